@@ -0,0 +1,413 @@
+/**
+ * @brief Access log of the http requests (combined or JSON format)
+ *
+ * @file accesslog.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Access log formats
+const (
+	ACCESSLOG_COMBINED = 1 //Combined log format + restincl fields
+	ACCESSLOG_JSON     = 2 //One JSON object per line
+)
+
+//Defaults
+const (
+	ACCESSLOG_FORMAT_DEFAULT  = "combined"
+	ACCESSLOG_BACKUPS_DEFAULT = 5
+)
+
+//Access log file, rotated by size
+type AccessLog struct {
+	mu      sync.Mutex
+	path    string
+	format  int
+	maxSize int64 //Rotate when file reaches this size, 0 - no rotation
+	backups int   //Number of rotated files to keep
+	f       *os.File
+	size    int64
+}
+
+//Access log configuration (from ini), log opened after config load
+var M_accesslog_file string
+var M_accesslog_format string = ACCESSLOG_FORMAT_DEFAULT
+var M_accesslog_maxsize int //Megabytes
+var M_accesslog_backups int = ACCESSLOG_BACKUPS_DEFAULT
+
+var M_accesslog *AccessLog //nil if access logging is disabled
+
+//Response writer collecting access log data of the request
+type accessWriter struct {
+	w        http.ResponseWriter //Real writer
+	start    time.Time
+	status   int
+	bytesIn  int64
+	bytesOut int64
+	route    string
+	svc      string
+	tpErr    int
+	errSrc   string
+	worker   int
+	mask     *MaskRules //Masking of the URL
+}
+
+//JSON access log record
+type accessRecord struct {
+	Time      string  `json:"time"`
+	Remote    string  `json:"remote"`
+	Method    string  `json:"method"`
+	Url       string  `json:"url"`
+	Proto     string  `json:"proto"`
+	Route     string  `json:"route"`
+	Svc       string  `json:"svc"`
+	Status    int     `json:"status"`
+	TpErr     int     `json:"tperrno"`
+	ErrSrc    string  `json:"errsrc"`
+	LatencyMs float64 `json:"latency_ms"`
+	BytesIn   int64   `json:"bytes_in"`
+	BytesOut  int64   `json:"bytes_out"`
+	Worker    int     `json:"worker"`
+	Referer   string  `json:"referer"`
+	UserAgent string  `json:"user_agent"`
+}
+
+//Request body reader counting the bytes received
+type countingReader struct {
+	r io.ReadCloser
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	return c.r.Close()
+}
+
+//Open the access log
+//@param ac ATMI Context
+//@return error or nil
+func accessLogOpen(ac *atmi.ATMICtx) error {
+
+	l := AccessLog{path: M_accesslog_file,
+		maxSize: int64(M_accesslog_maxsize) * 1024 * 1024,
+		backups: M_accesslog_backups}
+
+	switch M_accesslog_format {
+	case "combined":
+		l.format = ACCESSLOG_COMBINED
+	case "json":
+		l.format = ACCESSLOG_JSON
+	default:
+		return errors.New(fmt.Sprintf("Invalid accesslog_format [%s], "+
+			"valid: combined, json", M_accesslog_format))
+	}
+
+	if l.backups < 1 {
+		l.backups = 1
+	}
+
+	if err := l.open(); nil != err {
+		return err
+	}
+
+	ac.TpLogInfo("Access log [%s] format: %s maxsize: %d MB backups: %d",
+		l.path, M_accesslog_format, M_accesslog_maxsize, l.backups)
+
+	M_accesslog = &l
+
+	return nil
+}
+
+//Open (append) the log file
+func (l *AccessLog) open() error {
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+
+	if nil != err {
+		return errors.New(fmt.Sprintf("Failed to open access log [%s]: %s",
+			l.path, err.Error()))
+	}
+
+	l.f = f
+	l.size = 0
+
+	if fi, err := f.Stat(); nil == err {
+		l.size = fi.Size()
+	}
+
+	return nil
+}
+
+//Rotate the log: path.N-1 -> path.N, ..., path -> path.1
+//Called with lock held
+func (l *AccessLog) rotate() {
+
+	l.f.Close()
+
+	for i := l.backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i),
+			fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+
+	if err := os.Rename(l.path, l.path+".1"); nil != err {
+		M_ac.TpLogError("Failed to rotate access log [%s]: %s",
+			l.path, err.Error())
+	}
+
+	if err := l.open(); nil != err {
+		M_ac.TpLogError("%s", err.Error())
+	}
+}
+
+//Write single line to the log
+func (l *AccessLog) write(line string) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if nil == l.f {
+		//Re-open failed at rotation, try again
+		if err := l.open(); nil != err {
+			return
+		}
+	}
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		l.rotate()
+
+		if nil == l.f {
+			return
+		}
+	}
+
+	n, err := l.f.WriteString(line)
+	l.size += int64(n)
+
+	if nil != err {
+		M_ac.TpLogError("Failed to write access log: %s", err.Error())
+		l.f.Close()
+		l.f = nil
+	}
+}
+
+//Close the log
+func (l *AccessLog) close() {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if nil != l.f {
+		l.f.Close()
+		l.f = nil
+	}
+}
+
+//Start the access logging of the request
+//@param w response writer
+//@param req request, body gets counted
+//@return access log writer
+func newAccessWriter(w http.ResponseWriter, req *http.Request) *accessWriter {
+
+	aw := accessWriter{w: w, start: time.Now(), worker: atmi.FAIL,
+		mask: M_defaults.Mask}
+
+	if nil != req.Body {
+		req.Body = &countingReader{r: req.Body, n: &aw.bytesIn}
+	}
+
+	return &aw
+}
+
+//Get the access log writer of the response, if logging is enabled
+//@param w response writer (possibly wrapped by cache)
+//@return access writer or nil
+func accessWriterOf(w http.ResponseWriter) *accessWriter {
+
+	if cw, ok := w.(*cacheWriter); ok {
+		w = cw.w
+	}
+
+	aw, _ := w.(*accessWriter)
+
+	return aw
+}
+
+//Record the route serving the request
+//@param w response writer
+//@param svc route
+func accessRoute(w http.ResponseWriter, svc *ServiceMap) {
+
+	if aw := accessWriterOf(w); nil != aw {
+		aw.route = svc.Url
+		aw.svc = svc.Svc
+		aw.mask = svc.Mask
+	}
+}
+
+func (aw *accessWriter) Header() http.Header {
+	return aw.w.Header()
+}
+
+func (aw *accessWriter) WriteHeader(code int) {
+	if 0 == aw.status {
+		aw.status = code
+	}
+	aw.w.WriteHeader(code)
+}
+
+func (aw *accessWriter) Write(b []byte) (int, error) {
+	if 0 == aw.status {
+		aw.status = http.StatusOK
+	}
+	n, err := aw.w.Write(b)
+	aw.bytesOut += int64(n)
+	return n, err
+}
+
+//Flush streamed data (used by proxy)
+func (aw *accessWriter) Flush() {
+	if f, ok := aw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+//Take over the connection (used by proxy for Upgrade requests, e.g. WebSocket)
+func (aw *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+
+	hj, ok := aw.w.(http.Hijacker)
+
+	if !ok {
+		return nil, nil, fmt.Errorf("connection cannot be hijacked")
+	}
+
+	if 0 == aw.status {
+		aw.status = http.StatusSwitchingProtocols
+	}
+
+	return hj.Hijack()
+}
+
+//Dash for empty values in combined format
+func clfValue(s string) string {
+
+	if "" == s {
+		return "-"
+	}
+
+	return s
+}
+
+//Write the access log line of the finished request
+//@param aw access writer of the request
+//@param req request
+func (l *AccessLog) log(aw *accessWriter, req *http.Request) {
+
+	latency := time.Since(aw.start)
+
+	if 0 == aw.status {
+		aw.status = http.StatusOK
+	}
+
+	remote, _, err := net.SplitHostPort(req.RemoteAddr)
+
+	if nil != err {
+		remote = req.RemoteAddr
+	}
+
+	//Real client behind trusted proxies
+	if nil != M_trusted {
+		if ip := clientIP(req); nil != ip {
+			remote = ip.String()
+		}
+	}
+
+	var line string
+	reqURI := aw.mask.maskURL(req.URL)
+
+	if ACCESSLOG_JSON == l.format {
+
+		rec := accessRecord{Time: aw.start.Format(time.RFC3339Nano),
+			Remote: remote, Method: req.Method, Url: reqURI,
+			Proto: req.Proto, Route: aw.route, Svc: aw.svc, Status: aw.status,
+			TpErr: aw.tpErr, ErrSrc: aw.errSrc,
+			LatencyMs: float64(latency.Nanoseconds()) / 1000000.0,
+			BytesIn:   aw.bytesIn, BytesOut: aw.bytesOut, Worker: aw.worker,
+			Referer: req.Referer(), UserAgent: req.UserAgent()}
+
+		js, errJ := json.Marshal(&rec)
+
+		if nil != errJ {
+			M_ac.TpLogError("Failed to build access log record: %s", errJ.Error())
+			return
+		}
+
+		line = string(js) + "\n"
+	} else {
+
+		worker := "-"
+
+		if aw.worker > atmi.FAIL {
+			worker = fmt.Sprintf("%d", aw.worker)
+		}
+
+		line = fmt.Sprintf("%s - - [%s] %q %d %d %q %q route=%s svc=%s "+
+			"tperrno=%d errsrc=%s latency=%.6f in=%d worker=%s\n",
+			remote, aw.start.Format("02/Jan/2006:15:04:05 -0700"),
+			req.Method+" "+reqURI+" "+req.Proto,
+			aw.status, aw.bytesOut, clfValue(req.Referer()),
+			clfValue(req.UserAgent()), clfValue(aw.route),
+			clfValue(strings.Replace(aw.svc, " ", "_", -1)), aw.tpErr,
+			clfValue(aw.errSrc), latency.Seconds(), aw.bytesIn, worker)
+	}
+
+	l.write(line)
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
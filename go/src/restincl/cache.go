@@ -0,0 +1,476 @@
+/**
+ * @brief Response cache for GET routes
+ *
+ * @file cache.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Cached response
+type cacheEntry struct {
+	key     string
+	path    string
+	header  http.Header
+	body    []byte
+	etag    string
+	stored  time.Time
+	expires time.Time
+}
+
+//LRU Response cache of the route
+type RspCache struct {
+	url    string
+	size   int
+	mutex  sync.Mutex
+	lru    *list.List
+	items  map[string]*list.Element
+	hits   int64
+	misses int64
+}
+
+//Cache statistics for admin calls
+type CacheStats struct {
+	Url     string `json:"url"`
+	Entries int    `json:"entries"`
+	Hits    int64  `json:"hits"`
+	Misses  int64  `json:"misses"`
+}
+
+//Response writer which collects the response for caching
+type cacheWriter struct {
+	w       http.ResponseWriter //Real writer
+	header  http.Header
+	code    int
+	body    bytes.Buffer
+	key     string //Cache key
+	noStore bool   //Caller requested not to store the response
+	ttl     int    //TTL set by service, -1 not set
+	tpErr   int    //XATMI error code of the response
+}
+
+//List of route caches, key is route URL
+var M_caches = make(map[string]*RspCache)
+
+//Create new cache
+//@param url route url
+//@param size max number of entries
+func newRspCache(url string, size int) *RspCache {
+	return &RspCache{url: url, size: size, lru: list.New(),
+		items: make(map[string]*list.Element)}
+}
+
+//Get the entry from the cache, expired entries are removed
+//@param key cache key
+//@return entry or nil if not found
+func (c *RspCache) get(key string) *cacheEntry {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	el, ok := c.items[key]
+
+	if !ok {
+		c.misses++
+		return nil
+	}
+
+	e := el.Value.(*cacheEntry)
+
+	if time.Now().After(e.expires) {
+		c.lru.Remove(el)
+		delete(c.items, key)
+		c.misses++
+		return nil
+	}
+
+	c.lru.MoveToFront(el)
+	c.hits++
+
+	return e
+}
+
+//Add entry to the cache, least recently used entries are evicted
+//@param e entry to add
+func (c *RspCache) put(e *cacheEntry) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.items[e.key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.items[e.key] = c.lru.PushFront(e)
+
+	for c.lru.Len() > c.size {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.items, el.Value.(*cacheEntry).key)
+	}
+}
+
+//Remove entries from the cache
+//@param path request path to remove, if empty all entries are removed
+//@return number of entries removed
+func (c *RspCache) purge(path string) int {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if "" == path {
+		n := c.lru.Len()
+		c.lru.Init()
+		c.items = make(map[string]*list.Element)
+		return n
+	}
+
+	n := 0
+	for el := c.lru.Front(); nil != el; {
+		next := el.Next()
+		e := el.Value.(*cacheEntry)
+
+		if e.path == path {
+			c.lru.Remove(el)
+			delete(c.items, e.key)
+			n++
+		}
+		el = next
+	}
+
+	return n
+}
+
+//Get cache statistics
+func (c *RspCache) stats() CacheStats {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return CacheStats{Url: c.url, Entries: c.lru.Len(), Hits: c.hits,
+		Misses: c.misses}
+}
+
+//Check is Cache-Control directive present in header value
+//@param hdr Cache-Control header value
+//@param directive directive to search for e.g. "no-store"
+//@return directive value (if have one) and true if found
+func cacheDirective(hdr string, directive string) (string, bool) {
+
+	for _, d := range strings.Split(hdr, ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+
+		if d == directive {
+			return "", true
+		} else if strings.HasPrefix(d, directive+"=") {
+			return strings.Trim(d[len(directive)+1:], "\""), true
+		}
+	}
+
+	return "", false
+}
+
+//Build the cache key: host, path, sorted query and configured headers. Host
+//is included, as the route may serve several virtual hosts.
+//@param svc service map
+//@param req request
+func cacheKey(svc *ServiceMap, req *http.Request) string {
+
+	key := vhostNormalize(req.Host) + req.URL.Path + "?" +
+		req.URL.Query().Encode()
+
+	//Responses of different wire formats
+	if svc.Formats_ubf {
+		key += "\naccept:" + req.Header.Get("Accept") +
+			"\ncontent-type:" + req.Header.Get("Content-Type")
+	}
+
+	for _, h := range svc.Cache_headers_arr {
+		key += "\n" + strings.ToLower(h) + ":" +
+			strings.Join(req.Header[http.CanonicalHeaderKey(h)], ",")
+	}
+
+	return key
+}
+
+//Check does the ETag match the If-None-Match header
+//@param req request
+//@param etag entity tag of the response
+func etagMatch(req *http.Request, etag string) bool {
+
+	inm := req.Header.Get("If-None-Match")
+
+	if "" == inm || "" == etag {
+		return false
+	}
+
+	for _, t := range strings.Split(inm, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || t == etag || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Write the response (possibly not modified) to the caller
+//@param w real response writer
+//@param req request
+//@param header response headers
+//@param code http status code
+//@param body response body
+//@param etag entity tag, if cachable response
+func cacheWriteRsp(w http.ResponseWriter, req *http.Request, header http.Header,
+	code int, body []byte, etag string) {
+
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+
+	if http.StatusOK == code && etagMatch(req, etag) {
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if http.StatusOK != code {
+		w.WriteHeader(code)
+	}
+
+	w.Write(body)
+}
+
+//Lookup the response in the cache. If found, response is sent to caller.
+//@param ac ATMI Context (for logging)
+//@param svc service map
+//@param w response writer
+//@param req request
+//@return nil if served from cache, otherwise writer which collects the response
+func cacheLookup(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
+	req *http.Request) *cacheWriter {
+
+	cw := cacheWriter{w: w, header: make(http.Header), ttl: atmi.FAIL,
+		key: cacheKey(svc, req)}
+
+	reqCC := req.Header.Get("Cache-Control")
+	_, noCache := cacheDirective(reqCC, "no-cache")
+	_, cw.noStore = cacheDirective(reqCC, "no-store")
+
+	if noCache || cw.noStore || "no-cache" == req.Header.Get("Pragma") {
+		ac.TpLogInfo("Cache lookup bypassed by request, key [%s]", cw.key)
+		return &cw
+	}
+
+	e := svc.RspCache.get(cw.key)
+
+	if nil == e {
+		ac.TpLogDebug("Cache miss, key [%s]", cw.key)
+		return &cw
+	}
+
+	ac.TpLogInfo("Cache hit, key [%s] etag [%s]", cw.key, e.etag)
+
+	header := make(http.Header)
+	for k, v := range e.header {
+		header[k] = v
+	}
+	header.Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+
+	cacheWriteRsp(w, req, header, http.StatusOK, e.body, e.etag)
+
+	return nil
+}
+
+func (cw *cacheWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *cacheWriter) WriteHeader(code int) {
+	if 0 == cw.code {
+		cw.code = code
+	}
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	if 0 == cw.code {
+		cw.code = http.StatusOK
+	}
+	return cw.body.Write(b)
+}
+
+//Load cache related data from the response buffer
+//@param ac ATMI Context
+//@param buf response buffer
+//@param err response error
+func (cw *cacheWriter) loadRspInfo(ac *atmi.ATMICtx, buf atmi.TypedBuffer,
+	err atmi.ATMIError) {
+
+	cw.tpErr = err.Code()
+
+	if bufu, ok := buf.(*atmi.TypedUBF); ok && bufu.BPres(ubftab.EX_IF_CACHETTL, 0) {
+		cw.ttl, _ = bufu.BGetInt(ubftab.EX_IF_CACHETTL, 0)
+		bufu.BDel(ubftab.EX_IF_CACHETTL, 0)
+		ac.TpLogDebug("Service requested cache ttl: %d", cw.ttl)
+	}
+}
+
+//Store the collected response in cache (if cachable) and send it to caller
+//@param ac ATMI Context
+//@param svc service map
+//@param req request
+func (cw *cacheWriter) finish(ac *atmi.ATMICtx, svc *ServiceMap, req *http.Request) {
+
+	etag := ""
+
+	if 0 == cw.code {
+		cw.code = http.StatusOK
+	}
+
+	ttl := svc.Cache_ttl
+
+	rspCC := cw.header.Get("Cache-Control")
+	_, noStore := cacheDirective(rspCC, "no-store")
+	_, noCache := cacheDirective(rspCC, "no-cache")
+	_, private := cacheDirective(rspCC, "private")
+
+	if maxAge, ok := cacheDirective(rspCC, "max-age"); ok {
+		ttl, _ = strconv.Atoi(maxAge)
+	}
+
+	if cw.ttl > atmi.FAIL {
+		ttl = cw.ttl
+	}
+
+	if http.StatusOK == cw.code && atmi.TPMINVAL == cw.tpErr && ttl > 0 &&
+		!cw.noStore && !noStore && !noCache && !private {
+
+		etag = cw.header.Get("ETag")
+
+		if "" == etag {
+			sum := sha1.Sum(cw.body.Bytes())
+			etag = "\"" + hex.EncodeToString(sum[:]) + "\""
+			cw.header.Set("ETag", etag)
+		}
+
+		//Per request headers are not replayed to other callers
+		header := make(http.Header)
+
+		for k, v := range cw.header {
+			header[k] = v
+		}
+
+		for _, h := range M_cacheNoStoreHdr {
+			header.Del(h)
+		}
+
+		now := time.Now()
+		e := cacheEntry{key: cw.key, path: req.URL.Path, header: header,
+			body: cw.body.Bytes(), etag: etag, stored: now,
+			expires: now.Add(time.Duration(ttl) * time.Second)}
+
+		ac.TpLogInfo("Caching response, key [%s] ttl %d etag [%s]",
+			cw.key, ttl, etag)
+		svc.RspCache.put(&e)
+	} else {
+		ac.TpLogDebug("Response not cached: http %d tperrno %d ttl %d",
+			cw.code, cw.tpErr, ttl)
+	}
+
+	cacheWriteRsp(cw.w, req, cw.header, cw.code, cw.body.Bytes(), etag)
+}
+
+//Response headers which are specific to the request and are not stored in cache
+var M_cacheNoStoreHdr = []string{"Set-Cookie", TRACE_HDR_PARENT, TRACE_HDR_STATE}
+
+//Cache administration handler. GET returns the cache statistics,
+//POST/DELETE purges the cache. Query parameter "url" selects the route
+//(all routes if not set), "path" selects request path (all if not set).
+//@param w response writer
+//@param req request
+func cacheAdmin(w http.ResponseWriter, req *http.Request) {
+
+	var rsp []byte
+	url := req.URL.Query().Get("url")
+	path := req.URL.Query().Get("path")
+
+	switch req.Method {
+	case "GET":
+		stats := []CacheStats{}
+
+		for k, c := range M_caches {
+			if "" == url || k == url {
+				stats = append(stats, c.stats())
+			}
+		}
+
+		rsp, _ = json.Marshal(stats)
+		break
+	case "POST", "DELETE":
+		purged := 0
+
+		for k, c := range M_caches {
+			if "" == url || k == url {
+				purged += c.purge(path)
+			}
+		}
+
+		M_ac.TpLogWarn("Cache purge url [%s] path [%s]: %d entries removed",
+			url, path, purged)
+
+		rsp = []byte("{\"purged\":" + strconv.Itoa(purged) + "}")
+		break
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(rsp)))
+	w.Write(rsp)
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
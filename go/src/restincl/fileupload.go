@@ -33,6 +33,7 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -50,12 +51,33 @@ const (
 	FILES_FLAG_DELETE = "D" //Delete the file (RFU)
 )
 
+//Streamed upload modes
+const (
+	UPLOAD_MODE_CHUNKS   = "chunks" //Call upload service for each chunk
+	UPLOAD_MODE_CONV     = "conv"   //Send chunks in conversation
+	UPLOAD_HDR_RESERVE   = 4096     //Buffer space for chunk fields except data
+	UPLOAD_MODE_DEFAULT  = UPLOAD_MODE_CHUNKS
+	UPLOAD_CHUNK_DEFAULT = 65536 //Chunk size, bytes
+
+	UPLOAD_SCAN_TIME_DEFAULT = 60 //Scanner command timeout, seconds
+)
+
 //This is used to strack
 //additional request details
 //Including list of files uploaded
 type RequestContext struct {
 	errSrc   string
 	fileList []string
+	upldIds  []string
+	fltSkip  bool //Filter requested to skip remaining filters
+	fltReply bool //Filter requested to reply with current buffer
+	rspCode  int  //Forced http status code of the response (if not 0)
+	reqUBF   bool //Request body is binary UBF
+	rspUBF   bool //Respond with binary UBF
+
+	traceParent string //W3C traceparent passed to services
+	traceState  string //W3C tracestate passed to services
+	traceId     string
 }
 
 //Prepare file upload (request part, download & prepare the UBF buffer)
@@ -64,9 +86,10 @@ type RequestContext struct {
 //@param svc Target service
 //@param req HTTP request obj
 //@param rctx request context attributes
+//@param flags call flags for streamed upload service
 //@return ATMI error or nil
 func handleFileUploadReq(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, svc *ServiceMap,
-	r *http.Request, rctx *RequestContext) atmi.ATMIError {
+	r *http.Request, rctx *RequestContext, flags int64) atmi.ATMIError {
 
 	var n int
 	var err error
@@ -86,6 +109,7 @@ func handleFileUploadReq(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, svc *ServiceMap,
 
 	// buffer to be used for reading bytes from files
 	chunk := make([]byte, 4096)
+	v := newUploadVerifier(ac, svc, rctx)
 
 	for {
 		var tempfile *os.File
@@ -100,15 +124,27 @@ func handleFileUploadReq(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, svc *ServiceMap,
 
 			} else {
 				ac.TpLogInfo("Multipart upload OK")
-				return nil
+				//Scan files before target service is called
+				return v.scan(ac, bufu, flags)
 			}
 		}
 
-		ac.TpLogDebug("Uploaded filename occ=%d: %s", occ, part.FileName())
+		fname := part.FileName()
+
+		ac.TpLogDebug("Uploaded filename occ=%d: %s", occ, fname)
 		ac.TpLogDebug("Uploaded mimetype occ=%d: %s", occ, part.Header)
 
+		if svc.Upload_sanitize {
+			fname = uploadSanitizeName(fname)
+			ac.TpLogDebug("Sanitized filename occ=%d: %s", occ, fname)
+		}
+
+		if errA := v.start(part); nil != errA {
+			return errA
+		}
+
 		//Add the file names to the buffer
-		if errU := bufu.BAdd(ubftab.EX_IF_REQFILENAME, part.FileName()); nil != errU {
+		if errU := bufu.BAdd(ubftab.EX_IF_REQFILENAME, fname); nil != errU {
 			ac.TpLogError("Failed to add EX_IF_REQFILENAME[%d]: %s", occ, errU.Error())
 			return atmi.NewCustomATMIError(atmi.TPESYSTEM,
 				fmt.Sprintf("Failed to add EX_IF_REQFILENAME[%d]: %s", occ, errU.Error()))
@@ -126,6 +162,17 @@ func handleFileUploadReq(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, svc *ServiceMap,
 				fmt.Sprintf("Failed to add EX_IF_REQFILEMIME[%d]: %s", occ, errU.Error()))
 		}
 
+		//Stream to service instead of temp file
+		if "" != svc.Upload_svc {
+			if errA := uploadStreamPart(ac, bufu, svc, part, v, occ,
+				flags); nil != errA {
+				return errA
+			}
+
+			occ++
+			continue
+		}
+
 		//Add the file name to received rctx
 
 		tempfile, err = ioutil.TempFile(svc.Tempdir, fmt.Sprintf("%s-%s", progsection, M_cctag))
@@ -156,6 +203,10 @@ func handleFileUploadReq(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, svc *ServiceMap,
 				uploaded = true
 			}
 
+			if errA := v.write(chunk[:n]); nil != errA {
+				return errA
+			}
+
 			if n, err = tempfile.Write(chunk[:n]); err != nil {
 				ac.TpLogError("Error writing chunk to [%s]: %s", tempfile.Name(), err.Error())
 				return atmi.NewCustomATMIError(atmi.TPEOS,
@@ -166,11 +217,313 @@ func handleFileUploadReq(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, svc *ServiceMap,
 
 		ac.TpLogInfo("Uploaded file [%s] size: %d bytes", tempfile.Name(), filesize)
 
+		sum, errA := v.finish()
+
+		if nil != errA {
+			return errA
+		}
+
+		if errA = v.load(bufu, occ, sum); nil != errA {
+			return errA
+		}
+
 		occ++
 	}
 
 }
 
+//Set the fields of the chunk buffer
+//@param chunkbuf chunk buffer
+//@param bufu request buffer, file attributes are copied from
+//@param occ file occurrence in request buffer
+//@param id upload id of the part
+//@param offset chunk offset in the part
+//@param data chunk data
+//@param sum SHA-256 of the part, set on final chunk ("" otherwise)
+//@return UBF error or nil
+func uploadChunkSet(chunkbuf *atmi.TypedUBF, bufu *atmi.TypedUBF, occ int,
+	id string, offset int64, data []byte, sum string) atmi.UBFError {
+
+	finalFlag := FALSE
+
+	if "" != sum {
+		finalFlag = TRUE
+
+		if errU := chunkbuf.BChg(ubftab.EX_IF_UPLDSIZE, 0,
+			offset+int64(len(data))); nil != errU {
+			return errU
+		}
+
+		if errU := chunkbuf.BChg(ubftab.EX_IF_REQFILESHA256, 0, sum); nil != errU {
+			return errU
+		}
+	}
+
+	if errU := chunkbuf.BChg(ubftab.EX_IF_UPLDID, 0, id); nil != errU {
+		return errU
+	}
+
+	if errU := chunkbuf.BChg(ubftab.EX_IF_UPLDOFFSET, 0, offset); nil != errU {
+		return errU
+	}
+
+	if errU := chunkbuf.BChg(ubftab.EX_IF_UPLDFINAL, 0, finalFlag); nil != errU {
+		return errU
+	}
+
+	if errU := chunkbuf.BChg(ubftab.EX_IF_REQDATA, 0, data); nil != errU {
+		return errU
+	}
+
+	for _, fld := range []int{ubftab.EX_IF_REQFILENAME, ubftab.EX_IF_REQFILEFORM,
+		ubftab.EX_IF_REQFILEMIME} {
+
+		val, _ := bufu.BGetString(fld, occ)
+
+		if errU := chunkbuf.BChg(fld, 0, val); nil != errU {
+			return errU
+		}
+	}
+
+	return nil
+}
+
+//Map the conversation failure to ATMI error, disconnect if needed
+//@param ac ATMI Context
+//@param cd conversation descriptor
+//@param revent conversation event
+//@param errA error of the conversation call
+//@return ATMI error
+func uploadConvErr(ac *atmi.ATMICtx, cd int, revent int,
+	errA atmi.ATMIError) atmi.ATMIError {
+
+	if atmi.TPEEVENT != errA.Code() {
+		ac.TpDiscon(cd)
+		return errA
+	}
+
+	ac.TpLogError("Upload conversation %d event %d", cd, revent)
+
+	if atmi.TPEV_SVCFAIL == revent {
+		return atmi.NewCustomATMIError(atmi.TPESVCFAIL,
+			"Upload service failed")
+	}
+
+	return atmi.NewCustomATMIError(atmi.TPESVCERR,
+		fmt.Sprintf("Upload conversation ended with event %d", revent))
+}
+
+//Stream the file part to upload service in chunks. Chunks are sent either
+//as separate calls (chunks mode) or in single conversation (conv mode),
+//where after last chunk restincl waits for the service to return.
+//Upload id and size of the part are added to request buffer.
+//@param ac ATMI Context
+//@param bufu request buffer of the target service
+//@param svc route
+//@param part multipart part
+//@param v upload verifier of the request
+//@param occ file occurrence in request buffer
+//@param flags call flags
+//@return ATMI error or nil
+func uploadStreamPart(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, svc *ServiceMap,
+	part *multipart.Part, v *uploadVerifier, occ int, flags int64) atmi.ATMIError {
+
+	var sum string
+
+	var offset int64
+	var revent int
+	cd := atmi.FAIL
+	id := traceRandId(16)
+
+	chunkbuf, errA := ac.NewUBF(int64(svc.Upload_chunk) + UPLOAD_HDR_RESERVE)
+
+	if nil != errA {
+		ac.TpLogError("Failed to allocate chunk buffer: %s", errA.Error())
+		return errA
+	}
+
+	data := make([]byte, svc.Upload_chunk)
+	rd := bufio.NewReaderSize(part, svc.Upload_chunk)
+
+	ac.TpLogInfo("Streaming part [%s] to [%s] upload id [%s] mode [%s]",
+		part.FileName(), svc.Upload_svc, id, svc.Upload_mode)
+
+	for final := false; !final; {
+
+		n, err := io.ReadFull(rd, data)
+
+		if nil != err && io.EOF != err && io.ErrUnexpectedEOF != err {
+
+			if atmi.FAIL != cd {
+				ac.TpDiscon(cd)
+			}
+
+			ac.TpLogError("Error reading chunk: %s", err.Error())
+			return atmi.NewCustomATMIError(atmi.TPESYSTEM,
+				fmt.Sprintf("Error reading chunk: %s", err.Error()))
+		}
+
+		if final = nil != err; !final {
+			//Full chunk read, check is there anything left
+			_, err = rd.Peek(1)
+			final = io.EOF == err
+		}
+
+		//Verify content before it is passed to upload service
+		errA = v.write(data[:n])
+
+		if nil == errA && 0 == offset {
+			if errA = v.check(); nil == errA {
+				errA = v.loadMime(bufu, occ)
+			}
+		}
+
+		if nil == errA && final {
+			sum, errA = v.finish()
+		}
+
+		if nil != errA {
+
+			if atmi.FAIL != cd {
+				ac.TpDiscon(cd)
+			}
+
+			return errA
+		}
+
+		if errU := uploadChunkSet(chunkbuf, bufu, occ, id, offset, data[:n],
+			sum); nil != errU {
+
+			if atmi.FAIL != cd {
+				ac.TpDiscon(cd)
+			}
+
+			return atmi.NewCustomATMIError(atmi.TPESYSTEM,
+				fmt.Sprintf("Failed to prepare chunk %d:[%s]",
+					errU.Code(), errU.Message()))
+		}
+
+		ac.TpLogDebug("Upload [%s] chunk offset %d size %d final %t",
+			id, offset, n, final)
+
+		//Upload service may have data from now on, abort needed on failure
+		if 0 == offset && UPLOAD_MODE_CONV != svc.Upload_mode {
+			v.rctx.upldIds = append(v.rctx.upldIds, id)
+		}
+
+		offset += int64(n)
+
+		if UPLOAD_MODE_CONV != svc.Upload_mode {
+			if _, errA = ac.TpCall(svc.Upload_svc, chunkbuf, flags); nil != errA {
+				ac.TpLogError("Upload service [%s] failed: %s",
+					svc.Upload_svc, errA.Error())
+				return errA
+			}
+		} else if atmi.FAIL == cd {
+
+			cflags := flags | atmi.TPSENDONLY
+
+			if final {
+				cflags = flags | atmi.TPRECVONLY
+			}
+
+			if cd, errA = ac.TpConnect(svc.Upload_svc, chunkbuf, cflags); nil != errA {
+				ac.TpLogError("Failed to connect to upload service [%s]: %s",
+					svc.Upload_svc, errA.Error())
+				return errA
+			}
+		} else {
+
+			sflags := flags
+
+			if final {
+				sflags |= atmi.TPRECVONLY
+			}
+
+			if revent, errA = ac.TpSend(cd, chunkbuf, sflags); nil != errA {
+				return uploadConvErr(ac, cd, revent, errA)
+			}
+		}
+	}
+
+	//Wait for the service to finish the conversation
+	for atmi.FAIL != cd {
+
+		if revent, errA = ac.TpRecv(cd, chunkbuf, flags); nil == errA {
+			//Data sent back by service is not used
+			continue
+		}
+
+		if atmi.TPEEVENT != errA.Code() || atmi.TPEV_SVCSUCC != revent {
+			return uploadConvErr(ac, cd, revent, errA)
+		}
+
+		cd = atmi.FAIL
+	}
+
+	ac.TpLogInfo("Upload [%s] done, size: %d bytes", id, offset)
+
+	if errA = v.load(bufu, occ, sum); nil != errA {
+		return errA
+	}
+
+	if errU := bufu.BAdd(ubftab.EX_IF_UPLDID, id); nil != errU {
+		return atmi.NewCustomATMIError(atmi.TPESYSTEM,
+			fmt.Sprintf("Failed to add EX_IF_UPLDID: %s", errU.Error()))
+	}
+
+	if errU := bufu.BAdd(ubftab.EX_IF_UPLDSIZE, offset); nil != errU {
+		return atmi.NewCustomATMIError(atmi.TPESYSTEM,
+			fmt.Sprintf("Failed to add EX_IF_UPLDSIZE: %s", errU.Error()))
+	}
+
+	return nil
+}
+
+//Notify upload service that the streamed uploads of the request are aborted
+//(chunks mode), as request failed before target service was called. Service
+//is called for each upload id with EX_IF_UPLDABORT set to 1 and shall remove
+//the data received. Conversational uploads are aborted by disconnect.
+//@param ac ATMI Context
+//@param svc route
+//@param rctx request context with upload ids sent
+//@param flags call flags
+func uploadAbort(ac *atmi.ATMICtx, svc *ServiceMap, rctx *RequestContext,
+	flags int64) {
+
+	if 0 == len(rctx.upldIds) {
+		return
+	}
+
+	abortbuf, errA := ac.NewUBF(1024)
+
+	if nil != errA {
+		ac.TpLogError("Failed to allocate abort buffer: %s", errA.Error())
+		return
+	}
+
+	for _, id := range rctx.upldIds {
+
+		ac.TpLogWarn("Aborting upload [%s] at [%s]", id, svc.Upload_svc)
+
+		if errU := abortbuf.BChg(ubftab.EX_IF_UPLDID, 0, id); nil != errU {
+			ac.TpLogError("Failed to set EX_IF_UPLDID: %s", errU.Error())
+			return
+		}
+
+		if errU := abortbuf.BChg(ubftab.EX_IF_UPLDABORT, 0, TRUE); nil != errU {
+			ac.TpLogError("Failed to set EX_IF_UPLDABORT: %s", errU.Error())
+			return
+		}
+
+		if _, errA = ac.TpCall(svc.Upload_svc, abortbuf, flags); nil != errA {
+			ac.TpLogError("Upload [%s] abort failed: %s", id, errA.Error())
+		}
+	}
+
+	rctx.upldIds = nil
+}
+
 //Handle response after the file processed
 //@param ac ATMI Context
 //@param ubfu UBF buffer used for request handling
@@ -0,0 +1,179 @@
+/**
+ * @brief HTTP/2 (TLS and h2c) server setup and protocol metrics
+ *
+ * @file http2.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	atmi "github.com/endurox-dev/endurox-go"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+//HTTP/2 settings
+var M_http2 bool = true         //HTTP/2 over TLS
+var M_h2c bool = false          //Cleartext HTTP/2 (prior knowledge) for non TLS
+var M_http2_max_streams int = 0 //Max concurrent streams per connection, 0 - workers
+
+//Request statistics by protocol version
+type ProtoStats struct {
+	Proto  string `json:"proto"`
+	Active int64  `json:"active"` //Requests / streams in progress
+	Peak   int64  `json:"peak"`   //Max requests in progress seen
+	Total  int64  `json:"total"`  //Requests served
+}
+
+var M_protoStats = make(map[string]*ProtoStats)
+var M_protoStatsMu sync.Mutex
+
+//Build the http server with protocol settings
+//@param ac ATMI Context
+//@param listenOn listen address
+//@return http server, error
+func serverSetup(ac *atmi.ATMICtx, listenOn string) (*http.Server, error) {
+
+	srv := &http.Server{Addr: listenOn, Handler: &M_handler}
+
+	if M_http2_max_streams <= 0 {
+		M_http2_max_streams = M_workers
+	} else if M_http2_max_streams > M_workers {
+		ac.TpLogWarn("http2_max_streams %d exceeds workers %d - streams "+
+			"will wait for free XATMI session", M_http2_max_streams, M_workers)
+	}
+
+	h2srv := &http2.Server{MaxConcurrentStreams: uint32(M_http2_max_streams)}
+	h2 := false
+
+	if TRUE == M_tls_enable {
+
+		srv.TLSConfig = M_tls_config
+
+		if M_http2 {
+			if err := http2.ConfigureServer(srv, h2srv); nil != err {
+				return nil, fmt.Errorf("Failed to configure HTTP/2: %s",
+					err.Error())
+			}
+			h2 = true
+		} else {
+			//Non nil empty map disables HTTP/2 negotiation
+			srv.TLSNextProto = make(map[string]func(*http.Server,
+				*tls.Conn, http.Handler))
+		}
+	} else if M_h2c {
+		srv.Handler = h2c.NewHandler(&M_handler, h2srv)
+		h2 = true
+	}
+
+	ac.TpLogInfo("HTTP/2: %t, max concurrent streams: %d",
+		h2, M_http2_max_streams)
+
+	return srv, nil
+}
+
+//Account request start
+//@param proto request protocol version
+//@return function to call at request end
+func protoStatsEnter(proto string) func() {
+
+	M_protoStatsMu.Lock()
+
+	s := M_protoStats[proto]
+
+	if nil == s {
+		s = &ProtoStats{Proto: proto}
+		M_protoStats[proto] = s
+	}
+
+	s.Active++
+	s.Total++
+
+	if s.Active > s.Peak {
+		s.Peak = s.Active
+	}
+
+	M_protoStatsMu.Unlock()
+
+	return func() {
+		M_protoStatsMu.Lock()
+		s.Active--
+		M_protoStatsMu.Unlock()
+	}
+}
+
+//Metrics of the process
+type Metrics struct {
+	Workers         int          `json:"workers"`
+	FreeWorkers     int          `json:"free_workers"`
+	Http2MaxStreams int          `json:"http2_max_streams"`
+	Protocols       []ProtoStats `json:"protocols"`
+}
+
+//Serve process metrics (GET only)
+//@param w response writer
+//@param req request
+func metricsAdmin(w http.ResponseWriter, req *http.Request) {
+
+	if "GET" != req.Method {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	m := Metrics{Workers: M_workers, FreeWorkers: len(M_freechan),
+		Http2MaxStreams: M_http2_max_streams, Protocols: []ProtoStats{}}
+
+	M_protoStatsMu.Lock()
+
+	for _, s := range M_protoStats {
+		m.Protocols = append(m.Protocols, *s)
+	}
+
+	M_protoStatsMu.Unlock()
+
+	sort.Slice(m.Protocols, func(i, j int) bool {
+		return m.Protocols[i].Proto < m.Protocols[j].Proto
+	})
+
+	rsp, _ := json.Marshal(&m)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(rsp)))
+	w.Write(rsp)
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,324 @@
+/**
+ * @brief Client IP allow/deny lists (CIDR) and trusted proxies
+ *
+ * @file ipacl.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Client address access control lists
+type IPACL struct {
+	allow []*net.IPNet //If set, only these networks are allowed
+	deny  []*net.IPNet //Denied networks, checked first
+}
+
+//Forwarding headers, set by trusted proxies
+const (
+	IP_FORWARD_XFF       = "X-Forwarded-For"
+	IP_FORWARD_FORWARDED = "Forwarded" //RFC 7239
+)
+
+var M_ip_allow string        //Global allow list
+var M_ip_deny string         //Global deny list
+var M_trusted_proxies string //Proxies which forwarding headers are trusted
+var M_ipacl *IPACL           //Parsed global lists, nil if not used
+var M_trusted []*net.IPNet   //Parsed trusted proxies
+
+//Header which trusted proxies set, other one is ignored
+var M_ip_forward_header string = IP_FORWARD_XFF
+
+//Parse list of IP addresses / CIDR ranges
+//@param list comma or space separated list
+//@return parsed networks or error
+func ipParseList(list string) ([]*net.IPNet, error) {
+
+	var ret []*net.IPNet
+
+	for _, s := range strings.FieldsFunc(list, func(c rune) bool {
+		return ',' == c || ' ' == c || '\t' == c
+	}) {
+
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+
+			if nil == ip {
+				return nil, fmt.Errorf("Invalid IP address [%s]", s)
+			}
+
+			bits := 8 * net.IPv6len
+
+			if nil != ip.To4() {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+
+		if nil != err {
+			return nil, fmt.Errorf("Invalid CIDR [%s]: %s", s, err.Error())
+		}
+
+		ret = append(ret, n)
+	}
+
+	return ret, nil
+}
+
+//Check is address in any of the networks
+//@param nets networks
+//@param ip address
+//@return true if found
+func ipInList(nets []*net.IPNet, ip net.IP) bool {
+
+	if nil == ip {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Build access list from allow/deny settings
+//@param allow allow list
+//@param deny deny list
+//@return access list (nil if both empty) or error
+func ipaclNew(allow string, deny string) (*IPACL, error) {
+
+	var acl IPACL
+	var err error
+
+	if acl.allow, err = ipParseList(allow); nil != err {
+		return nil, err
+	}
+
+	if acl.deny, err = ipParseList(deny); nil != err {
+		return nil, err
+	}
+
+	if nil == acl.allow && nil == acl.deny {
+		return nil, nil
+	}
+
+	return &acl, nil
+}
+
+//Check the client address against the lists. Deny list wins, if allow
+//list is set, address must be in it.
+//@param ip client address
+//@return true if access allowed
+func (acl *IPACL) allowed(ip net.IP) bool {
+
+	if nil == acl {
+		return true
+	}
+
+	if ipInList(acl.deny, ip) {
+		return false
+	}
+
+	if nil != acl.allow && !ipInList(acl.allow, ip) {
+		return false
+	}
+
+	return true
+}
+
+//Parse the global access lists and trusted proxies
+//@param ac ATMI Context
+//@return error or nil
+func ipaclSetup(ac *atmi.ATMICtx) error {
+
+	var err error
+
+	if M_ipacl, err = ipaclNew(M_ip_allow, M_ip_deny); nil != err {
+		return fmt.Errorf("Invalid global `ip_allow'/`ip_deny': %s", err.Error())
+	}
+
+	if M_trusted, err = ipParseList(M_trusted_proxies); nil != err {
+		return fmt.Errorf("Invalid `trusted_proxies': %s", err.Error())
+	}
+
+	switch {
+	case strings.EqualFold(M_ip_forward_header, IP_FORWARD_XFF):
+		M_ip_forward_header = IP_FORWARD_XFF
+	case strings.EqualFold(M_ip_forward_header, IP_FORWARD_FORWARDED):
+		M_ip_forward_header = IP_FORWARD_FORWARDED
+	default:
+		return fmt.Errorf("Invalid `ip_forward_header' [%s], must be %s or %s",
+			M_ip_forward_header, IP_FORWARD_XFF, IP_FORWARD_FORWARDED)
+	}
+
+	ac.TpLogInfo("Global ip_allow: [%s] ip_deny: [%s] trusted_proxies: [%s] "+
+		"ip_forward_header: [%s]", M_ip_allow, M_ip_deny, M_trusted_proxies,
+		M_ip_forward_header)
+
+	return nil
+}
+
+//Parse the access lists of the route
+//@param ac ATMI Context
+//@param svc route
+//@return error or nil
+func validateIPACL(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	var err error
+
+	//Cache administration has no authentication, local access only by default
+	if CONV_CACHEADM == svc.Conv_int && "" == svc.Ip_allow {
+		ac.TpLogInfo("No `ip_allow' for cacheadm route [%s], using [%s]",
+			svc.Url, CACHEADM_IP_ALLOW_DEFAULT)
+		svc.Ip_allow = CACHEADM_IP_ALLOW_DEFAULT
+	}
+
+	if svc.Ipacl, err = ipaclNew(svc.Ip_allow, svc.Ip_deny); nil != err {
+		return fmt.Errorf("Invalid `ip_allow'/`ip_deny' for [%s]: %s",
+			svc.Url, err.Error())
+	}
+
+	return nil
+}
+
+//Parse address from forwarding header, port and brackets are removed
+//@param s address
+//@return IP or nil if not parsable (e.g. "unknown")
+func ipParseAddr(s string) net.IP {
+
+	s = strings.Trim(strings.TrimSpace(s), "\"")
+
+	if h, _, err := net.SplitHostPort(s); nil == err {
+		s = h
+	}
+
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
+
+//Return the forwarding chain of the request, client first. Only the header
+//set by trusted proxies (ip_forward_header) is used, as the other one is
+//passed through by proxy as sent by the client.
+//@param req request
+//@return chain of forwarded addresses
+func ipForwardChain(req *http.Request) []string {
+
+	var chain []string
+
+	if IP_FORWARD_FORWARDED == M_ip_forward_header {
+
+		fwd := req.Header.Values(IP_FORWARD_FORWARDED)
+
+		for _, elm := range strings.Split(strings.Join(fwd, ","), ",") {
+			for _, pair := range strings.Split(elm, ";") {
+
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+
+				if 2 == len(kv) && strings.EqualFold(kv[0], "for") {
+					chain = append(chain, kv[1])
+				}
+			}
+		}
+
+		return chain
+	}
+
+	for _, xff := range req.Header.Values(IP_FORWARD_XFF) {
+		chain = append(chain, strings.Split(xff, ",")...)
+	}
+
+	return chain
+}
+
+//Resolve the client address of the request. If the peer is trusted proxy,
+//forwarding headers are walked from the right, skipping trusted proxies.
+//@param req request
+//@return client address, nil if not parsable
+func clientIP(req *http.Request) net.IP {
+
+	ip := ipParseAddr(req.RemoteAddr)
+
+	if nil == M_trusted || !ipInList(M_trusted, ip) {
+		return ip
+	}
+
+	chain := ipForwardChain(req)
+
+	for i := len(chain) - 1; i >= 0; i-- {
+
+		ip = ipParseAddr(chain[i])
+
+		if !ipInList(M_trusted, ip) {
+			return ip
+		}
+	}
+
+	return ip
+}
+
+//Check the access lists for the request, respond with 403 if denied
+//@param w response writer
+//@param req request
+//@param acl access list to check
+//@return true if request may continue
+func ipCheck(w http.ResponseWriter, req *http.Request, acl *IPACL) bool {
+
+	if nil == acl {
+		return true
+	}
+
+	ip := clientIP(req)
+
+	if acl.allowed(ip) {
+		return true
+	}
+
+	M_ac.TpLogWarn("Client [%v] (peer %s) denied access to [%s]",
+		ip, req.RemoteAddr, req.URL.Path)
+
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+
+	return false
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
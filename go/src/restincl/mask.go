@@ -0,0 +1,369 @@
+/**
+ * @brief Masking of sensitive request/response data in logs
+ *
+ * @file mask.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Replacement of masked values
+const MASK_VALUE = "***"
+
+//Compiled masking rules of the route
+type MaskRules struct {
+	paths   map[string]bool //JSON paths (dotted) or key names (any level)
+	fields  map[string]bool //UBF field names
+	headers map[string]bool //Lower case header names
+	rex     []*regexp.Regexp
+}
+
+//Split comma separated list into set
+//@param list comma separated list
+//@param lower convert to lower case
+//@return set or nil if empty
+func maskSet(list string, lower bool) map[string]bool {
+
+	var ret map[string]bool
+
+	for _, s := range strings.Split(list, ",") {
+
+		s = strings.TrimSpace(s)
+
+		if lower {
+			s = strings.ToLower(s)
+		}
+
+		if "" != s {
+			if nil == ret {
+				ret = make(map[string]bool)
+			}
+			ret[s] = true
+		}
+	}
+
+	return ret
+}
+
+//Build the masking rules of the route
+//@param svc service map
+//@return error or nil
+func validateMask(svc *ServiceMap) error {
+
+	m := MaskRules{paths: maskSet(svc.Mask_json, false),
+		fields:  maskSet(svc.Mask_fields, false),
+		headers: maskSet(svc.Mask_headers, true)}
+
+	for _, r := range svc.Mask_regex {
+
+		rex, err := regexp.Compile(r)
+
+		if nil != err {
+			return errors.New(fmt.Sprintf("Invalid `mask_regex' [%s] (route %s): %s",
+				r, svc.Url, err.Error()))
+		}
+
+		m.rex = append(m.rex, rex)
+	}
+
+	svc.Mask = nil
+
+	if nil != m.paths || nil != m.fields || nil != m.headers || len(m.rex) > 0 {
+		svc.Mask = &m
+	}
+
+	return nil
+}
+
+//Apply regex rules
+func (m *MaskRules) maskRex(s string) string {
+
+	for _, rex := range m.rex {
+		s = rex.ReplaceAllString(s, MASK_VALUE)
+	}
+
+	return s
+}
+
+//Mask JSON values, walking the document
+//@param path dotted path of v
+//@param v value
+//@return masked value
+func (m *MaskRules) maskJSONValue(path string, v interface{}) interface{} {
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+
+			p := k
+			if "" != path {
+				p = path + "." + k
+			}
+
+			if m.paths[p] || m.paths[k] || m.fields[k] {
+				t[k] = MASK_VALUE
+			} else {
+				t[k] = m.maskJSONValue(p, e)
+			}
+		}
+	case []interface{}:
+		//Array elements share the path of array
+		for i, e := range t {
+			t[i] = m.maskJSONValue(path, e)
+		}
+	}
+
+	return v
+}
+
+//Mask JSON document by JSON paths and UBF field names (as json2ubf keys are
+//field names)
+//@param data request or response body
+//@return masked document, true if data was JSON document
+func (m *MaskRules) maskJSON(data []byte) ([]byte, bool) {
+
+	trimmed := bytes.TrimSpace(data)
+
+	if (nil != m.paths || nil != m.fields) && len(trimmed) > 0 &&
+		('{' == trimmed[0] || '[' == trimmed[0]) {
+
+		var doc interface{}
+
+		if err := json.Unmarshal(trimmed, &doc); nil == err {
+			if js, err := json.Marshal(m.maskJSONValue("", doc)); nil == err {
+				return js, true
+			}
+		}
+	}
+
+	return data, false
+}
+
+//Mask request/response data for logging. JSON documents are masked by JSON
+//paths and field names, then regex rules are applied.
+//@param data request or response body
+//@return masked text
+func (m *MaskRules) maskData(data []byte) string {
+
+	if nil == m {
+		return string(data)
+	}
+
+	data, _ = m.maskJSON(data)
+
+	return m.maskRex(string(data))
+}
+
+//Mask header value for logging
+//@param name header name
+//@param value header value
+//@return masked value
+func (m *MaskRules) maskHeader(name string, value string) string {
+
+	if nil == m {
+		return value
+	}
+
+	if m.headers[strings.ToLower(name)] {
+		return MASK_VALUE
+	}
+
+	return m.maskRex(value)
+}
+
+//Mask request parameter value for logging
+//@param name parameter name
+//@param value parameter value
+//@return masked value
+func (m *MaskRules) maskParam(name string, value string) string {
+
+	if nil == m {
+		return value
+	}
+
+	if m.paths[name] || m.fields[name] {
+		return MASK_VALUE
+	}
+
+	return m.maskRex(value)
+}
+
+//Mask URL for logging, query values of masked keys/fields are replaced
+//@param u URL
+//@return masked URL string
+func (m *MaskRules) maskURL(u *url.URL) string {
+
+	if nil == m {
+		return u.RequestURI()
+	}
+
+	ret := u.EscapedPath()
+
+	if "" != u.RawQuery {
+
+		q := u.Query()
+
+		for k, v := range q {
+			if m.paths[k] || m.fields[k] {
+				for i := range v {
+					v[i] = MASK_VALUE
+				}
+			}
+		}
+
+		ret += "?" + q.Encode()
+	}
+
+	return m.maskRex(ret)
+}
+
+//Mask UBF buffer print: values of masked fields and of masked header
+//name/value pairs, then regex rules. Caller checks the log level, the
+//print is not built if it is not logged.
+//@param text UBF buffer print (BPrintStr format, FIELD\tVALUE lines)
+//@return masked print
+func (m *MaskRules) maskUBFPrint(text string) string {
+
+	//Header names by occurrence
+	var hdrNames = map[string][]string{"EX_IF_REQHN": nil, "EX_IF_RSPHN": nil,
+		"EX_IF_REQCN": nil, "EX_IF_RSPCN": nil}
+	var valueOf = map[string]string{"EX_IF_REQHV": "EX_IF_REQHN",
+		"EX_IF_RSPHV": "EX_IF_RSPHN", "EX_IF_REQCV": "EX_IF_REQCN",
+		"EX_IF_RSPCV": "EX_IF_RSPCN"}
+	occs := make(map[string]int)
+
+	lines := strings.Split(text, "\n")
+
+	for i, l := range lines {
+
+		tab := strings.Index(l, "\t")
+
+		if tab < 0 {
+			continue
+		}
+
+		fld := l[0:tab]
+		val := l[tab+1:]
+
+		if names, ok := hdrNames[fld]; ok {
+			hdrNames[fld] = append(names, val)
+		}
+
+		if m.fields[fld] {
+			val = MASK_VALUE
+		} else if "EX_IF_REQDATA" == fld || "EX_IF_RSPDATA" == fld {
+
+			//Body in ext mode, backslashes are escaped in print
+			if js, ok := m.maskJSON([]byte(strings.Replace(val,
+				"\\\\", "\\", -1))); ok {
+				val = string(js)
+			}
+		} else if nameFld, ok := valueOf[fld]; ok {
+
+			occ := occs[fld]
+			occs[fld]++
+
+			if names := hdrNames[nameFld]; occ < len(names) &&
+				(m.headers[strings.ToLower(names[occ])] ||
+					("EX_IF_REQCN" == nameFld && m.headers["cookie"]) ||
+					("EX_IF_RSPCN" == nameFld && m.headers["set-cookie"])) {
+				val = MASK_VALUE
+			}
+		}
+
+		lines[i] = fld + "\t" + val
+	}
+
+	return m.maskRex(strings.Join(lines, "\n"))
+}
+
+//Check is debug level logged, so that prints and masking may be skipped
+//@param ac ATMI Context
+//@return true if debug is logged
+func logDebugOn(ac *atmi.ATMICtx) bool {
+
+	lev, errA := ac.TpLogQInfo(atmi.LOG_DEBUG,
+		atmi.TPLOGQI_GET_TP|atmi.TPLOGQI_EVAL_RETURN)
+
+	return nil != errA || 0 != lev
+}
+
+//Print UBF buffer to log with masking applied
+//@param ac ATMI Context
+//@param svc service map
+//@param bufu buffer to print
+//@param title title of the print
+func logUBF(ac *atmi.ATMICtx, svc *ServiceMap, bufu *atmi.TypedUBF, title string) {
+
+	if !logDebugOn(ac) {
+		return
+	} else if nil == svc.Mask {
+		bufu.TpLogPrintUBF(atmi.LOG_DEBUG, title)
+		return
+	}
+
+	text, errU := bufu.BPrintStr()
+
+	if nil != errU {
+		ac.TpLogError("Failed to print UBF: %s", errU.Error())
+		return
+	}
+
+	ac.TpLogDebug("%s\n%s", title, svc.Mask.maskUBFPrint(text))
+}
+
+//Dump request/response data to log with masking applied
+//@param ac ATMI Context
+//@param svc service map
+//@param title title of the dump
+//@param data data to dump
+func logData(ac *atmi.ATMICtx, svc *ServiceMap, title string, data []byte) {
+
+	if !logDebugOn(ac) {
+		return
+	} else if nil == svc.Mask {
+		ac.TpLogDump(atmi.LOG_DEBUG, title, data, len(data))
+		return
+	}
+
+	ac.TpLogDebug("%s: [%s]", title, svc.Mask.maskData(data))
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,198 @@
+/**
+ * @brief Query string and url-encoded form mapping to UBF fields/VIEW members
+ *
+ * @file params.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Check is request body url-encoded form
+//@param req HTTP request
+//@return true if form
+func isFormBody(req *http.Request) bool {
+
+	mt, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+
+	return nil == err && "application/x-www-form-urlencoded" == mt
+}
+
+//Check shall the buffer be built from parameters only (no JSON/XML body)
+//@param svc Service map
+//@param req HTTP request
+//@param body request body
+//@return true if no document in body
+func paramsOnly(svc *ServiceMap, req *http.Request, body []byte) bool {
+
+	return svc.Parseparams &&
+		(isFormBody(req) || "" == strings.TrimSpace(string(body)))
+}
+
+//Collect the request parameters: URL query and url-encoded form body
+//@param ac ATMI Context
+//@param req HTTP request
+//@param body request body (already read)
+//@return parameters, ATMI error
+func collectParams(ac *atmi.ATMICtx, req *http.Request,
+	body []byte) (url.Values, atmi.ATMIError) {
+
+	params := req.URL.Query()
+
+	if isFormBody(req) {
+
+		form, err := url.ParseQuery(string(body))
+
+		if nil != err {
+			ac.TpLogError("Failed to parse form body: %s", err.Error())
+			return nil, atmi.NewCustomATMIError(atmi.TPEINVAL,
+				fmt.Sprintf("Failed to parse form body: %s", err.Error()))
+		}
+
+		//Body values go first, as in http.Request.ParseForm()
+		for k, v := range params {
+			form[k] = append(form[k], v...)
+		}
+
+		params = form
+	}
+
+	return params, nil
+}
+
+//Check is parameter name reserved for restincl interface fields (EX_IF_*,
+//EX_NREQLOGFILE), such fields cannot be set by the client
+//@param name parameter name
+//@return true if reserved
+func paramReserved(name string) bool {
+
+	return strings.HasPrefix(name, "EX_IF_") || "EX_NREQLOGFILE" == name
+}
+
+//Load the request parameters into UBF fields with the same names. Values are
+//converted to field types, multiple values are loaded as occurrences.
+//Parameters not matching any field or having reserved names are ignored.
+//@param ac ATMI Context
+//@param svc Service map
+//@param req HTTP request
+//@param body request body
+//@param bufu UBF buffer
+//@return ATMI error or nil
+func paramsToUBF(ac *atmi.ATMICtx, svc *ServiceMap, req *http.Request, body []byte,
+	bufu *atmi.TypedUBF) atmi.ATMIError {
+
+	params, errA := collectParams(ac, req, body)
+
+	if nil != errA {
+		return errA
+	}
+
+	for k, v := range params {
+
+		if paramReserved(k) {
+			ac.TpLogWarn("Parameter [%s] is reserved field - ignore", k)
+			continue
+		}
+
+		id, errU := ac.BFldId(k)
+
+		if nil != errU || 0 == id {
+			ac.TpLogDebug("Parameter [%s] is not UBF field - ignore", k)
+			continue
+		}
+
+		for occ, vv := range v {
+
+			ac.TpLogDebug("Parameter %s[%d]=[%s]", k, occ,
+				svc.Mask.maskParam(k, vv))
+
+			if errU := bufu.BChg(id, occ, vv); nil != errU {
+				ac.TpLogError("Failed to set [%s] occ %d: %s", k, occ, errU.Error())
+				return atmi.NewCustomATMIError(atmi.TPEINVAL,
+					fmt.Sprintf("Failed to set [%s] occ %d: %s",
+						k, occ, errU.Message()))
+			}
+		}
+	}
+
+	return nil
+}
+
+//Load the request parameters into VIEW members with the same names. Values are
+//converted to member types, multiple values are loaded as occurrences.
+//Parameters not matching any member are ignored.
+//@param ac ATMI Context
+//@param svc Service map
+//@param req HTTP request
+//@param body request body
+//@param bufv VIEW buffer
+//@return ATMI error or nil
+func paramsToVIEW(ac *atmi.ATMICtx, svc *ServiceMap, req *http.Request, body []byte,
+	bufv *atmi.TypedVIEW) atmi.ATMIError {
+
+	params, errA := collectParams(ac, req, body)
+
+	if nil != errA {
+		return errA
+	}
+
+	for k, v := range params {
+
+		for occ, vv := range v {
+
+			ac.TpLogDebug("Parameter %s[%d]=[%s]", k, occ,
+				svc.Mask.maskParam(k, vv))
+
+			if errU := bufv.BVChg(k, occ, vv); nil != errU {
+
+				if atmi.BNOCNAME == errU.Code() {
+					ac.TpLogDebug("Parameter [%s] is not VIEW member - ignore", k)
+					break
+				}
+
+				ac.TpLogError("Failed to set [%s] occ %d: %s", k, occ, errU.Error())
+				return atmi.NewCustomATMIError(atmi.TPEINVAL,
+					fmt.Sprintf("Failed to set [%s] occ %d: %s",
+						k, occ, errU.Message()))
+			}
+		}
+	}
+
+	return nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
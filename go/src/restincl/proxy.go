@@ -0,0 +1,345 @@
+/**
+ * @brief Reverse proxy routes to upstream HTTP servers
+ *
+ * @file proxy.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+	"ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Validate proxy route settings and prepare the upstream transport
+//@param ac ATMI Context
+//@param svc Service map
+//@return error or nil
+func proxySetup(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if CONV_PROXY != svc.Conv_int {
+		return nil
+	}
+
+	if svc.Errors_int != ERRORS_HTTP && svc.Errors_int != ERRORS_JSON &&
+		svc.Errors_int != ERRORS_TEXT && svc.Errors_int != ERRORS_XML {
+		return fmt.Errorf("Route [%s] conv is 'proxy', but errors not "+
+			"http, json, xml or text: [%s]", svc.Url, svc.Errors)
+	}
+
+	target, err := url.Parse(svc.Proxy_url)
+
+	if nil != err {
+		return fmt.Errorf("Route [%s] invalid proxy_url [%s]: %s",
+			svc.Url, svc.Proxy_url, err.Error())
+	}
+
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return fmt.Errorf("Route [%s] proxy_url [%s] must be http or https",
+			svc.Url, svc.Proxy_url)
+	}
+
+	svc.ProxyTarget = target
+	svc.ProxyTransport = &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: time.Duration(svc.Proxy_timeout) * time.Second,
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: svc.Proxy_sslinsecure},
+	}
+
+	ac.TpLogInfo("Route [%s] proxied to [%s] timeout %d strip [%s]",
+		svc.Url, svc.Proxy_url, svc.Proxy_timeout, svc.Proxy_stripprefix)
+
+	return nil
+}
+
+//Load the request data in UBF buffer for proxy route filters
+//@param ac ATMI Context
+//@param svc Service map
+//@param req HTTP request
+//@param bufu UBF buffer to fill
+//@return ATMI error or nil
+func proxyLoadReq(ac *atmi.ATMICtx, svc *ServiceMap, req *http.Request,
+	bufu *atmi.TypedUBF) atmi.ATMIError {
+
+	if errU := parseHeaders(ac, svc, req, bufu); nil != errU {
+		return atmi.NewCustomATMIError(atmi.TPESYSTEM,
+			fmt.Sprintf("Failed to parse headers %d:[%s]",
+				errU.Code(), errU.Message()))
+	}
+
+	if errU := bufu.BAdd(ubftab.EX_IF_URL, req.URL.Path); nil != errU {
+		return atmi.NewCustomATMIError(atmi.TPESYSTEM,
+			fmt.Sprintf("Failed to set EX_IF_URL %d:[%s]",
+				errU.Code(), errU.Message()))
+	}
+
+	if errU := bufu.BAdd(ubftab.EX_IF_METHOD, req.Method); nil != errU {
+		return atmi.NewCustomATMIError(atmi.TPESYSTEM,
+			fmt.Sprintf("Failed to set EX_IF_METHOD %d:[%s]",
+				errU.Code(), errU.Message()))
+	}
+
+	if errU := vhostLoadUBF(svc, req, bufu); nil != errU {
+		return atmi.NewCustomATMIError(atmi.TPESYSTEM,
+			fmt.Sprintf("Failed to set host fields %d:[%s]",
+				errU.Code(), errU.Message()))
+	}
+
+	if errU := parseQuery(ac, svc, req, bufu); nil != errU {
+		return atmi.NewCustomATMIError(atmi.TPESYSTEM,
+			fmt.Sprintf("Failed to parse Query params %d:[%s]",
+				errU.Code(), errU.Message()))
+	}
+
+	return nil
+}
+
+//Reply with the buffer prepared by the filter (or by the rerouted service) in
+//the same way as in ext mode: EX_NETRCODE http status (default 200), headers
+//(if parseheaders is set) and EX_IF_RSPDATA body
+//@param ac ATMI Context
+//@param svc Service map
+//@param w Response writer
+//@param bufu reply buffer
+func proxyReply(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
+	bufu *atmi.TypedUBF) {
+
+	netCode := http.StatusOK
+
+	if bufu.BPres(ubftab.EX_NETRCODE, 0) {
+		netCode, _ = bufu.BGetInt(ubftab.EX_NETRCODE, 0)
+	}
+
+	if rspType := genRspHeaders(ac, bufu, w, svc); "" != rspType {
+		w.Header().Set("Content-Type", rspType)
+	}
+
+	rsp, _ := bufu.BGetByteArr(ubftab.EX_IF_RSPDATA, 0)
+
+	if aw := accessWriterOf(w); nil != aw {
+		aw.svc = svc.Svc
+	}
+
+	ac.TpLogInfo("Proxy [%s] replied with out upstream, http %d", svc.Url, netCode)
+
+	w.WriteHeader(netCode)
+	w.Write(rsp)
+}
+
+//Run incoming filters of the proxy route
+//@param ac ATMI Context of the worker
+//@param svc Service map
+//@param w Response writer
+//@param req HTTP request
+//@param rctx request context
+//@return true if request is already replied (filter error, filter reply or
+//rerouted service), false if request shall be forwarded to upstream
+func proxyFilter(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
+	req *http.Request, rctx *RequestContext) bool {
+
+	bufu, err := ac.NewUBF(atmi.ATMIMsgSizeMax())
+
+	if nil != err {
+		ac.TpLogError("failed to alloca ubf buffer %d:[%s]",
+			err.Code(), err.Message())
+
+		genRsp(ac, nil, svc, w, err, false, false, false, rctx)
+		return true
+	}
+
+	if errA := proxyLoadReq(ac, svc, req, bufu); nil != errA {
+		ac.TpLogError("Failed to prepare filter buffer: %s", errA.Message())
+		genRsp(ac, nil, svc, w, errA, false, false, false, rctx)
+		return true
+	}
+
+	if errU := traceLoadUBF(ac, bufu, rctx); nil != errU {
+		errA := atmi.NewCustomATMIError(atmi.TPESYSTEM,
+			fmt.Sprintf("Failed to set trace context %d:[%s]",
+				errU.Code(), errU.Message()))
+		genRsp(ac, nil, svc, w, errA, false, false, false, rctx)
+		return true
+	}
+
+	if "" != svc.Reqlogsvc {
+		if errA := ac.TpLogSetReqFile(bufu, "", svc.Reqlogsvc); nil == errA {
+			defer ac.TpLogCloseReqFile()
+		}
+	} else if traceLogOpen(ac, svc, bufu, rctx) {
+		defer ac.TpLogCloseReqFile()
+	}
+
+	target := svc.Svc
+
+	if errA := runChain(ac, svc, bufu, true, svc.Finman_arr,
+		"filter-incoming-mandatory(finman)", rctx); nil != errA {
+		rctx.errSrc = ERRSRC_FINMAN
+		genRsp(ac, nil, svc, w, errA, false, false, false, rctx)
+		return true
+	}
+
+	runChain(ac, svc, bufu, false, svc.Finopt_arr,
+		"filter-incoming-optional(finopt)", rctx)
+
+	//Filter has prepared the response
+	if rctx.fltReply {
+		proxyReply(ac, svc, w, bufu)
+		return true
+	}
+
+	//Filter rerouted the request to XATMI service, called as in ext mode
+	if target != svc.Svc {
+
+		body, errR := ioutil.ReadAll(req.Body)
+
+		if nil != errR {
+			errA := atmi.NewCustomATMIError(atmi.TPESYSTEM,
+				fmt.Sprintf("Failed to read request body: %s", errR.Error()))
+			genRsp(ac, nil, svc, w, errA, false, false, false, rctx)
+			return true
+		}
+
+		if errU := bufu.BChg(ubftab.EX_IF_REQDATA, 0, body); nil != errU {
+			errA := atmi.NewCustomATMIError(atmi.TPESYSTEM,
+				fmt.Sprintf("Failed to set body data in EX_IF_REQDATA %d:[%s]",
+					errU.Code(), errU.Message()))
+			genRsp(ac, nil, svc, w, errA, false, false, false, rctx)
+			return true
+		}
+
+		ac.TpLogInfo("Proxy [%s] rerouted to service [%s]", req.URL.Path, svc.Svc)
+
+		rctx.errSrc = ERRSRC_SERVICE
+
+		if _, errA := ac.TpCall(svc.Svc, bufu, 0); nil != errA {
+			ac.TpLogError("Rerouted service [%s] failed: %s",
+				svc.Svc, errA.Error())
+			genRsp(ac, nil, svc, w, errA, false, true, false, rctx)
+			return true
+		}
+
+		proxyReply(ac, svc, w, bufu)
+		return true
+	}
+
+	return false
+}
+
+//Forward the request to upstream HTTP server. Incoming filters
+//(finman/finopt) are executed before, with request loaded in UBF buffer
+//as in ext mode (with out body). Worker is held by the caller for the whole
+//upstream exchange, thus upstream concurrency is limited by workers.
+//@param ac ATMI Context of the worker
+//@param svc Service map
+//@param w Response writer
+//@param req HTTP request
+//@return SUCCEED/FAIL
+func handleProxy(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
+	req *http.Request) int {
+
+	var rctx RequestContext
+	rctx.errSrc = ERRSRC_RESTIN
+
+	ac.TpLog(atmi.LOG_DEBUG, "Got URL [%s], caller: %s proto: %s",
+		svc.Mask.maskURL(req.URL), req.RemoteAddr, req.Proto)
+
+	traceStart(ac, svc, w, req, &rctx)
+
+	if len(svc.Finman_arr) > 0 || len(svc.Finopt_arr) > 0 || "" != svc.Reqlogsvc {
+
+		if proxyFilter(ac, svc, w, req, &rctx) {
+			return atmi.SUCCEED
+		}
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(svc.ProxyTarget)
+	proxy.Transport = svc.ProxyTransport
+
+	if "" != svc.Proxy_stripprefix {
+		director := proxy.Director
+		proxy.Director = func(r *http.Request) {
+			r.URL.Path = strings.TrimPrefix(r.URL.Path, svc.Proxy_stripprefix)
+			r.URL.RawPath = ""
+			director(r)
+		}
+	}
+
+	//Upstream continues our trace
+	if "" != rctx.traceParent {
+		director := proxy.Director
+		proxy.Director = func(r *http.Request) {
+			director(r)
+			traceSetHeaders(r.Header, &rctx)
+		}
+
+		proxy.ModifyResponse = func(r *http.Response) error {
+			r.Header.Del(TRACE_HDR_PARENT)
+			r.Header.Del(TRACE_HDR_STATE)
+			return nil
+		}
+	}
+
+	//Upstream failures are mapped to 504 (timeout) or 502
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, e error) {
+
+		var errA atmi.ATMIError
+
+		ac.TpLogError("Upstream [%s] call failed: %s", svc.Proxy_url, e.Error())
+
+		if ne, ok := e.(net.Error); ok && ne.Timeout() {
+			errA = atmi.NewCustomATMIError(atmi.TPETIME,
+				fmt.Sprintf("Upstream timeout: %s", e.Error()))
+			rctx.rspCode = http.StatusGatewayTimeout
+		} else {
+			errA = atmi.NewCustomATMIError(atmi.TPESVCERR,
+				fmt.Sprintf("Upstream failed: %s", e.Error()))
+			rctx.rspCode = http.StatusBadGateway
+		}
+
+		rctx.errSrc = ERRSRC_SERVICE
+		genRsp(ac, nil, svc, w, errA, false, true, false, &rctx)
+	}
+
+	ac.TpLogInfo("Proxy [%s] %s -> [%s]", req.URL.Path, req.Method, svc.Proxy_url)
+	proxy.ServeHTTP(w, req)
+
+	return atmi.SUCCEED
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
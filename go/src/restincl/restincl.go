@@ -43,6 +43,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"regexp"
@@ -79,6 +80,7 @@ const (
 	ERRORS_JSON2UBF  = 5
 	ERRORS_JSON2VIEW = 6
 	ERRORS_EXT       = 7 //External mode errors, direct UBF error codes, services
+	ERRORS_XML       = 8 //Add the error elements to XML response root
 )
 
 const (
@@ -87,6 +89,12 @@ const (
 	ERRSRC_RESTIN  = "R" //Error source is rest-in internal error
 )
 
+//Filter decisions returned in EX_IF_FLTACTION
+const (
+	FLTACTION_SKIP  = "S" //Skip remaining filters of the chain
+	FLTACTION_REPLY = "R" //Reply with current buffer, do not call target service
+)
+
 //Conversion types resolved
 const (
 	CONV_JSON2UBF  = 1
@@ -96,6 +104,10 @@ const (
 	CONV_JSON2VIEW = 5
 	CONV_STATIC    = 6 //Serving static content
 	CONV_EXT       = 7 //External services, raw FML buffers
+	CONV_CACHEADM  = 8 //Response cache administration
+	CONV_PROXY     = 9 //Reverse proxy to upstream http server
+	CONV_XML2UBF   = 10
+	CONV_METRICS   = 11 //Process metrics
 )
 
 //Defaults
@@ -109,8 +121,16 @@ const (
 	ERRFMT_JSON_ONSUCC_DEFAULT = true /* generate success message in JSON */
 	ERRFMT_VIEW_ONSUCC_DEFAULT = true /* generate success message in VIEW */
 	ERRFMT_TEXT_DEFAULT        = "%d: %s"
+	ERRFMT_XML_MSG_DEFAULT     = "<error_message>%s</error_message>"
+	ERRFMT_XML_CODE_DEFAULT    = "<error_code>%d</error_code>"
+	ERRFMT_XML_ONSUCC_DEFAULT  = true /* generate success message in XML */
+	XML_ROOT_DEFAULT           = "ubf"
+	CACHEADM_IP_ALLOW_DEFAULT  = "127.0.0.1,::1"
 	ASYNCCALL_DEFAULT          = false
-	WORKERS                    = 10 /* Number of worker processes */
+	CACHE_TTL_DEFAULT          = 60   /* Response cache ttl, seconds */
+	CACHE_SIZE_DEFAULT         = 1000 /* Max number of cached responses per route */
+	PROXY_TIMEOUT_DEFAULT      = 60   /* Upstream response timeout, seconds */
+	WORKERS                    = 10   /* Number of worker processes */
 )
 
 //We will have most of the settings as defaults
@@ -118,6 +138,7 @@ const (
 type ServiceMap struct {
 	Svc    string `json:"svc"`
 	Url    string
+	Vhost  string //Virtual host group of the route
 	Errors string `json:"errors"`
 	//Above converted to consntant
 	Errors_int       int
@@ -128,6 +149,12 @@ type ServiceMap struct {
 	//If set, then generate code/message for success too
 	Errfmt_json_onsucc bool `json:"errfmt_json_onsucc"`
 
+	//XML errors mode, elements added to root of response
+	Errfmt_xml_msg    string `json:"errfmt_xml_msg"`
+	Errfmt_xml_code   string `json:"errfmt_xml_code"`
+	Errfmt_xml_onsucc bool   `json:"errfmt_xml_onsucc"`
+	Xml_root          string `json:"xml_root"` //Root element of xml2ubf response
+
 	//In case of json2view errors, we install the return
 	//code direclty in the given fields
 	Errfmt_view_msg    string `json:"errfmt_view_msg"`
@@ -158,6 +185,21 @@ type ServiceMap struct {
 	Conv_int  int    //Resolve conversion type
 	//Request logging classify service
 	Reqlogsvc string `json:"reqlogsvc"`
+	//Masking of sensitive data in logs
+	Mask_json    string   `json:"mask_json"`    // JSON paths / key names
+	Mask_fields  string   `json:"mask_fields"`  // UBF field names
+	Mask_headers string   `json:"mask_headers"` // Header names
+	Mask_regex   []string `json:"mask_regex"`   // Regular expressions
+	Mask         *MaskRules
+
+	//Client address access lists (CIDR), checked after global lists
+	Ip_allow string `json:"ip_allow"`
+	Ip_deny  string `json:"ip_deny"`
+	Ipacl    *IPACL
+
+	//W3C Trace Context, optionally request log file named by trace id
+	Trace       bool   `json:"trace"`
+	Tracelogdir string `json:"tracelogdir"`
 	//Error mapping Enduro/X error code (including * for all):http error code
 	Errors_fmt_http_map_str string `json:"errors_fmt_http_map"`
 	Errors_fmt_http_map     map[string]int
@@ -171,8 +213,27 @@ type ServiceMap struct {
 	Parseheaders bool   `json:"parseheaders"` // Default false
 	Parsecookies bool   `json:"parsecookies"` // Default false
 	Parseform    bool   `json:"parseform"`    // Parse form data and load into UBF
+	Parseparams  bool   `json:"parseparams"`  // Map query/form params to fields/members
+	Paramsview   string `json:"paramsview"`   // VIEW to use if no JSON doc in json2view
+	Formats      string `json:"formats"`      // Accepted wire formats: json,ubf
 	Fileupload   bool   `json:"fileupload"`   // This url end-point is used for file upload
 	Tempdir      string `json:"tempdir"`      // Temporary folder where to store uploaded files
+	Upload_svc   string `json:"upload_svc"`   // Stream uploaded files to this service
+	Upload_mode  string `json:"upload_mode"`  // Streaming mode: chunks or conv
+	Upload_chunk int    `json:"upload_chunk"` // Streamed chunk size, bytes
+	Formats_json bool   //Parsed from Formats
+	Formats_ubf  bool
+
+	//Upload content verification
+	Upload_mime      string `json:"upload_mime"`      // Allowed (sniffed) MIME types
+	Upload_max_files int    `json:"upload_max_files"` // Max number of files
+	Upload_max_size  int64  `json:"upload_max_size"`  // Max size of single file, bytes
+	Upload_max_total int64  `json:"upload_max_total"` // Max size of all files, bytes
+	Upload_sanitize  bool   `json:"upload_sanitize"`  // Clean up client file names
+	Upload_scan_svc  string `json:"upload_scan_svc"`  // Scanner service called per file
+	Upload_scan_cmd  string `json:"upload_scan_cmd"`  // Scanner command run per file
+	Upload_scan_time int    `json:"upload_scan_time"` // Scanner command timeout, seconds
+	Upload_mime_arr  []string
 
 	//For ext mode:
 	Finman     string `json:"finman"` // Mandatory incoming services
@@ -196,6 +257,21 @@ type ServiceMap struct {
 	NoAbort            bool `json:"txnoabort"`           // Do not abort global transaction if service failed
 	TxNoOptim          bool `json:"txnooptim"`           // Do not optimize known resource managers
 
+	//Response caching of GET requests
+	Cache             bool   `json:"cache"`         // Enable response cache
+	Cache_ttl         int    `json:"cache_ttl"`     // Time to live of entries, seconds
+	Cache_size        int    `json:"cache_size"`    // Max number of entries
+	Cache_headers     string `json:"cache_headers"` // Request headers included in key
+	Cache_headers_arr []string
+	RspCache          *RspCache //Cache of the route, shared between requests
+
+	//Reverse proxy routes
+	Proxy_url         string `json:"proxy_url"`         // Upstream base URL
+	Proxy_timeout     int    `json:"proxy_timeout"`     // Response header timeout, seconds
+	Proxy_stripprefix string `json:"proxy_stripprefix"` // Path prefix to remove
+	Proxy_sslinsecure bool   `json:"proxy_sslinsecure"` // Do not verify upstream cert
+	ProxyTarget       *url.URL
+	ProxyTransport    *http.Transport
 }
 
 //Route information structure for Handles with Regexp path
@@ -237,6 +313,10 @@ var M_convs = map[string]int{
 	"json2view": CONV_JSON2VIEW,
 	"static":    CONV_STATIC,
 	"ext":       CONV_EXT,
+	"cacheadm":  CONV_CACHEADM,
+	"proxy":     CONV_PROXY,
+	"xml2ubf":   CONV_XML2UBF,
+	"metrics":   CONV_METRICS,
 }
 
 var M_workers int
@@ -262,11 +342,21 @@ func (h *RegexpHandler) HandleFunc(pattern *regexp.Regexp, svc ServiceMap) {
 	if svc.Format == "regexp" || svc.Format == "r" {
 		h.regexpRoutes = append(h.regexpRoutes, &route{pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
+			accessRoute(w, &svc)
+
+			if !ipCheck(w, r, svc.Ipacl) {
+				return
+			}
+
 			if CONV_STATIC == svc.Conv_int {
 				result := strings.Split(r.URL.Path, "/")
 				//M_ac.TpLogInfo("Got Static request... [%s] base: [%s] rex", r.URL.Path, result[1])
 				http.StripPrefix("/"+result[1], svc.FileServer).ServeHTTP(w, r)
 
+			} else if CONV_CACHEADM == svc.Conv_int {
+				cacheAdmin(w, r)
+			} else if CONV_METRICS == svc.Conv_int {
+				metricsAdmin(w, r)
 			} else {
 				//M_ac.TpLogInfo("Got XATMI request...")
 				dispatchRequest(w, r, svc)
@@ -275,10 +365,21 @@ func (h *RegexpHandler) HandleFunc(pattern *regexp.Regexp, svc ServiceMap) {
 	} else {
 		h.urlMap[svc.Url] = svc
 		h.defaultHandler[svc.Url] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			accessRoute(w, &svc)
+
+			if !ipCheck(w, r, svc.Ipacl) {
+				return
+			}
+
 			if CONV_STATIC == svc.Conv_int {
 				result := strings.Split(r.URL.Path, "/")
 				//M_ac.TpLogInfo("Got Static request... [%s] base: [%s] stat", r.URL.Path, result[1])
 				http.StripPrefix("/"+result[1], svc.FileServer).ServeHTTP(w, r)
+			} else if CONV_CACHEADM == svc.Conv_int {
+				cacheAdmin(w, r)
+			} else if CONV_METRICS == svc.Conv_int {
+				metricsAdmin(w, r)
 			} else {
 				//M_ac.TpLogInfo("Got XATMI request...")
 				dispatchRequest(w, r, svc)
@@ -289,7 +390,7 @@ func (h *RegexpHandler) HandleFunc(pattern *regexp.Regexp, svc ServiceMap) {
 
 //ServeHTTP function to satisfy http.Handler interface
 //This function is called when incomming request is received
-//It checks if urlMap contains exact match URL and if it does, calls corresponding
+//Route set is selected by Host header (virtual host groups), then it checks if urlMap contains exact match URL and if it does, calls corresponding
 // handler which calls dispatchRequest()
 //If URL is not in urlMap (exact match) ServeHTTP checks all compiled regexps
 //and calls dispatchRequest() on match.
@@ -297,6 +398,32 @@ func (h *RegexpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	//M_ac.TpLogInfo("ServeHTTP: [%s]", r.URL.Path)
 
+	defer protoStatsEnter(r.Proto)()
+
+	if nil != M_accesslog {
+		aw := newAccessWriter(w, r)
+		defer M_accesslog.log(aw, r)
+		w = aw
+	}
+
+	//Global access lists, denied before any routing / worker usage
+	if !ipCheck(w, r, M_ipacl) {
+		return
+	}
+
+	vh := vhostResolve(r.Host)
+
+	if nil == vh {
+		vhostUnknown(w)
+		return
+	}
+
+	vh.serveRoute(w, r)
+}
+
+//Dispatch the request to exact match or regexp route of the handler
+func (h *RegexpHandler) serveRoute(w http.ResponseWriter, r *http.Request) {
+
 	svc := h.urlMap[r.URL.Path]
 	if svc.Svc != "" || svc.Echo {
 		//M_ac.TpLogInfo("Default ServeHTTP: [%s]", r.URL.Path)
@@ -333,6 +460,21 @@ func routeSetup(svc *ServiceMap) error {
 		M_do_tpopen = true
 	}
 
+	if "proxy" == svc.Conv && "" == svc.Svc {
+		//special value, really not used
+		svc.Svc = "@PROXY"
+	}
+
+	if "cacheadm" == svc.Conv && "" == svc.Svc {
+		//special value, really not used
+		svc.Svc = "@CACHEADM"
+	}
+
+	if "metrics" == svc.Conv && "" == svc.Svc {
+		//special value, really not used
+		svc.Svc = "@METRICS"
+	}
+
 	return nil
 }
 
@@ -359,6 +501,9 @@ func remapErrors(svc *ServiceMap) error {
 	case "ext":
 		svc.Errors_int = ERRORS_EXT
 		break
+	case "xml":
+		svc.Errors_int = ERRORS_XML
+		break
 	default:
 		return fmt.Errorf("Unsupported error type [%s]", svc.Errors)
 	}
@@ -394,14 +539,29 @@ func apprun(ac *atmi.ATMICtx) error {
 		/* To prepare cert (self-signed) do following steps:
 		 * - TODO
 		 */
-		err = http.ListenAndServeTLS(listenOn, M_tls_cert_file, M_tls_key_file, &M_handler)
+		srv, errS := serverSetup(ac, listenOn)
+
+		if nil != errS {
+			ac.TpLogError("%s", errS.Error())
+			return errS
+		}
+
+		//Certificates are served by M_tls_config.GetCertificate
+		err = srv.ListenAndServeTLS("", "")
 
 		/*	err = http.ServeTLS(l, &M_handler, M_tls_cert_file, M_tls_key_file) */
 
 		ac.TpLog(atmi.LOG_ERROR, "ListenAndServeTLS() failed: %s", err)
 	} else {
 		/*err = http.Serve(l, &M_handler)*/
-		err = http.ListenAndServe(listenOn, &M_handler)
+		srv, errS := serverSetup(ac, listenOn)
+
+		if nil != errS {
+			ac.TpLogError("%s", errS.Error())
+			return errS
+		}
+
+		err = srv.ListenAndServe()
 		ac.TpLog(atmi.LOG_ERROR, "ListenAndServe() failed: %s", err)
 	}
 
@@ -414,11 +574,36 @@ func dispatchRequest(w http.ResponseWriter, req *http.Request, svc ServiceMap) {
 	M_ac.TpLog(atmi.LOG_DEBUG, "URL [%s] getting free goroutine caller: %s",
 		req.URL, req.RemoteAddr)
 
+	//Check the response cache first, no worker needed for hits
+	//(protocol upgrades are not cached, connection is taken over)
+	var cw *cacheWriter
+	if nil != svc.RspCache && "GET" == req.Method &&
+		"" == req.Header.Get("Upgrade") {
+
+		if cw = cacheLookup(M_ac, &svc, w, req); nil == cw {
+			return
+		}
+		w = cw
+	}
+
 	nr := <-M_freechan
 
 	M_ac.TpLogInfo("Got free goroutine, nr %d", nr)
 
-	handleMessage(M_ctxs[nr], &svc, w, req)
+	if aw := accessWriterOf(w); nil != aw {
+		aw.worker = nr
+	}
+
+	//Proxy routes hold the worker for the whole upstream exchange too
+	if CONV_PROXY == svc.Conv_int {
+		handleProxy(M_ctxs[nr], &svc, w, req)
+	} else {
+		handleMessage(M_ctxs[nr], &svc, w, req)
+	}
+
+	if nil != cw {
+		cw.finish(M_ctxs[nr], &svc, req)
+	}
 
 	M_ac.TpLogInfo("Request processing done %d... releasing the context", nr)
 
@@ -484,7 +669,57 @@ func printSvcSummary(ac *atmi.ATMICtx, svc *ServiceMap) {
 		svc.Finman, svc.Finopt, svc.Finerr, svc.Foutman, svc.Foutopt, svc.Fouterr,
 		svc.NoAbort)
 
-	ac.TpLogWarn("fileupload:%t tempdir:[%s]", svc.Fileupload, svc.Tempdir)
+	ac.TpLogWarn("vhost:[%s] ip_allow:[%s] ip_deny:[%s]", svc.Vhost,
+		svc.Ip_allow, svc.Ip_deny)
+	ac.TpLogWarn("fileupload:%t tempdir:[%s] upload_svc:[%s] upload_mode:[%s] "+
+		"upload_chunk:%d", svc.Fileupload, svc.Tempdir, svc.Upload_svc,
+		svc.Upload_mode, svc.Upload_chunk)
+	ac.TpLogWarn("cache:%t cache_ttl:%d cache_size:%d cache_headers:[%s]",
+		svc.Cache, svc.Cache_ttl, svc.Cache_size, svc.Cache_headers)
+}
+
+//Validate response cache settings
+func validateCache(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if !svc.Cache {
+		return nil
+	}
+
+	//Not XATMI routes, nothing to cache (flag may come from defaults)
+	if CONV_STATIC == svc.Conv_int || CONV_CACHEADM == svc.Conv_int ||
+		CONV_METRICS == svc.Conv_int {
+		ac.TpLogInfo("`cache' ignored for [%s] route", svc.Url)
+		svc.Cache = false
+		return nil
+	}
+
+	if svc.Asynccall || svc.TransactionHandler || svc.Fileupload {
+		return errors.New(fmt.Sprintf("`cache' not suitable for route [%s] "+
+			"(async, transaction_handler or fileupload)", svc.Url))
+	}
+
+	//Cache hits are served with out running the filters
+	if len(svc.Finman_arr) > 0 || len(svc.Finopt_arr) > 0 {
+		return errors.New(fmt.Sprintf("`cache' not suitable for route [%s] "+
+			"with incoming filters (finman/finopt)", svc.Url))
+	}
+
+	if svc.Cache_size <= 0 {
+		return errors.New(fmt.Sprintf("Invalid `cache_size' %d for [%s]",
+			svc.Cache_size, svc.Url))
+	}
+
+	svc.Cache_headers_arr = nil
+	svc.Cache_headers = strings.TrimSpace(svc.Cache_headers)
+
+	if "" != svc.Cache_headers {
+		for _, h := range strings.Split(svc.Cache_headers, ",") {
+			svc.Cache_headers_arr = append(svc.Cache_headers_arr,
+				strings.TrimSpace(h))
+		}
+	}
+
+	return nil
 }
 
 //Validate external service definitions
@@ -516,7 +751,9 @@ func validateExtService(ac *atmi.ATMICtx, svc *ServiceMap) error {
 	svc.Finman = strings.TrimSpace(svc.Finman)
 	svc.Finopt = strings.TrimSpace(svc.Finopt)
 
-	if svc.Conv_int == CONV_EXT {
+	//Filters are UBF based, thus json2ubf/xml2ubf may use them too
+	if svc.Conv_int == CONV_EXT || svc.Conv_int == CONV_JSON2UBF ||
+		svc.Conv_int == CONV_XML2UBF {
 
 		svc.Finerr = strings.TrimSpace(svc.Finerr)
 
@@ -565,6 +802,10 @@ func validateExtService(ac *atmi.ATMICtx, svc *ServiceMap) error {
 				svc.Conv))
 		}
 
+	}
+
+	if svc.Conv_int != CONV_EXT {
+
 		if svc.Fileupload {
 			return errors.New(fmt.Sprintf("`fileupload' is valid only for ext conv (cur %s)",
 				svc.Conv))
@@ -574,13 +815,68 @@ func validateExtService(ac *atmi.ATMICtx, svc *ServiceMap) error {
 			return errors.New(fmt.Sprintf("`parseform' is valid only for ext conv (cur %s",
 				svc.Conv))
 		}
+	}
+
+	//Proxy routes may use incoming filters only
+	if svc.Conv_int == CONV_PROXY {
+		if "" != svc.Finman {
+			svc.Finman_arr = strings.Split(svc.Finman, ",")
+		}
+		if "" != svc.Finopt {
+			svc.Finopt_arr = strings.Split(svc.Finopt, ",")
+		}
+	}
+
+	if svc.Parseparams {
+
+		if svc.Conv_int != CONV_JSON2UBF && svc.Conv_int != CONV_JSON2VIEW &&
+			svc.Conv_int != CONV_XML2UBF {
+			return errors.New(fmt.Sprintf("`parseparams' is valid only for json2ubf, "+
+				"xml2ubf and json2view conv (cur %s)", svc.Conv))
+		}
+
+		if svc.Conv_int == CONV_JSON2VIEW && "" == svc.Paramsview {
+			return errors.New(fmt.Sprintf("`parseparams' for json2view requires "+
+				"`paramsview' (route %s)", svc.Url))
+		}
+	}
 
+	if err := validateFormats(svc); nil != err {
+		return err
+	}
+
+	if err := validateMask(svc); nil != err {
+		return err
 	}
 
 	if svc.Fileupload && svc.Parseform {
 		return errors.New(fmt.Sprintf("`fileupload' or `parseform' must be used exclusively"))
 	}
 
+	if "" != svc.Upload_svc {
+
+		if !svc.Fileupload {
+			return errors.New(fmt.Sprintf("`upload_svc' requires `fileupload' (route %s)",
+				svc.Url))
+		}
+
+		if UPLOAD_MODE_CHUNKS != svc.Upload_mode && UPLOAD_MODE_CONV != svc.Upload_mode {
+			return errors.New(fmt.Sprintf("Invalid `upload_mode' [%s] (route %s), "+
+				"valid: chunks, conv", svc.Upload_mode, svc.Url))
+		}
+
+		if svc.Upload_chunk <= 0 ||
+			int64(svc.Upload_chunk)+UPLOAD_HDR_RESERVE > atmi.ATMIMsgSizeMax() {
+			return errors.New(fmt.Sprintf("Invalid `upload_chunk' %d (route %s), "+
+				"max %d", svc.Upload_chunk, svc.Url,
+				atmi.ATMIMsgSizeMax()-UPLOAD_HDR_RESERVE))
+		}
+	}
+
+	if err := validateUpload(svc); nil != err {
+		return err
+	}
+
 	return nil
 }
 
@@ -601,6 +897,17 @@ func appinit(ac *atmi.ATMICtx) error {
 	M_defaults.Errfmt_text = ERRFMT_TEXT_DEFAULT
 	M_defaults.Asynccall = ASYNCCALL_DEFAULT
 	M_defaults.Errfmt_view_onsucc = ERRFMT_VIEW_ONSUCC_DEFAULT
+	M_defaults.Errfmt_xml_msg = ERRFMT_XML_MSG_DEFAULT
+	M_defaults.Errfmt_xml_code = ERRFMT_XML_CODE_DEFAULT
+	M_defaults.Errfmt_xml_onsucc = ERRFMT_XML_ONSUCC_DEFAULT
+	M_defaults.Xml_root = XML_ROOT_DEFAULT
+	M_defaults.Cache_ttl = CACHE_TTL_DEFAULT
+	M_defaults.Cache_size = CACHE_SIZE_DEFAULT
+	M_defaults.Proxy_timeout = PROXY_TIMEOUT_DEFAULT
+	M_defaults.Upload_mode = UPLOAD_MODE_DEFAULT
+	M_defaults.Upload_chunk = UPLOAD_CHUNK_DEFAULT
+	M_defaults.Upload_sanitize = true
+	M_defaults.Upload_scan_time = UPLOAD_SCAN_TIME_DEFAULT
 
 	//Do not use known rm optimization, so that each time
 	//transaction life is validated.
@@ -690,9 +997,69 @@ func appinit(ac *atmi.ATMICtx) error {
 		case "tls_key_file":
 			M_tls_key_file, _ = buf.BGetString(u.EX_CC_VALUE, occ)
 			break
+		case "tls_min_version":
+			minVer, _ := buf.BGetString(u.EX_CC_VALUE, occ)
+			if err := tlsParseMinVersion(minVer); nil != err {
+				ac.TpLogError("%s", err.Error())
+				return err
+			}
+			break
+		case "tls_ciphers":
+			M_tls_ciphers, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "tls_sni_certs":
+			M_tls_sni_certs, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "tls_reload_interval":
+			M_tls_reload_interval, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
 		case "tpopen":
 			M_do_tpopen = true
 			break
+		case "http2":
+			http2, _ := buf.BGetInt(u.EX_CC_VALUE, occ)
+			M_http2 = TRUE == http2
+			break
+		case "h2c":
+			h2c, _ := buf.BGetInt(u.EX_CC_VALUE, occ)
+			M_h2c = TRUE == h2c
+			break
+		case "http2_max_streams":
+			M_http2_max_streams, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "ip_allow":
+			M_ip_allow, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "ip_deny":
+			M_ip_deny, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "trusted_proxies":
+			M_trusted_proxies, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "ip_forward_header":
+			M_ip_forward_header, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "vhosts":
+			M_vhosts_cfg, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "vhost_unknown_code":
+			M_vhost_unknown_code, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "vhost_unknown_body":
+			M_vhost_unknown_body, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "accesslog":
+			M_accesslog_file, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "accesslog_format":
+			M_accesslog_format, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "accesslog_maxsize":
+			M_accesslog_maxsize, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "accesslog_backups":
+			M_accesslog_backups, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
 		case "defaults":
 			//Override the defaults
 			jsonDefault, _ := buf.BGetByteArr(u.EX_CC_VALUE, occ)
@@ -752,13 +1119,16 @@ func appinit(ac *atmi.ATMICtx) error {
 		ac.TpLog(atmi.LOG_DEBUG, "Got config field [%s]", fldName)
 
 		//Load routes...
-		if strings.HasPrefix(fldName, "/") {
+		if group, urlPath := vhostSplitKey(fldName); "" != urlPath {
 			cfgVal, _ := buf.BGetString(u.EX_CC_VALUE, occ)
 
 			ac.TpLogInfo("Got route config [%s]", cfgVal)
 
 			tmp := M_defaults
 
+			//Decoder reuses slices, do not share them with defaults
+			tmp.Mask_regex = append([]string(nil), M_defaults.Mask_regex...)
+
 			//Override the stuff from current config
 
 			//err := json.Unmarshal(cfgVal, &tmp)
@@ -779,7 +1149,8 @@ func appinit(ac *atmi.ATMICtx) error {
 
 			ac.TpLogDebug("Got route: URL [%s] -> Service [%s]",
 				fldName, tmp.Svc)
-			tmp.Url = fldName
+			tmp.Url = urlPath
+			tmp.Vhost = group
 
 			//Parse http errors for
 			if tmp.Errors_fmt_http_map_str != "" {
@@ -836,24 +1207,44 @@ func appinit(ac *atmi.ATMICtx) error {
 				return err
 			}
 
+			//Validate cache & open it
+			if err = validateCache(ac, &tmp); err != nil {
+				return err
+			}
+
+			//Parse client access lists
+			if err = validateIPACL(ac, &tmp); err != nil {
+				return err
+			}
+
+			//Setup upstream for proxy routes
+			if err = proxySetup(ac, &tmp); err != nil {
+				return err
+			}
+
+			if tmp.Cache {
+				tmp.RspCache = newRspCache(fldName, tmp.Cache_size)
+				M_caches[fldName] = tmp.RspCache
+			}
+
 			printSvcSummary(ac, &tmp)
 
 			ac.TpLogInfo("Checking if service uses regexp")
 			//Add to HTTP listener
-			if tmp.Format == "regexp" || tmp.Format == "r" {
-				if r, err := regexp.Compile(fldName); err == nil {
-					ac.TpLogInfo("Regexp compiled")
-					M_handler.HandleFunc(r, tmp)
-				} else {
-					ac.TpLogError("Failed to compile regexp [%s]",
-						err.Error())
-				}
-			} else {
-				M_handler.HandleFunc(nil, tmp)
-			}
+			vhostRegister(ac, group, tmp)
 		}
 	}
 
+	if err := ipaclSetup(ac); nil != err {
+		ac.TpLogError("%s", err.Error())
+		return err
+	}
+
+	if err := vhostSetup(ac); nil != err {
+		ac.TpLogError("%s", err.Error())
+		return err
+	}
+
 	if atmi.FAIL == M_port || "" == M_ip {
 		ac.TpLog(atmi.LOG_ERROR, "Invalid config: missing ip (%s) or port (%d)",
 			M_ip, M_port)
@@ -869,6 +1260,13 @@ func appinit(ac *atmi.ATMICtx) error {
 		return errors.New("Invalid config: missing ip or port")
 	}
 
+	if TRUE == M_tls_enable {
+		if err := tlsSetup(ac); nil != err {
+			ac.TpLogError("%s", err.Error())
+			return err
+		}
+	}
+
 	if M_defaults.Parsecookies && !M_defaults.Parseheaders {
 		return errors.New("Invalid config: parsecookies works only in parseheader mode")
 	}
@@ -935,6 +1333,13 @@ func appinit(ac *atmi.ATMICtx) error {
 
 	}
 
+	if "" != M_accesslog_file {
+		if err := accessLogOpen(ac); nil != err {
+			ac.TpLogError("%s", err.Error())
+			return err
+		}
+	}
+
 	ac.TpLogInfo("About to init woker pool, number of workers: %d", M_workers)
 
 	if err := initPool(ac); nil != err {
@@ -961,6 +1366,10 @@ func unInit(ac *atmi.ATMICtx, retCode int) {
 		M_ctxs[nr].FreeATMICtx()
 	}
 
+	if nil != M_accesslog {
+		M_accesslog.close()
+	}
+
 	ac.TpTerm()
 	ac.FreeATMICtx()
 	os.Exit(retCode)
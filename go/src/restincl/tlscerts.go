@@ -0,0 +1,312 @@
+/**
+ * @brief TLS listener settings, SNI certificates and certificate reload
+ *
+ * @file tlscerts.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Defaults
+const (
+	TLS_RELOAD_INTERVAL_DEFAULT = 10 /* Certificate file check interval, seconds */
+)
+
+/* TLS additional settings: */
+var M_tls_min_version uint16 = tls.VersionTLS12
+var M_tls_ciphers string   //Comma separated cipher suite names
+var M_tls_sni_certs string //JSON: {"host":{"cert":"file","key":"file"}}
+var M_tls_reload_interval int = TLS_RELOAD_INTERVAL_DEFAULT
+var M_tls_config *tls.Config //Resolved TLS config of the listener
+var M_tls_certs CertStore    //Loaded certificates
+
+//SNI certificate files in config
+type sniCertFiles struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+//Certificate pair with file modification times for reload
+type certPair struct {
+	certFile  string
+	keyFile   string
+	certMtime time.Time
+	keyMtime  time.Time
+	cert      *tls.Certificate
+}
+
+//Certificates served by the listener
+type CertStore struct {
+	mu   sync.RWMutex
+	def  *certPair            //Default certificate (no SNI match)
+	sni  map[string]*certPair //Lower case host name or *.domain wildcard
+	list []*certPair          //All pairs, for reload
+}
+
+//Parse tls_min_version setting
+//@param ver version string
+//@return error or nil
+func tlsParseMinVersion(ver string) error {
+
+	switch ver {
+	case "TLS10":
+		M_tls_min_version = tls.VersionTLS10
+	case "TLS11":
+		M_tls_min_version = tls.VersionTLS11
+	case "TLS12":
+		M_tls_min_version = tls.VersionTLS12
+	case "TLS13":
+		M_tls_min_version = tls.VersionTLS13
+	default:
+		return errors.New(fmt.Sprintf("Invalid tls_min_version [%s], "+
+			"expected: TLS10,TLS11,TLS12,TLS13", ver))
+	}
+
+	return nil
+}
+
+//Resolve cipher suite names to ids
+//@param names comma separated list of names
+//@return ids, error
+func tlsParseCiphers(names string) ([]uint16, error) {
+
+	var ret []uint16
+
+	known := make(map[string]uint16)
+
+	for _, c := range tls.CipherSuites() {
+		known[c.Name] = c.ID
+	}
+
+	for _, c := range tls.InsecureCipherSuites() {
+		known[c.Name] = c.ID
+	}
+
+	for _, n := range strings.Split(names, ",") {
+
+		n = strings.TrimSpace(n)
+
+		if "" == n {
+			continue
+		}
+
+		id, ok := known[n]
+
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Unknown cipher suite [%s] "+
+				"in tls_ciphers", n))
+		}
+
+		ret = append(ret, id)
+	}
+
+	return ret, nil
+}
+
+//Load the pair if files are changed
+//@param force load even if not changed
+//@return true if loaded, error
+func (p *certPair) load(force bool) (bool, error) {
+
+	ci, err := os.Stat(p.certFile)
+
+	if nil != err {
+		return false, err
+	}
+
+	ki, err := os.Stat(p.keyFile)
+
+	if nil != err {
+		return false, err
+	}
+
+	if !force && ci.ModTime().Equal(p.certMtime) && ki.ModTime().Equal(p.keyMtime) {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+
+	if nil != err {
+		return false, err
+	}
+
+	p.cert = &cert
+	p.certMtime = ci.ModTime()
+	p.keyMtime = ki.ModTime()
+
+	return true, nil
+}
+
+//Select certificate by SNI host name
+//@param hello client hello
+//@return certificate, error
+func (cs *CertStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	host := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	if "" != host {
+
+		if p, ok := cs.sni[host]; ok {
+			return p.cert, nil
+		}
+
+		//Wildcard, one label
+		if i := strings.Index(host, "."); i > 0 {
+			if p, ok := cs.sni["*"+host[i:]]; ok {
+				return p.cert, nil
+			}
+		}
+	}
+
+	return cs.def.cert, nil
+}
+
+//Check the certificate files and reload changed ones.
+//On failure old certificate is kept.
+//@param ac ATMI Context
+func (cs *CertStore) reload(ac *atmi.ATMICtx) {
+
+	for _, p := range cs.list {
+
+		//Load copy, so that handshakes see consistent pair
+		tmp := *p
+
+		loaded, err := tmp.load(false)
+
+		if nil != err {
+			ac.TpLogError("Failed to reload certificate [%s]/[%s] - keeping "+
+				"old one: %s", p.certFile, p.keyFile, err.Error())
+		} else if loaded {
+			cs.mu.Lock()
+			*p = tmp
+			cs.mu.Unlock()
+
+			ac.TpLogWarn("Certificate [%s]/[%s] reloaded", p.certFile, p.keyFile)
+		}
+	}
+}
+
+//Add certificate pair to store and load it
+//@param certFile certificate file
+//@param keyFile key file
+//@return pair, error
+func (cs *CertStore) add(certFile string, keyFile string) (*certPair, error) {
+
+	p := certPair{certFile: certFile, keyFile: keyFile}
+
+	if _, err := p.load(true); nil != err {
+		return nil, errors.New(fmt.Sprintf("Failed to load TLS certificate "+
+			"[%s]/[%s]: %s", certFile, keyFile, err.Error()))
+	}
+
+	cs.list = append(cs.list, &p)
+
+	return &p, nil
+}
+
+//Prepare TLS configuration of the listener: certificates (default + SNI),
+//min version, ciphers. Start certificate file watcher.
+//@param ac ATMI Context
+//@return error or nil
+func tlsSetup(ac *atmi.ATMICtx) error {
+
+	var err error
+
+	M_tls_certs.sni = make(map[string]*certPair)
+
+	if M_tls_certs.def, err = M_tls_certs.add(M_tls_cert_file, M_tls_key_file); nil != err {
+		return err
+	}
+
+	if "" != M_tls_sni_certs {
+
+		sni := make(map[string]sniCertFiles)
+
+		if err := json.Unmarshal([]byte(M_tls_sni_certs), &sni); nil != err {
+			return errors.New(fmt.Sprintf("Failed to parse tls_sni_certs: %s",
+				err.Error()))
+		}
+
+		for host, f := range sni {
+
+			if "" == f.Cert || "" == f.Key {
+				return errors.New(fmt.Sprintf("tls_sni_certs host [%s]: "+
+					"cert and key are mandatory", host))
+			}
+
+			p, err := M_tls_certs.add(f.Cert, f.Key)
+
+			if nil != err {
+				return err
+			}
+
+			M_tls_certs.sni[strings.ToLower(host)] = p
+			ac.TpLogInfo("SNI host [%s] certificate [%s]", host, f.Cert)
+		}
+	}
+
+	M_tls_config = &tls.Config{GetCertificate: M_tls_certs.getCertificate,
+		MinVersion: M_tls_min_version}
+
+	if "" != M_tls_ciphers {
+		if M_tls_config.CipherSuites, err = tlsParseCiphers(M_tls_ciphers); nil != err {
+			return err
+		}
+	}
+
+	ac.TpLogInfo("TLS Min version: %x, ciphers: [%s], reload interval: %d",
+		M_tls_min_version, M_tls_ciphers, M_tls_reload_interval)
+
+	if M_tls_reload_interval > 0 {
+		go func() {
+			for range time.Tick(time.Duration(M_tls_reload_interval) * time.Second) {
+				M_tls_certs.reload(M_ac)
+			}
+		}()
+	}
+
+	return nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
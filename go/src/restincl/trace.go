@@ -0,0 +1,242 @@
+/**
+ * @brief W3C Trace Context propagation into XATMI calls
+ *
+ * @file trace.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//W3C Trace Context headers
+const (
+	TRACE_HDR_PARENT = "traceparent"
+	TRACE_HDR_STATE  = "tracestate"
+	TRACE_FLAGS_NEW  = "01" //Sampled flag for traces started by restincl
+
+	TRACE_KEY_PARENT = "EX_IF_TRACEPARENT" //VIEW member of traceparent
+	TRACE_KEY_STATE  = "EX_IF_TRACESTATE"  //VIEW member of tracestate
+)
+
+//version-traceid-parentid-flags
+var M_traceRex = regexp.MustCompile("^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$")
+
+//Generate random hex id
+//@param n number of bytes
+//@return hex string
+func traceRandId(n int) string {
+
+	b := make([]byte, n)
+
+	for {
+		if _, err := rand.Read(b); nil != err {
+			//Not expected, fallback to pid based id
+			copy(b, []byte(fmt.Sprintf("%0*x", n, os.Getpid())))
+		}
+
+		//All zero ids are invalid
+		for _, c := range b {
+			if 0 != c {
+				return hex.EncodeToString(b)
+			}
+		}
+	}
+}
+
+//Accept incoming W3C traceparent/tracestate or start new trace. restincl
+//acts as new span, thus parent id is regenerated for the downstream calls.
+//Trace headers are set in response.
+//@param ac ATMI Context
+//@param svc service map
+//@param w response writer
+//@param req HTTP request
+//@param rctx request context, gets trace data
+func traceStart(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
+	req *http.Request, rctx *RequestContext) {
+
+	if !svc.Trace {
+		return
+	}
+
+	flags := TRACE_FLAGS_NEW
+	rctx.traceState = ""
+	rctx.traceId = ""
+
+	incoming := strings.TrimSpace(strings.ToLower(req.Header.Get(TRACE_HDR_PARENT)))
+
+	if m := M_traceRex.FindStringSubmatch(incoming); nil != m && "ff" != m[1] &&
+		strings.Trim(m[2], "0") != "" && strings.Trim(m[3], "0") != "" {
+
+		rctx.traceId = m[2]
+		flags = m[4]
+		rctx.traceState = strings.Join(req.Header[http.CanonicalHeaderKey(TRACE_HDR_STATE)], ",")
+		ac.TpLogInfo("Continuing trace from [%s]", incoming)
+	} else {
+
+		if "" != incoming {
+			ac.TpLogWarn("Invalid traceparent [%s] - starting new trace", incoming)
+		}
+
+		rctx.traceId = traceRandId(16)
+	}
+
+	rctx.traceParent = fmt.Sprintf("00-%s-%s-%s", rctx.traceId, traceRandId(8), flags)
+
+	ac.TpLogInfo("Request traceparent [%s] tracestate [%s]",
+		rctx.traceParent, rctx.traceState)
+
+	w.Header().Set(TRACE_HDR_PARENT, rctx.traceParent)
+
+	if "" != rctx.traceState {
+		w.Header().Set(TRACE_HDR_STATE, rctx.traceState)
+	}
+}
+
+//Load trace context into UBF request buffer
+//@param ac ATMI Context
+//@param bufu UBF buffer
+//@param rctx request context
+//@return UBF error or nil
+func traceLoadUBF(ac *atmi.ATMICtx, bufu *atmi.TypedUBF,
+	rctx *RequestContext) atmi.UBFError {
+
+	if "" == rctx.traceParent {
+		return nil
+	}
+
+	if errU := bufu.BChg(ubftab.EX_IF_TRACEPARENT, 0, rctx.traceParent); nil != errU {
+		ac.TpLogError("Failed to set EX_IF_TRACEPARENT: %s", errU.Error())
+		return errU
+	}
+
+	if "" != rctx.traceState {
+		if errU := bufu.BChg(ubftab.EX_IF_TRACESTATE, 0, rctx.traceState); nil != errU {
+			ac.TpLogError("Failed to set EX_IF_TRACESTATE: %s", errU.Error())
+			return errU
+		}
+	}
+
+	return nil
+}
+
+//Load trace context into VIEW request buffer, if view has the members
+//@param ac ATMI Context
+//@param bufv VIEW buffer
+//@param rctx request context
+//@return ATMI error or nil
+func traceLoadVIEW(ac *atmi.ATMICtx, bufv *atmi.TypedVIEW,
+	rctx *RequestContext) atmi.ATMIError {
+
+	if "" == rctx.traceParent {
+		return nil
+	}
+
+	for _, m := range []struct{ name, val string }{
+		{TRACE_KEY_PARENT, rctx.traceParent},
+		{TRACE_KEY_STATE, rctx.traceState}} {
+
+		if errU := bufv.BVChg(m.name, 0, m.val); nil != errU {
+
+			if atmi.BNOCNAME == errU.Code() {
+				ac.TpLogDebug("VIEW has no [%s] member - not loaded", m.name)
+				continue
+			}
+
+			ac.TpLogError("Failed to set [%s]: %s", m.name, errU.Error())
+			return atmi.NewCustomATMIError(atmi.TPESYSTEM,
+				fmt.Sprintf("Failed to set [%s]: %s", m.name, errU.Message()))
+		}
+	}
+
+	return nil
+}
+
+//Set trace headers for the upstream call
+//@param header request headers
+//@param rctx request context
+func traceSetHeaders(header http.Header, rctx *RequestContext) {
+
+	if "" == rctx.traceParent {
+		return
+	}
+
+	header.Set(TRACE_HDR_PARENT, rctx.traceParent)
+
+	if "" != rctx.traceState {
+		header.Set(TRACE_HDR_STATE, rctx.traceState)
+	} else {
+		header.Del(TRACE_HDR_STATE)
+	}
+}
+
+//Open request log file named by trace id (if configured). For UBF buffers
+//file name is stored in buffer, so that services log to the same file.
+//@param ac ATMI Context
+//@param svc service map
+//@param buf request buffer, may be nil
+//@param rctx request context
+//@return true if request log file is open
+func traceLogOpen(ac *atmi.ATMICtx, svc *ServiceMap, buf atmi.TypedBuffer,
+	rctx *RequestContext) bool {
+
+	if "" == svc.Tracelogdir || "" == rctx.traceId {
+		return false
+	}
+
+	fname := filepath.Join(svc.Tracelogdir, rctx.traceId+".log")
+
+	if bufu, ok := buf.(*atmi.TypedUBF); ok {
+
+		if err := ac.TpLogSetReqFile(bufu, fname, ""); nil != err {
+			ac.TpLogError("Failed to set request log file [%s]: %s",
+				fname, err.Error())
+			return false
+		}
+	} else {
+		ac.TpLogSetReqFileDirect(fname)
+	}
+
+	ac.TpLogInfo("Request logging to [%s]", fname)
+
+	return true
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
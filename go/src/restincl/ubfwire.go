@@ -0,0 +1,283 @@
+/**
+ * @brief JSON / binary UBF wire format negotiation for json2ubf routes
+ *
+ * @file ubfwire.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Wire formats of json2ubf routes
+const (
+	FORMAT_JSON = "json"
+	FORMAT_UBF  = "ubf"
+
+	MIME_JSON = "application/json"
+	MIME_UBF  = "application/x-ubf" //Binary UBF, as produced by Bwrite(3)
+)
+
+//Parse the accepted wire formats of the route
+//@param svc service map
+//@return error or nil
+func validateFormats(svc *ServiceMap) error {
+
+	svc.Formats_json = false
+	svc.Formats_ubf = false
+
+	if "" == strings.TrimSpace(svc.Formats) {
+		svc.Formats_json = true
+		return nil
+	}
+
+	for _, f := range strings.Split(svc.Formats, ",") {
+
+		switch strings.ToLower(strings.TrimSpace(f)) {
+		case FORMAT_JSON:
+			svc.Formats_json = true
+		case FORMAT_UBF:
+			svc.Formats_ubf = true
+		default:
+			return errors.New(fmt.Sprintf("Invalid format [%s] in `formats' "+
+				"(route %s), valid: json, ubf", f, svc.Url))
+		}
+	}
+
+	if svc.Formats_ubf && CONV_JSON2UBF != svc.Conv_int {
+		return errors.New(fmt.Sprintf("`formats' with ubf is valid only for "+
+			"json2ubf conv (cur %s)", svc.Conv))
+	}
+
+	return nil
+}
+
+//Get the media type of the header value
+//@param val header value (e.g. Content-Type)
+//@return media type or empty string
+func mediaType(val string) string {
+
+	mt, _, err := mime.ParseMediaType(val)
+
+	if nil != err {
+		return ""
+	}
+
+	return mt
+}
+
+//Get the quality of the media type in the Accept header (RFC 7231). Exact
+//media type takes precedence over type/* and */* ranges.
+//@param accept Accept header value
+//@param mt media type to check
+//@return quality (0..1, 0 - not acceptable) or -1 if not listed, position
+//of the matched entry in the header
+func acceptQuality(accept string, mt string) (float64, int) {
+
+	q := -1.0
+	pos := -1
+	prec := 0
+
+	for i, a := range strings.Split(accept, ",") {
+
+		amt, params, err := mime.ParseMediaType(a)
+
+		if nil != err {
+			continue
+		}
+
+		p := 0
+
+		switch {
+		case amt == mt:
+			p = 3
+		case "*/*" == amt:
+			p = 1
+		case strings.HasSuffix(amt, "/*") &&
+			strings.HasPrefix(mt, strings.TrimSuffix(amt, "*")):
+			p = 2
+		}
+
+		if p <= prec {
+			continue
+		}
+
+		prec = p
+		pos = i
+		q = 1
+
+		if v, ok := params["q"]; ok {
+			f, errF := strconv.ParseFloat(v, 64)
+
+			if nil == errF && f >= 0 && f <= 1 {
+				q = f
+			}
+		}
+	}
+
+	return q, pos
+}
+
+//Choose the response format by the Accept header. Format with higher quality
+//wins, on equal quality the one listed first. Formats with q=0 are not
+//acceptable.
+//@param svc service map
+//@param accept Accept header value
+//@return MIME_JSON, MIME_UBF, empty string if there is no preference, or
+//error if none of the route formats is acceptable
+func acceptFormat(svc *ServiceMap, accept string) (string, error) {
+
+	qj, pj := acceptQuality(accept, MIME_JSON)
+	qu, pu := acceptQuality(accept, MIME_UBF)
+
+	okJson := svc.Formats_json && 0 != qj
+	okUbf := svc.Formats_ubf && 0 != qu
+
+	switch {
+	case !okJson && !okUbf:
+		return "", fmt.Errorf("None of route formats is acceptable by [%s]",
+			accept)
+	case !okJson:
+		return MIME_UBF, nil
+	case !okUbf:
+		return MIME_JSON, nil
+	case qu > qj, qu == qj && pu > -1 && pu < pj:
+		return MIME_UBF, nil
+	case qj > qu, qj == qu && pj > -1 && pj < pu:
+		return MIME_JSON, nil
+	}
+
+	return "", nil
+}
+
+//Resolve request and response wire formats. Response format is UBF if it is
+//the only format of the route, if caller prefers it in Accept header or if
+//request is UBF and caller have not asked for JSON.
+//@param ac ATMI Context
+//@param svc service map
+//@param req HTTP request
+//@param rctx request context, gets reqUBF/rspUBF set
+//@return ATMI error if request format is not accepted by route or response
+//format is not acceptable by caller
+func resolveFormats(ac *atmi.ATMICtx, svc *ServiceMap, req *http.Request,
+	rctx *RequestContext) atmi.ATMIError {
+
+	if !svc.Formats_ubf {
+		return nil
+	}
+
+	rctx.reqUBF = MIME_UBF == mediaType(req.Header.Get("Content-Type"))
+
+	if !rctx.reqUBF && !svc.Formats_json {
+
+		rctx.rspCode = http.StatusUnsupportedMediaType
+
+		return atmi.NewCustomATMIError(atmi.TPEINVAL,
+			fmt.Sprintf("Unsupported content type [%s], expected %s",
+				req.Header.Get("Content-Type"), MIME_UBF))
+	}
+
+	accept := req.Header.Get("Accept")
+	format := ""
+
+	if "" != strings.TrimSpace(accept) {
+
+		var err error
+
+		if format, err = acceptFormat(svc, accept); nil != err {
+
+			rctx.rspCode = http.StatusNotAcceptable
+
+			return atmi.NewCustomATMIError(atmi.TPEINVAL, err.Error())
+		}
+	}
+
+	switch format {
+	case MIME_UBF:
+		rctx.rspUBF = true
+	case MIME_JSON:
+		rctx.rspUBF = false
+	default:
+		rctx.rspUBF = rctx.reqUBF
+	}
+
+	ac.TpLogInfo("Wire formats: request ubf: %t response ubf: %t",
+		rctx.reqUBF, rctx.rspUBF)
+
+	return nil
+}
+
+//Generate binary UBF response. Error code and message are installed
+//in EX_IF_ECODE/EX_IF_EMSG fields.
+//@param ac ATMI Context
+//@param bufu response buffer, if nil, new buffer is allocated
+//@param err ATMI error of the call
+//@return serialized buffer or nil on failure
+func ubfWriteRsp(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, err atmi.ATMIError) []byte {
+
+	if nil == bufu {
+
+		var errA atmi.ATMIError
+
+		if bufu, errA = ac.NewUBF(1024); nil != errA {
+			ac.TpLogError("Failed to alloc UBF for response: %s", errA.Error())
+			return nil
+		}
+	}
+
+	if e1 := bufu.BChg(ubftab.EX_IF_ECODE, 0, err.Code()); nil != e1 {
+		ac.TpLogError("Failed to set EX_IF_ECODE: %d/%s ",
+			e1.Code(), e1.Message())
+	}
+
+	if e2 := bufu.BChg(ubftab.EX_IF_EMSG, 0, err.Message()); nil != e2 {
+		ac.TpLogError("Failed to set EX_IF_EMSG: %d/%s ",
+			e2.Code(), e2.Message())
+	}
+
+	rsp, errU := bufu.BWrite()
+
+	if nil != errU {
+		ac.TpLogError("Failed to serialize UBF: %s", errU.Error())
+		return nil
+	}
+
+	return rsp
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
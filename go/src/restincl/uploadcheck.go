@@ -0,0 +1,439 @@
+/**
+ * @brief Upload content verification - limits, MIME sniffing, scanner hook
+ *
+ * @file uploadcheck.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+	"ubftab"
+	"unicode"
+	"unicode/utf8"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+const (
+	UPLOAD_SNIFF_LEN    = 512 //Bytes used for content type detection
+	UPLOAD_NAME_MAX_LEN = 255 //Max length of sanitized file name
+
+	//File name used if nothing is left of client name after sanitizing
+	UPLOAD_NAME_EMPTY = "unnamed"
+)
+
+//Upload content verification of single request
+type uploadVerifier struct {
+	ac    *atmi.ATMICtx
+	svc   *ServiceMap
+	rctx  *RequestContext
+	files int   //Number of files (parts with file name) received
+	total int64 //Bytes received in all parts
+
+	//Current part:
+	isFile  bool
+	size    int64
+	sha     hash.Hash
+	sniff   []byte
+	checked bool
+	mime    string //Client or detected (if verified) content type
+}
+
+//Validate upload verification settings of the route
+//@param svc route
+//@return error or nil
+func validateUpload(svc *ServiceMap) error {
+
+	svc.Upload_mime_arr = nil
+
+	for _, m := range strings.Split(svc.Upload_mime, ",") {
+		if m = strings.ToLower(strings.TrimSpace(m)); "" != m {
+			svc.Upload_mime_arr = append(svc.Upload_mime_arr, m)
+		}
+	}
+
+	if !svc.Fileupload {
+
+		if nil != svc.Upload_mime_arr || 0 != svc.Upload_max_files ||
+			0 != svc.Upload_max_size || 0 != svc.Upload_max_total ||
+			"" != svc.Upload_scan_svc || "" != svc.Upload_scan_cmd {
+			return errors.New(fmt.Sprintf("`upload_*' checks require "+
+				"`fileupload' (route %s)", svc.Url))
+		}
+
+		return nil
+	}
+
+	if svc.Upload_max_files < 0 || svc.Upload_max_size < 0 || svc.Upload_max_total < 0 {
+		return errors.New(fmt.Sprintf("Invalid upload limits (route %s)", svc.Url))
+	}
+
+	if "" != svc.Upload_scan_cmd && svc.Upload_scan_time < 1 {
+		return errors.New(fmt.Sprintf("Invalid `upload_scan_time' %d, must be "+
+			">= 1 (route %s)", svc.Upload_scan_time, svc.Url))
+	}
+
+	if "" != svc.Upload_scan_cmd && "" != svc.Upload_svc {
+		return errors.New(fmt.Sprintf("`upload_scan_cmd' cannot be used with "+
+			"`upload_svc', files are not stored locally (route %s)", svc.Url))
+	}
+
+	return nil
+}
+
+//Clean up the client supplied file name: path is removed,
+//control and reserved characters are dropped, leading dots removed.
+//If nothing is left of the given name, placeholder name is used.
+//@param name file name from the form
+//@return sanitized name
+func uploadSanitizeName(name string) string {
+
+	if "" == name {
+		//Not a file
+		return name
+	}
+
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune("<>:\"/|?*", r) {
+			return -1
+		}
+		return r
+	}, name)
+
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+
+	//Cut at rune boundary
+	for len(name) > UPLOAD_NAME_MAX_LEN {
+		_, sz := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-sz]
+	}
+
+	if "" == name {
+		name = UPLOAD_NAME_EMPTY
+	}
+
+	return name
+}
+
+//Create verifier for the request
+//@param ac ATMI Context
+//@param svc route
+//@param rctx request context
+//@return verifier
+func newUploadVerifier(ac *atmi.ATMICtx, svc *ServiceMap,
+	rctx *RequestContext) *uploadVerifier {
+	return &uploadVerifier{ac: ac, svc: svc, rctx: rctx}
+}
+
+//Reject the upload with given ATMI error and http status
+//@param code ATMI error code
+//@param status http status of the response
+//@param msg message
+//@return ATMI error
+func (v *uploadVerifier) reject(code int, status int, msg string) atmi.ATMIError {
+
+	v.ac.TpLogError("Upload rejected: %s", msg)
+	v.rctx.rspCode = status
+
+	return atmi.NewCustomATMIError(code, msg)
+}
+
+//Start next part of the upload
+//@param part multipart part
+//@return ATMI error if limits exceeded
+func (v *uploadVerifier) start(part *multipart.Part) atmi.ATMIError {
+
+	v.isFile = "" != part.FileName()
+	v.size = 0
+	v.sha = sha256.New()
+	v.sniff = v.sniff[:0]
+	v.checked = false
+	v.mime = part.Header.Get("Content-Type")
+
+	if v.isFile {
+		v.files++
+
+		if v.svc.Upload_max_files > 0 && v.files > v.svc.Upload_max_files {
+			return v.reject(atmi.TPELIMIT, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Too many files, max %d", v.svc.Upload_max_files))
+		}
+	}
+
+	return nil
+}
+
+//Process received data of the part
+//@param data received data
+//@return ATMI error if limits exceeded or content type not allowed
+func (v *uploadVerifier) write(data []byte) atmi.ATMIError {
+
+	v.size += int64(len(data))
+	v.total += int64(len(data))
+	v.sha.Write(data)
+
+	if v.svc.Upload_max_size > 0 && v.size > v.svc.Upload_max_size {
+		return v.reject(atmi.TPELIMIT, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("File too large, max %d bytes", v.svc.Upload_max_size))
+	}
+
+	if v.svc.Upload_max_total > 0 && v.total > v.svc.Upload_max_total {
+		return v.reject(atmi.TPELIMIT, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Upload too large, max %d bytes", v.svc.Upload_max_total))
+	}
+
+	if !v.checked && len(v.sniff) < UPLOAD_SNIFF_LEN {
+
+		n := UPLOAD_SNIFF_LEN - len(v.sniff)
+
+		if n > len(data) {
+			n = len(data)
+		}
+
+		v.sniff = append(v.sniff, data[:n]...)
+	}
+
+	if len(v.sniff) >= UPLOAD_SNIFF_LEN {
+		return v.check()
+	}
+
+	return nil
+}
+
+//Detect the content type of the part and check it against allowed list.
+//Performed once per part, with data received so far
+//@return ATMI error if content type is not allowed
+func (v *uploadVerifier) check() atmi.ATMIError {
+
+	if v.checked || nil == v.svc.Upload_mime_arr || !v.isFile {
+		return nil
+	}
+
+	v.checked = true
+	detected := http.DetectContentType(v.sniff)
+	mediaType, _, err := mime.ParseMediaType(detected)
+
+	if nil != err {
+		mediaType = detected
+	}
+
+	for _, m := range v.svc.Upload_mime_arr {
+		if m == mediaType || (strings.HasSuffix(m, "/*") &&
+			strings.HasPrefix(mediaType, m[:len(m)-1])) {
+			v.mime = mediaType
+			return nil
+		}
+	}
+
+	return v.reject(atmi.TPEINVAL, http.StatusUnsupportedMediaType,
+		fmt.Sprintf("Content type [%s] of file not allowed (client sent [%s])",
+			mediaType, v.mime))
+}
+
+//Finish the part
+//@return SHA-256 (hex) of the part, ATMI error if content type not allowed
+func (v *uploadVerifier) finish() (string, atmi.ATMIError) {
+
+	if errA := v.check(); nil != errA {
+		return "", errA
+	}
+
+	return hex.EncodeToString(v.sha.Sum(nil)), nil
+}
+
+//Set detected content type of the part in request buffer (if verified)
+//@param bufu request buffer
+//@param occ occurrence of the part
+//@return ATMI error or nil
+func (v *uploadVerifier) loadMime(bufu *atmi.TypedUBF, occ int) atmi.ATMIError {
+
+	if !v.checked {
+		return nil
+	}
+
+	if errU := bufu.BChg(ubftab.EX_IF_REQFILEMIME, occ, v.mime); nil != errU {
+		return atmi.NewCustomATMIError(atmi.TPESYSTEM,
+			fmt.Sprintf("Failed to set EX_IF_REQFILEMIME[%d]: %s", occ, errU.Error()))
+	}
+
+	return nil
+}
+
+//Store the verification results of the part in request buffer
+//@param bufu request buffer
+//@param occ occurrence of the part
+//@param sum SHA-256 of the part
+//@return ATMI error or nil
+func (v *uploadVerifier) load(bufu *atmi.TypedUBF, occ int, sum string) atmi.ATMIError {
+
+	if errA := v.loadMime(bufu, occ); nil != errA {
+		return errA
+	}
+
+	if errU := bufu.BChg(ubftab.EX_IF_REQFILESHA256, occ, sum); nil != errU {
+		return atmi.NewCustomATMIError(atmi.TPESYSTEM,
+			fmt.Sprintf("Failed to set EX_IF_REQFILESHA256[%d]: %s", occ, errU.Error()))
+	}
+
+	return nil
+}
+
+//Run the scanner hook on the uploaded files before target service is called.
+//Scanner service gets file attributes (local file name or upload id for
+//streamed uploads), command gets local file name as last argument. Failure
+//of the service or non zero exit status of the command rejects the upload.
+//@param ac ATMI Context
+//@param bufu request buffer with uploaded files
+//@param flags call flags
+//@return ATMI error or nil
+func (v *uploadVerifier) scan(ac *atmi.ATMICtx, bufu *atmi.TypedUBF,
+	flags int64) atmi.ATMIError {
+
+	if "" == v.svc.Upload_scan_svc && "" == v.svc.Upload_scan_cmd {
+		return nil
+	}
+
+	//Each received part is stored (form fields too), thus all are scanned
+	occs, _ := bufu.BOccur(ubftab.EX_IF_REQFILEFORM)
+
+	for i := 0; i < occs; i++ {
+
+		fname, _ := bufu.BGetString(ubftab.EX_IF_REQFILENAME, i)
+
+		if "" == fname {
+			fname = UPLOAD_NAME_EMPTY
+		}
+
+		if "" != v.svc.Upload_scan_svc {
+			if errA := v.scanSvc(ac, bufu, i, flags); nil != errA {
+				return errA
+			}
+		}
+
+		if "" != v.svc.Upload_scan_cmd {
+
+			disk, _ := bufu.BGetString(ubftab.EX_IF_REQFILEDISK, i)
+			args := append(strings.Fields(v.svc.Upload_scan_cmd), disk)
+
+			//Hung scanner shall not block the worker
+			ctx, cancel := context.WithTimeout(context.Background(),
+				time.Second*time.Duration(v.svc.Upload_scan_time))
+			cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+			cmd.WaitDelay = time.Second
+			out, err := cmd.CombinedOutput()
+			cancel()
+
+			ac.TpLogInfo("Scanner [%s] on [%s] (%s): [%s]", v.svc.Upload_scan_cmd,
+				disk, fname, strings.TrimSpace(string(out)))
+
+			if context.DeadlineExceeded == ctx.Err() {
+				return v.reject(atmi.TPETIME, http.StatusUnprocessableEntity,
+					fmt.Sprintf("File [%s] rejected, scanner timed out after %d sec",
+						fname, v.svc.Upload_scan_time))
+			} else if _, isExit := err.(*exec.ExitError); isExit {
+				return v.reject(atmi.TPEPERM, http.StatusUnprocessableEntity,
+					fmt.Sprintf("File [%s] rejected by scanner", fname))
+			} else if nil != err {
+				return atmi.NewCustomATMIError(atmi.TPEOS,
+					fmt.Sprintf("Failed to run scanner: %s", err.Error()))
+			}
+		}
+	}
+
+	return nil
+}
+
+//Call scanner service for the file
+//@param ac ATMI Context
+//@param bufu request buffer with uploaded files
+//@param occ file occurrence
+//@param flags call flags
+//@return ATMI error or nil
+func (v *uploadVerifier) scanSvc(ac *atmi.ATMICtx, bufu *atmi.TypedUBF,
+	occ int, flags int64) atmi.ATMIError {
+
+	scanbuf, errA := ac.NewUBF(1024)
+
+	if nil != errA {
+		return errA
+	}
+
+	for _, fld := range []int{ubftab.EX_IF_REQFILENAME, ubftab.EX_IF_REQFILEFORM,
+		ubftab.EX_IF_REQFILEMIME, ubftab.EX_IF_REQFILESHA256,
+		ubftab.EX_IF_REQFILEDISK, ubftab.EX_IF_UPLDID, ubftab.EX_IF_UPLDSIZE} {
+
+		if !bufu.BPres(fld, occ) {
+			continue
+		}
+
+		val, _ := bufu.BGetString(fld, occ)
+
+		if errU := scanbuf.BChg(fld, 0, val); nil != errU {
+			return atmi.NewCustomATMIError(atmi.TPESYSTEM,
+				fmt.Sprintf("Failed to prepare scanner buffer: %s", errU.Error()))
+		}
+	}
+
+	if _, errA = ac.TpCall(v.svc.Upload_scan_svc, scanbuf, flags); nil != errA {
+
+		fname, _ := bufu.BGetString(ubftab.EX_IF_REQFILENAME, occ)
+
+		if "" == fname {
+			fname = UPLOAD_NAME_EMPTY
+		}
+
+		if atmi.TPESVCFAIL == errA.Code() {
+			return v.reject(atmi.TPEPERM, http.StatusUnprocessableEntity,
+				fmt.Sprintf("File [%s] rejected by scanner", fname))
+		}
+
+		ac.TpLogError("Scanner service [%s] failed: %s",
+			v.svc.Upload_scan_svc, errA.Error())
+
+		return errA
+	}
+
+	return nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
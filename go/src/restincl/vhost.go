@@ -0,0 +1,283 @@
+/**
+ * @brief Virtual hosts - route groups selected by Host header
+ *
+ * @file vhost.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+	"ubftab"
+)
+
+//Name of the default group, routes without group prefix
+const VHOST_DEFAULT = "default"
+
+//Virtual host group, routes of the group are served only for
+//matching Host header
+type VHost struct {
+	Name    string
+	Hosts   []string       //Host patterns, exact or "*.domain"
+	Handler *RegexpHandler //Routes of the group
+}
+
+var M_vhosts_cfg string                     //JSON: group -> list of host patterns
+var M_vhosts = make(map[string]*VHost)      //Groups by name
+var M_vhost_exact = make(map[string]*VHost) //Exact host lookup
+var M_vhost_wild []string                   //Wildcard suffixes, longest first
+var M_vhost_wildmap = make(map[string]*VHost)
+var M_vhost_unknown_code int //If set, unknown hosts get this status
+var M_vhost_unknown_body string
+
+//Split the route config key into group and URL path
+//Key format is either "/path" (default group) or "group:/path"
+//@param key config key
+//@return group name, url path ("" if key is not a route)
+func vhostSplitKey(key string) (string, string) {
+
+	if strings.HasPrefix(key, "/") {
+		return VHOST_DEFAULT, key
+	}
+
+	if i := strings.Index(key, ":/"); i > 0 {
+		return key[:i], key[i+1:]
+	}
+
+	return "", ""
+}
+
+//Return the route handler of the group, group is created on first use
+//@param group group name
+//@return handler where to register routes
+func vhostHandler(group string) *RegexpHandler {
+
+	vh, ok := M_vhosts[group]
+
+	if ok {
+		return vh.Handler
+	}
+
+	vh = &VHost{Name: group}
+
+	if VHOST_DEFAULT == group {
+		vh.Handler = &M_handler
+	} else {
+		vh.Handler = &RegexpHandler{
+			urlMap:         make(map[string]ServiceMap),
+			defaultHandler: make(map[string]http.Handler)}
+	}
+
+	M_vhosts[group] = vh
+
+	return vh.Handler
+}
+
+//Normalize host name: lower case, port removed
+//@param host host value from request or config
+//@return normalized host
+func vhostNormalize(host string) string {
+
+	if h, _, err := net.SplitHostPort(host); nil == err {
+		host = h
+	}
+
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+//Load the host patterns of the groups and check that all groups which
+//have routes have host patterns and vice versa
+//@param ac ATMI Context
+//@return error or nil
+func vhostSetup(ac *atmi.ATMICtx) error {
+
+	cfg := make(map[string][]string)
+
+	if "" != M_vhosts_cfg {
+		if err := json.Unmarshal([]byte(M_vhosts_cfg), &cfg); nil != err {
+			return fmt.Errorf("Failed to parse `vhosts': %s", err.Error())
+		}
+	}
+
+	for name, hosts := range cfg {
+
+		vh, ok := M_vhosts[name]
+
+		if !ok {
+			return fmt.Errorf("Virtual host group [%s] has no routes", name)
+		}
+
+		if len(hosts) == 0 {
+			return fmt.Errorf("Virtual host group [%s] has no hosts", name)
+		}
+
+		for _, h := range hosts {
+
+			h = vhostNormalize(h)
+
+			if strings.HasPrefix(h, "*.") {
+				suffix := h[1:]
+
+				if _, dup := M_vhost_wildmap[suffix]; dup {
+					return fmt.Errorf("Host pattern [%s] used in several groups", h)
+				}
+
+				M_vhost_wildmap[suffix] = vh
+				M_vhost_wild = append(M_vhost_wild, suffix)
+
+			} else if "" != h && !strings.Contains(h, "*") {
+
+				if _, dup := M_vhost_exact[h]; dup {
+					return fmt.Errorf("Host [%s] used in several groups", h)
+				}
+
+				M_vhost_exact[h] = vh
+			} else {
+				return fmt.Errorf("Invalid host pattern [%s] in group [%s]",
+					h, name)
+			}
+
+			vh.Hosts = append(vh.Hosts, h)
+		}
+
+		ac.TpLogInfo("Virtual host group [%s]: hosts %v", name, vh.Hosts)
+	}
+
+	for name := range M_vhosts {
+		if _, ok := cfg[name]; !ok && VHOST_DEFAULT != name {
+			return fmt.Errorf("Routes use group [%s] which is not "+
+				"defined in `vhosts'", name)
+		}
+	}
+
+	//Most specific wildcard wins
+	sort.Slice(M_vhost_wild, func(i, j int) bool {
+		return len(M_vhost_wild[i]) > len(M_vhost_wild[j])
+	})
+
+	if M_vhost_unknown_code != 0 && (M_vhost_unknown_code < 100 ||
+		M_vhost_unknown_code > 999) {
+		return errors.New(fmt.Sprintf("Invalid `vhost_unknown_code' %d",
+			M_vhost_unknown_code))
+	}
+
+	return nil
+}
+
+//Resolve the route handler for request host
+//@param host Host header value
+//@return handler or nil if host is unknown
+func vhostResolve(host string) *RegexpHandler {
+
+	if "" == M_vhosts_cfg {
+		return &M_handler
+	}
+
+	host = vhostNormalize(host)
+
+	if vh, ok := M_vhost_exact[host]; ok {
+		return vh.Handler
+	}
+
+	for _, suffix := range M_vhost_wild {
+		if strings.HasSuffix(host, suffix) {
+			return M_vhost_wildmap[suffix].Handler
+		}
+	}
+
+	if M_vhost_unknown_code != 0 {
+		return nil
+	}
+
+	return &M_handler
+}
+
+//Respond to request with unknown host
+//@param w response writer
+func vhostUnknown(w http.ResponseWriter) {
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(M_vhost_unknown_code)
+	w.Write([]byte(M_vhost_unknown_body))
+}
+
+//Load request host and virtual host group name into UBF buffer
+//@param svc route
+//@param req request
+//@param bufu UBF buffer
+//@return UBF error or nil
+func vhostLoadUBF(svc *ServiceMap, req *http.Request,
+	bufu *atmi.TypedUBF) atmi.UBFError {
+
+	if "" != req.Host {
+		if errU := bufu.BChg(ubftab.EX_IF_HOST, 0, req.Host); nil != errU {
+			return errU
+		}
+	}
+
+	if "" != M_vhosts_cfg {
+		if errU := bufu.BChg(ubftab.EX_IF_VHOST, 0, svc.Vhost); nil != errU {
+			return errU
+		}
+	}
+
+	return nil
+}
+
+//Register the route in handler of the group
+//@param ac ATMI Context
+//@param group group name
+//@param svc route
+func vhostRegister(ac *atmi.ATMICtx, group string, svc ServiceMap) {
+
+	h := vhostHandler(group)
+
+	if svc.Format == "regexp" || svc.Format == "r" {
+		if r, err := regexp.Compile(svc.Url); err == nil {
+			ac.TpLogInfo("Regexp compiled")
+			h.HandleFunc(r, svc)
+		} else {
+			ac.TpLogError("Failed to compile regexp [%s]",
+				err.Error())
+		}
+	} else {
+		h.HandleFunc(nil, svc)
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
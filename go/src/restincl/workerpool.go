@@ -34,6 +34,7 @@ package main
 
 import (
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -103,7 +104,7 @@ func genRspHeaders(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, w http.ResponseWriter,
 			occ := 0
 			var e error
 			//Print the buffer to stdout
-			bufu.TpLogPrintUBF(atmi.LOG_DEBUG, "Incoming request:")
+			logUBF(ac, svc, bufu, "Incoming request:")
 			ac.TpLogInfo("Setting Response Cookies")
 			if bufu.BPres(ubftab.EX_IF_RSPCN, occ) {
 				CookieName, retName := bufu.BGetString(ubftab.EX_IF_RSPCN, occ)
@@ -232,7 +233,10 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 		ubftab.EX_IF_RSPCEXPIRES,
 		ubftab.EX_IF_RSPCMAXAGE,
 		ubftab.EX_IF_RSPCSECURE,
-		ubftab.EX_IF_RSPCHTTPONLY}
+		ubftab.EX_IF_RSPCHTTPONLY,
+		// Trace context of the request
+		ubftab.EX_IF_TRACEPARENT,
+		ubftab.EX_IF_TRACESTATE}
 
 	//Remove request logfile if was open and not needed in rsp.
 	if reqlogOpen && svc.Noreqfilersp {
@@ -248,6 +252,11 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 		err = atmiErr
 	}
 
+	//Collect cache related data of the response
+	if cw, ok := w.(*cacheWriter); ok {
+		cw.loadRspInfo(ac, buf, err)
+	}
+
 	//Generate response accordingly...
 	ac.TpLogDebug("Conv %d errors %d", svc.Conv_int, svc.Errors_int)
 
@@ -262,9 +271,6 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 			break
 		}
 
-		out_err := false
-		was_error := false
-
 		ac.TpLogInfo("err=%v", err)
 
 		//Load the error codes, if missing
@@ -286,33 +292,7 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 		}
 
 		//OK we are at ext, execute the error filters, if any
-		if !postSvc {
-			//This is incoming error, run the incoming error handler
-			runChain(ac, svc, buf, false, svc.Finerr_arr,
-				"filter-incoming-error-opt(finerr)")
-			was_error = true
-		} else if nil == err || 0 == err.Code() {
-			//Execute the outgoing chains...
-			if errA := runChain(ac, svc, buf, true, svc.Foutman_arr,
-				"filter-outgoing-mandatory(foutman)"); nil != errA {
-				out_err = true
-				was_error = true
-			}
-
-			if !was_error {
-				runChain(ac, svc, buf, false, svc.Foutopt_arr,
-					"filter-outgoing-optional(foutopt)")
-			}
-		} else {
-			out_err = true
-			was_error = true
-		}
-
-		//If we got outgoing error, call the service correspondingly..
-		if out_err {
-			runChain(ac, svc, buf, false, svc.Fouterr_arr,
-				"filter-outgoing-error-opt(fouterr)")
-		}
+		was_error, _ := runRspChains(ac, svc, buf, err, postSvc, rctx)
 
 		//Process files if
 		if svc.Fileupload {
@@ -329,6 +309,11 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 
 			netCode, _ = bufu.BGetInt(ubftab.EX_NETRCODE, 0)
 
+			//Request rejected by restincl with known status
+			if 0 == netCode && 0 != rctx.rspCode {
+				netCode = rctx.rspCode
+			}
+
 			if 0 == netCode {
 				ac.TpLogError("Invalid EX_NETRCODE or not set => return http 500")
 				w.WriteHeader(500)
@@ -370,7 +355,7 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 
 		break
 
-	case CONV_JSON2UBF:
+	case CONV_JSON2UBF, CONV_XML2UBF:
 		rspType = "application/json"
 		//Convert buffer back to JSON & send it back..
 		//But we could append the buffer with error here...
@@ -396,6 +381,11 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 			}
 		} else {
 
+			//Execute the response filters, if any
+			if _, errA := runRspChains(ac, svc, buf, err, postSvc, rctx); nil != errA {
+				err = errA
+			}
+
 			if svc.Errors_int == ERRORS_JSON2UBF {
 				ac.TpLogInfo("Setting JSON2UBF buffer error codes to: %d/%s",
 					err.Code(), err.Message())
@@ -418,7 +408,12 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 			// Delete Header and Cookie data from buffer (req&rsp)
 			bufu.BDelete(delFldList)
 
-			ret, err1 := bufu.TpUBFToJSON()
+			var ret string
+			var err1 atmi.UBFError
+
+			if !rctx.rspUBF {
+				ret, err1 = bufu.TpUBFToJSON()
+			}
 
 			if nil == err1 {
 				//Generate the resposne buffer...
@@ -437,6 +432,42 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 			}
 		}
 
+		//Binary UBF response, errors are always in EX_IF_ECODE/EX_IF_EMSG
+		if rctx.rspUBF {
+			rspType = MIME_UBF
+
+			if !ok || (svc.Asynccall && !svc.Asyncecho) {
+				bufu = nil
+			}
+
+			rsp = ubfWriteRsp(ac, bufu, err)
+		}
+
+		if svc.Formats_ubf {
+			w.Header().Set("Vary", "Accept")
+		}
+
+		//XML is generated from JSON of the buffer
+		if CONV_XML2UBF == svc.Conv_int {
+			rspType = "application/xml"
+
+			if len(rsp) > 0 {
+				ret, errX := jsonToXML(svc.Xml_root, string(rsp))
+
+				if nil != errX {
+					ac.TpLogError("Failed to convert JSON to XML: %s", errX.Error())
+
+					if err.Code() == atmi.TPMINVAL {
+						err = atmi.NewCustomATMIError(atmi.TPESYSTEM,
+							fmt.Sprintf("Failed to convert JSON to XML: %s", errX.Error()))
+					}
+					rsp = nil
+				} else {
+					rsp = []byte(ret)
+				}
+			}
+		}
+
 		break
 	case CONV_JSON2VIEW:
 		rspType = "application/json"
@@ -453,7 +484,7 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 				ac.TpLogInfo("Generating configured rsp...")
 				rsp = VIEWGenDefaultResponse(ac, svc, atmiErr)
 
-				ac.TpLogInfo("Got response: [%v]", rsp)
+				ac.TpLogInfo("Got response: [%s]", svc.Mask.maskData(rsp))
 			}
 		} else if !ok || nil == buf { //Nil case goes here too
 			ac.TpLogError("Failed to cast TypedBuffer to TypedVIEW!")
@@ -633,12 +664,25 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 			}
 		}
 		break
+	case CONV_PROXY:
+		if ERRORS_JSON == svc.Errors_int {
+			rspType = "application/json"
+		}
+		break
 	}
 
 	//OK Now if all ok, there is stuff in buffer (from JSONUBF) it will
 	//be there in any case, thus we do not handle that
 	w.Header().Set("Content-Type", rspType)
-	switch svc.Errors_int {
+
+	errorsMode := svc.Errors_int
+
+	//UBF response carries the error in the buffer, only http code may be mapped
+	if rctx.rspUBF && ERRORS_HTTP != errorsMode {
+		errorsMode = ERRORS_JSON2UBF
+	}
+
+	switch errorsMode {
 	case ERRORS_HTTP:
 		var lookup map[string]int
 		//Map the resposne codes
@@ -700,16 +744,41 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 
 			ac.TpLogWarn("Error code generated: [%s]", errs)
 			strrsp = substring + errs
-			ac.TpLogDebug("JSON Response generated: [%s]", strrsp)
+			ac.TpLogDebug("JSON Response generated: [%s]",
+				svc.Mask.maskData([]byte(strrsp)))
 		} else {
 			//rsp_type = "text/json"
 			//Send plaint json
 			strrsp = fmt.Sprintf("{%s,%s}",
 				fmt.Sprintf(svc.Errfmt_json_code, err.Code()),
 				fmt.Sprintf(svc.Errfmt_json_msg, err.Message()))
-			ac.TpLogDebug("JSON Response generated (2): [%s]", strrsp)
+			ac.TpLogDebug("JSON Response generated (2): [%s]",
+				svc.Mask.maskData([]byte(strrsp)))
 		}
 
+		rsp = []byte(strrsp)
+		break
+	case ERRORS_XML:
+		//Add error elements to the root element of response
+
+		if atmi.TPMINVAL == err.Code() && !svc.Errfmt_xml_onsucc && !svc.Asyncecho {
+			break //Do no generate on success.
+		}
+
+		strrsp := string(rsp)
+		errs := fmt.Sprintf(svc.Errfmt_xml_code, err.Code()) +
+			fmt.Sprintf(svc.Errfmt_xml_msg, xmlEscape(err.Message()))
+
+		if i := strings.LastIndex(strrsp, "</"); i > -1 {
+			strrsp = strrsp[0:i] + errs + strrsp[i:]
+		} else {
+			strrsp = fmt.Sprintf("%s<%s>%s</%s>", xml.Header, svc.Xml_root,
+				errs, svc.Xml_root)
+		}
+
+		ac.TpLogDebug("XML Response generated: [%s]",
+			svc.Mask.maskData([]byte(strrsp)))
+
 		rsp = []byte(strrsp)
 		break
 	case ERRORS_TEXT:
@@ -718,7 +787,8 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 		//Send plaint json
 		if (svc.Asynccall && !svc.Asyncecho) || atmi.TPMINVAL != err.Code() {
 			strrsp := fmt.Sprintf(svc.Errfmt_text, err.Code(), err.Message())
-			ac.TpLogDebug("TEXT Response generated (2): [%s]", strrsp)
+			ac.TpLogDebug("TEXT Response generated (2): [%s]",
+				svc.Mask.maskData([]byte(strrsp)))
 			rsp = []byte(strrsp)
 		}
 
@@ -727,9 +797,21 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 
 	//Send response back
 	ac.TpLogDebug("Returning context type: %s, len: %d", rspType, len(rsp))
-	ac.TpLogDump(atmi.LOG_DEBUG, "Sending response back", rsp, len(rsp))
+	logData(ac, svc, "Sending response back", rsp)
 	w.Header().Set("Content-Length", strconv.Itoa(len(rsp)))
 
+	if aw := accessWriterOf(w); nil != aw {
+		aw.svc = svc.Svc //Filters may have rerouted the request
+		aw.tpErr = err.Code()
+		aw.errSrc = rctx.errSrc
+	}
+
+	//In http errors and ext modes, code is already sent
+	if 0 != rctx.rspCode && ERRORS_HTTP != svc.Errors_int &&
+		ERRORS_EXT != svc.Errors_int {
+		w.WriteHeader(rctx.rspCode)
+	}
+
 	w.Write(rsp)
 }
 
@@ -740,7 +822,8 @@ func parseHeaders(ac *atmi.ATMICtx, svc *ServiceMap, req *http.Request,
 	// Add header data to UBF fields
 	if svc.Parseheaders {
 		for k, v := range req.Header {
-			ac.TpLogDebug("Header field %s, Value %+v", k, v)
+			ac.TpLogDebug("Header field %s, Value %s", k,
+				svc.Mask.maskHeader(k, fmt.Sprintf("%+v", v)))
 			hv := fmt.Sprintf("%s", v)
 			if errU := bufu.BAdd(ubftab.EX_IF_REQHN, k); nil != errU {
 				return errU
@@ -756,7 +839,8 @@ func parseHeaders(ac *atmi.ATMICtx, svc *ServiceMap, req *http.Request,
 			for _, cookie := range req.Cookies() {
 				// Incoming request have Name and Value
 				ac.TpLogDebug("cookie.Name=[%s]", cookie.Name)
-				ac.TpLogDebug("cookie.Value=[%s]", cookie.Value)
+				ac.TpLogDebug("cookie.Value=[%s]",
+					svc.Mask.maskHeader("Cookie", cookie.Value))
 				if errU := bufu.BAdd(ubftab.EX_IF_REQCN, cookie.Name); nil != errU {
 					return errU
 				}
@@ -801,36 +885,186 @@ func parseQuery(ac *atmi.ATMICtx, svc *ServiceMap, req *http.Request,
 //ac is Atmi Context, svc is currently mapped service definition, buf is associated
 //converted buffer, svclist is comma seperated service name list.
 //Listdbg is debug string for the invocation
+//Filter may return decision in EX_IF_FLTACTION (skip remaining filters or reply
+//with current buffer) and EX_IF_FLTSVC (reroute to other target service).
+//Decisions are stored in rctx, fields are removed from buffer.
 func runChain(ac *atmi.ATMICtx, svc *ServiceMap, buf atmi.TypedBuffer, mand bool,
-	svclist []string, listdbg string) atmi.ATMIError {
+	svclist []string, listdbg string, rctx *RequestContext) atmi.ATMIError {
 
 	if len(svclist) == 0 {
 		return nil
 	}
 
-	for _, svc := range svclist {
+	if rctx.fltSkip {
+		ac.TpLogInfo("%s: skipped by previous filter decision", listdbg)
+		return nil
+	}
 
-		ac.TpLogInfo("%s: About to invoke: [%s]", listdbg, svc)
+	bufu, isUBF := buf.(*atmi.TypedUBF)
+
+	for _, fsvc := range svclist {
+
+		ac.TpLogInfo("%s: About to invoke: [%s]", listdbg, fsvc)
+
+		//Decisions are accepted only when set by this filter
+		if isUBF {
+			bufu.BDelete([]int{ubftab.EX_IF_FLTSVC, ubftab.EX_IF_FLTACTION})
+		}
 
-		_, err := ac.TpCall(svc, buf, 0)
+		_, err := ac.TpCall(fsvc, buf, 0)
 
 		if nil != err {
 
 			if !mand {
 				ac.TpLogWarn("%s: Failed to call [%s] service: %s - optional, continue",
-					listdbg, svc, err.Message())
+					listdbg, fsvc, err.Message())
 			} else {
 				ac.TpLogError("%s: Failed to call [%s] service: %s - fail",
-					listdbg, svc, err.Message())
+					listdbg, fsvc, err.Message())
 				return err
 			}
 		}
 
+		if !isUBF || nil != err {
+			continue
+		}
+
+		//Check the routing decisions of the filter
+		if bufu.BPres(ubftab.EX_IF_FLTSVC, 0) {
+			target, _ := bufu.BGetString(ubftab.EX_IF_FLTSVC, 0)
+			bufu.BDel(ubftab.EX_IF_FLTSVC, 0)
+
+			if "" != target {
+				ac.TpLogInfo("%s: [%s] reroutes target service [%s] -> [%s]",
+					listdbg, fsvc, svc.Svc, target)
+				svc.Svc = target
+			}
+		}
+
+		if bufu.BPres(ubftab.EX_IF_FLTACTION, 0) {
+			action, _ := bufu.BGetString(ubftab.EX_IF_FLTACTION, 0)
+			bufu.BDel(ubftab.EX_IF_FLTACTION, 0)
+
+			switch action {
+			case FLTACTION_SKIP:
+				ac.TpLogInfo("%s: [%s] requests to skip remaining filters",
+					listdbg, fsvc)
+				rctx.fltSkip = true
+				return nil
+			case FLTACTION_REPLY:
+				ac.TpLogInfo("%s: [%s] requests to reply with current buffer",
+					listdbg, fsvc)
+				rctx.fltSkip = true
+				rctx.fltReply = true
+				return nil
+			default:
+				ac.TpLogWarn("%s: [%s] returned unknown filter action [%s] - ignore",
+					listdbg, fsvc, action)
+			}
+		}
+
 	}
 
 	return nil
 }
 
+//Control fields of restincl, these are set by restincl, filters or services
+//only and are removed from the incoming request
+var M_ctlFields = []int{
+	ubftab.EX_IF_FLTSVC,
+	ubftab.EX_IF_FLTACTION,
+	ubftab.EX_IF_CACHETTL,
+	ubftab.EX_IF_ECODE,
+	ubftab.EX_IF_EMSG,
+	ubftab.EX_IF_ERRSRC,
+	ubftab.EX_IF_TPURCODE,
+	ubftab.EX_NREQLOGFILE,
+	// Upload related, loaded by restincl after the filters
+	ubftab.EX_IF_REQFILEDISK,
+	ubftab.EX_IF_REQFILENAME,
+	ubftab.EX_IF_REQFILEMIME,
+	ubftab.EX_IF_REQFILEFORM,
+	ubftab.EX_IF_REQFILESHA256,
+	ubftab.EX_IF_RSPFILEACTION,
+	ubftab.EX_IF_UPLDID,
+	ubftab.EX_IF_UPLDOFFSET,
+	ubftab.EX_IF_UPLDFINAL,
+	ubftab.EX_IF_UPLDSIZE,
+	ubftab.EX_IF_UPLDABORT}
+
+//Remove control fields sent by the client, so that filter decisions, cache
+//ttl, request log file, etc. cannot be injected by the request
+//@param ac ATMI Context
+//@param bufu incoming request buffer
+//@return UBF error or nil
+func clearCtlFields(ac *atmi.ATMICtx, bufu *atmi.TypedUBF) atmi.UBFError {
+
+	var present []int
+
+	for _, fld := range M_ctlFields {
+		if bufu.BPres(fld, 0) {
+			ac.TpLogWarn("Removing control field [%d] from the request", fld)
+			present = append(present, fld)
+		}
+	}
+
+	if len(present) > 0 {
+		return bufu.BDelete(present)
+	}
+
+	return nil
+}
+
+//Run the response filter chains (error or outgoing) on the response buffer
+//@param ac ATMI Context
+//@param svc Service map
+//@param buf Response buffer (UBF)
+//@param err Current error (TPMINVAL if no error)
+//@param postSvc Target service was called (or reply requested by filter)
+//@param rctx Request context
+//@return true if error chains were executed, mandatory out filter error if any
+func runRspChains(ac *atmi.ATMICtx, svc *ServiceMap, buf atmi.TypedBuffer,
+	err atmi.ATMIError, postSvc bool, rctx *RequestContext) (bool, atmi.ATMIError) {
+
+	var errA atmi.ATMIError
+	out_err := false
+	was_error := false
+
+	//Decisions of incoming filters does not affect response chains
+	rctx.fltSkip = false
+
+	if !postSvc {
+		//This is incoming error, run the incoming error handler
+		runChain(ac, svc, buf, false, svc.Finerr_arr,
+			"filter-incoming-error-opt(finerr)", rctx)
+		was_error = true
+	} else if nil == err || 0 == err.Code() {
+		//Execute the outgoing chains...
+		if errA = runChain(ac, svc, buf, true, svc.Foutman_arr,
+			"filter-outgoing-mandatory(foutman)", rctx); nil != errA {
+			out_err = true
+			was_error = true
+		}
+
+		if !was_error {
+			runChain(ac, svc, buf, false, svc.Foutopt_arr,
+				"filter-outgoing-optional(foutopt)", rctx)
+		}
+	} else {
+		out_err = true
+		was_error = true
+	}
+
+	//If we got outgoing error, call the service correspondingly..
+	if out_err {
+		rctx.fltSkip = false
+		runChain(ac, svc, buf, false, svc.Fouterr_arr,
+			"filter-outgoing-error-opt(fouterr)", rctx)
+	}
+
+	return was_error, errA
+}
+
 //Request handler
 //@param ac	ATMI Context
 //@param w	Response writer (as usual)
@@ -846,7 +1080,10 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 	reqlogOpen := false
 	rctx.errSrc = ERRSRC_RESTIN //Default error source rest-in process
 
-	ac.TpLog(atmi.LOG_DEBUG, "Got URL [%s], caller: %s", req.URL, req.RemoteAddr)
+	ac.TpLog(atmi.LOG_DEBUG, "Got URL [%s], caller: %s proto: %s",
+		svc.Mask.maskURL(req.URL), req.RemoteAddr, req.Proto)
+
+	traceStart(ac, svc, w, req, &rctx)
 
 	if "" != svc.Svc || svc.Echo {
 
@@ -855,7 +1092,7 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 
 			body, _ = ioutil.ReadAll(req.Body)
 			ac.TpLogDebug("Requesting service [%s] buffer [%s]",
-				svc.Svc, string(body))
+				svc.Svc, svc.Mask.maskData(body))
 		}
 
 		//Prepare outgoing buffer...
@@ -926,6 +1163,18 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 				return atmi.FAIL
 			}
 
+			//Load the request host & virtual host group
+			if errU := vhostLoadUBF(svc, req, bufu); nil != errU {
+
+				errA := atmi.NewCustomATMIError(atmi.TPESYSTEM,
+					fmt.Sprintf("Failed to set host fields %d:[%s]",
+						errU.Code(), errU.Message()))
+
+				ac.TpLogError("Failed to set request host")
+				genRsp(ac, nil, svc, w, errA, false, false, false, &rctx)
+				return atmi.FAIL
+			}
+
 			//Load request paramters
 			if errU := parseQuery(ac, svc, req, bufu); nil != errU {
 				ac.TpLogError("Failed to parse/load URL Query params")
@@ -954,7 +1203,8 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 
 						ac.TpLogDebug("form field name=[%s]", k)
 						str := strings.Join(v, ";")
-						ac.TpLogDebug("form field value=[%s]", str)
+						ac.TpLogDebug("form field value=[%s]",
+							svc.Mask.maskParam(k, str))
 
 						if errU := bufu.BAdd(ubftab.EX_IF_REQFORMN, k); nil != errU {
 
@@ -987,8 +1237,13 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 
 			buf = bufu
 			break
-		case CONV_JSON2UBF:
+		case CONV_JSON2UBF, CONV_XML2UBF:
 			//Convert JSON 2 UBF...
+			if errA := resolveFormats(ac, svc, req, &rctx); nil != errA {
+				genRsp(ac, nil, svc, w, errA, false, false, false, &rctx)
+				return atmi.FAIL
+			}
+
 			//Bug #200, use max buffer size
 			bufu, err1 := ac.NewUBF(atmi.ATMIMsgSizeMax())
 
@@ -1000,7 +1255,24 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 				return atmi.FAIL
 			}
 
-			ac.TpLogDebug("Converting to UBF: [%s]", body)
+			//Binary UBF is loaded first, as it replaces buffer content
+			if rctx.reqUBF {
+				if errU := bufu.BRead(body); nil != errU {
+					ac.TpLogError("Failed to read binary UBF %d:[%s]",
+						errU.Code(), errU.Message())
+
+					errA := atmi.NewCustomATMIError(atmi.TPEINVAL,
+						fmt.Sprintf("Failed to read UBF %d:[%s]",
+							errU.Code(), errU.Message()))
+
+					genRsp(ac, nil, svc, w, errA, false, false, false, &rctx)
+					return atmi.FAIL
+				}
+			}
+
+			if logDebugOn(ac) {
+				ac.TpLogDebug("Converting to UBF: [%s]", svc.Mask.maskData(body))
+			}
 
 			if errU := parseHeaders(ac, svc, req, bufu); nil != errU {
 				ac.TpLogError("Failed to parse/load headers")
@@ -1013,15 +1285,48 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 				return atmi.FAIL
 			}
 
-			if err1 := bufu.TpJSONToUBF(string(body)); err1 != nil {
+			jsonBody := string(body)
+			noDoc := paramsOnly(svc, req, body)
+
+			//XML is loaded via one level JSON
+			if rctx.reqUBF {
+				ac.TpLogDebug("Binary UBF request loaded")
+			} else if noDoc {
+				ac.TpLogDebug("No document in body - loading parameters only")
+			} else if CONV_XML2UBF == svc.Conv_int {
+				var errX error
+
+				if jsonBody, errX = xmlToJSON(body); nil != errX {
+					ac.TpLogError("Failed to convert XML to JSON: %s", errX.Error())
+					ac.TpLogError("Failed req: [%s]", svc.Mask.maskData(body))
+
+					errA := atmi.NewCustomATMIError(atmi.TPEINVAL,
+						fmt.Sprintf("Failed to parse XML: %s", errX.Error()))
+
+					genRsp(ac, nil, svc, w, errA, false, false, false, &rctx)
+					return atmi.FAIL
+				}
+			}
+
+			if noDoc || rctx.reqUBF {
+				//Buffer is loaded already or from parameters bellow
+			} else if err1 := bufu.TpJSONToUBF(jsonBody); err1 != nil {
 				ac.TpLogError("Failed to conver from JSON to UBF %d:[%s]\n",
 					err1.Code(), err1.Message())
 
-				ac.TpLogError("Failed req: [%s]", string(body))
+				ac.TpLogError("Failed req: [%s]", svc.Mask.maskData(body))
 
 				genRsp(ac, nil, svc, w, err1, false, false, false, &rctx)
 				return atmi.FAIL
 			}
+
+			//Map query string / form to fields
+			if svc.Parseparams {
+				if errA := paramsToUBF(ac, svc, req, body, bufu); nil != errA {
+					genRsp(ac, nil, svc, w, errA, false, false, false, &rctx)
+					return atmi.FAIL
+				}
+			}
 			if svc.Format == "r" || svc.Format == "regexp" {
 				if id, err := ac.BFldId(svc.UrlField); err == nil && id != 0 {
 					ac.TpLogInfo("Setting field: [%d] with value [%s]", id, req.URL.Path)
@@ -1037,15 +1342,32 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 		case CONV_JSON2VIEW:
 			//Conver JSON to View
 
-			ac.TpLogDebug("Converting to VIEW: [%s]", body)
+			var bufv *atmi.TypedVIEW
+			var err1 atmi.ATMIError
+
+			if paramsOnly(svc, req, body) {
+				ac.TpLogDebug("No document in body - loading parameters "+
+					"to VIEW [%s]", svc.Paramsview)
 
-			bufv, err1 := ac.TpJSONToVIEW(string(body))
+				bufv, err1 = ac.NewVIEW(svc.Paramsview, 0)
+			} else {
+				if logDebugOn(ac) {
+					ac.TpLogDebug("Converting to VIEW: [%s]", svc.Mask.maskData(body))
+				}
+
+				bufv, err1 = ac.TpJSONToVIEW(string(body))
+			}
+
+			if err1 == nil && svc.Parseparams {
+				//Map query string / form to members
+				err1 = paramsToVIEW(ac, svc, req, body, bufv)
+			}
 
 			if err1 != nil {
 				ac.TpLogError("Failed to convert JSON to VIEW: %d:[%s]\n",
 					err1.Code(), err1.Message())
 
-				ac.TpLogError("Failed req: [%s]", string(body))
+				ac.TpLogError("Failed req: [%s]", svc.Mask.maskData(body))
 
 				genRsp(ac, nil, svc, w, err1, false, false, false, &rctx)
 				return atmi.FAIL
@@ -1127,6 +1449,23 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 			break
 		}
 
+		//Drop client supplied control fields, pass the trace context to services
+		if bufu, ok := buf.(*atmi.TypedUBF); ok && nil == err {
+			if errU := clearCtlFields(ac, bufu); nil != errU {
+				err = atmi.NewCustomATMIError(atmi.TPESYSTEM,
+					fmt.Sprintf("Failed to clear control fields %d:[%s]",
+						errU.Code(), errU.Message()))
+			} else if errU := traceLoadUBF(ac, bufu, &rctx); nil != errU {
+				err = atmi.NewCustomATMIError(atmi.TPESYSTEM,
+					fmt.Sprintf("Failed to set trace context %d:[%s]",
+						errU.Code(), errU.Message()))
+			}
+		}
+
+		if bufv, ok := buf.(*atmi.TypedVIEW); ok && nil == err {
+			err = traceLoadVIEW(ac, bufv, &rctx)
+		}
+
 		if err != nil {
 			ac.TpLogError("ATMI Error %d:[%s]\n", err.Code(), err.Message())
 
@@ -1152,19 +1491,24 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 			}
 		}
 
+		//Otherwise request log may be keyed by trace id
+		if !reqlogOpen {
+			reqlogOpen = traceLogOpen(ac, svc, buf, &rctx)
+		}
+
 		//Perform incoming filters...
 		//If input filters fails, then generate response immediately...
 		err = nil
 
 		if len(svc.Finman_arr) > 0 {
 			err = runChain(ac, svc, buf, true, svc.Finman_arr,
-				"filter-incoming-mandatory(finman)")
+				"filter-incoming-mandatory(finman)", &rctx)
 
 			//Run optional chain, if any..
 			if nil == err {
 
 				runChain(ac, svc, buf, false, svc.Finopt_arr,
-					"filter-incoming-optional(finopt)")
+					"filter-incoming-optional(finopt)", &rctx)
 			} else {
 				//Error source is mandatory filter
 				rctx.errSrc = ERRSRC_FINMAN
@@ -1178,16 +1522,20 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
 		if do_upload {
 			bufu, _ := ac.CastToUBF(buf.GetBuf())
 
-			if errA := handleFileUploadReq(ac, bufu, svc, req, &rctx); nil != errA {
+			if errA := handleFileUploadReq(ac, bufu, svc, req, &rctx, flags); nil != errA {
+				uploadAbort(ac, svc, &rctx, flags)
 				genRsp(ac, buf, svc, w, errA, false, false, false, &rctx)
 				return atmi.FAIL
 			}
 		}
 
 		if nil != err {
+			uploadAbort(ac, svc, &rctx, flags)
 			genRsp(ac, buf, svc, w, err, reqlogOpen, false, false, &rctx)
-		} else if svc.Echo {
+		} else if svc.Echo || rctx.fltReply {
 			//Do not send service, just echo buffer back
+			//(or filter have prepared the response)
+			uploadAbort(ac, svc, &rctx, flags)
 			genRsp(ac, buf, svc, w, err, reqlogOpen, true, false, &rctx)
 		} else if svc.Asynccall {
 			_, err := ac.TpACall(svc.Svc, buf, flags|atmi.TPNOREPLY)
@@ -0,0 +1,229 @@
+/**
+ * @brief XML to UBF conversion (via one level JSON)
+ *
+ * @file xmlconv.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+//Convert XML document to one level JSON object, suitable for TpJSONToUBF().
+//Child elements of the root are field names, repeated elements are loaded
+//as arrays (field occurrences). Nested elements are not supported.
+//@param data XML document
+//@return JSON string, error
+func xmlToJSON(data []byte) (string, error) {
+
+	var names []string
+	var text bytes.Buffer
+	vals := make(map[string][]string)
+	depth := 0
+	haveRoot := false
+	cur := ""
+
+	dec := xml.NewDecoder(bytes.NewReader(data))
+
+	for {
+		tok, err := dec.Token()
+
+		if err == io.EOF {
+			break
+		} else if nil != err {
+			return "", err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+
+			if 1 == depth {
+				if haveRoot {
+					return "", errors.New("multiple root elements")
+				}
+				haveRoot = true
+			} else if 2 == depth {
+				cur = t.Name.Local
+				text.Reset()
+			} else {
+				return "", fmt.Errorf("nested element [%s] in [%s] not supported",
+					t.Name.Local, cur)
+			}
+			break
+		case xml.CharData:
+			if 2 == depth {
+				text.Write(t)
+			}
+			break
+		case xml.EndElement:
+			if 2 == depth {
+				if _, ok := vals[cur]; !ok {
+					names = append(names, cur)
+				}
+				vals[cur] = append(vals[cur], text.String())
+			}
+			depth--
+			break
+		}
+	}
+
+	if !haveRoot {
+		return "", errors.New("no root element")
+	}
+
+	var js bytes.Buffer
+
+	js.WriteString("{")
+
+	for i, name := range names {
+
+		var val []byte
+
+		if i > 0 {
+			js.WriteString(",")
+		}
+
+		key, _ := json.Marshal(name)
+
+		if 1 == len(vals[name]) {
+			val, _ = json.Marshal(vals[name][0])
+		} else {
+			val, _ = json.Marshal(vals[name])
+		}
+
+		js.Write(key)
+		js.WriteString(":")
+		js.Write(val)
+	}
+
+	js.WriteString("}")
+
+	return js.String(), nil
+}
+
+//Get the JSON scalar value as string
+func jsonScalar(tok json.Token) string {
+
+	switch v := tok.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+
+	return ""
+}
+
+//Escape the XML text
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+//Convert one level JSON object (as produced by TpUBFToJSON()) to XML document
+//Arrays are written as repeated elements.
+//@param root root element name
+//@param js JSON document
+//@return XML string, error
+func jsonToXML(root string, js string) (string, error) {
+
+	var out bytes.Buffer
+
+	dec := json.NewDecoder(strings.NewReader(js))
+	dec.UseNumber()
+
+	if tok, err := dec.Token(); nil != err {
+		return "", err
+	} else if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return "", errors.New("JSON object expected")
+	}
+
+	out.WriteString(xml.Header)
+	out.WriteString("<" + root + ">")
+
+	for dec.More() {
+
+		tok, err := dec.Token()
+
+		if nil != err {
+			return "", err
+		}
+
+		name := jsonScalar(tok)
+
+		if tok, err = dec.Token(); nil != err {
+			return "", err
+		}
+
+		if d, ok := tok.(json.Delim); ok && d == '[' {
+
+			for dec.More() {
+				if tok, err = dec.Token(); nil != err {
+					return "", err
+				}
+
+				if _, isDelim := tok.(json.Delim); isDelim {
+					return "", fmt.Errorf("nested object or array in [%s] "+
+						"not supported", name)
+				}
+
+				out.WriteString("<" + name + ">" + xmlEscape(jsonScalar(tok)) +
+					"</" + name + ">")
+			}
+
+			//Closing bracket
+			if _, err = dec.Token(); nil != err {
+				return "", err
+			}
+		} else if ok {
+			return "", fmt.Errorf("nested object [%s] not supported", name)
+		} else {
+			out.WriteString("<" + name + ">" + xmlEscape(jsonScalar(tok)) +
+				"</" + name + ">")
+		}
+	}
+
+	out.WriteString("</" + root + ">")
+
+	return out.String(), nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
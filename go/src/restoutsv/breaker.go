@@ -0,0 +1,318 @@
+/**
+ * @brief Circuit breaker of outgoing services, driven by live calls
+ *
+ * @file breaker.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Circuit breaker states
+const (
+	BREAKER_CLOSED = 0 //Calls pass through
+	BREAKER_OPEN   = 1 //Calls fail fast
+	BREAKER_HALF   = 2 //Probe calls are let through
+)
+
+//Circuit breaker modes
+const (
+	BREAKER_FAILFAST    = "failfast"    //Calls fail with TPENOENT while open
+	BREAKER_UNADVERTISE = "unadvertise" //Service is unadvertised while open
+)
+
+//Circuit breaker state of the service, fed by live call outcomes
+type Breaker struct {
+	mutex    sync.Mutex
+	state    int
+	fails    int       //Consecutive failures
+	window   []bool    //Last outcomes, true if failed
+	pos      int       //Next position in window
+	count    int       //Number of outcomes in window
+	nfail    int       //Number of failures in window
+	openedAt time.Time //When breaker was opened
+	probing  bool      //Half-open probe call is in progress
+	probeOK  int       //Succeeded half-open probes
+}
+
+//Validate and prepare circuit breaker of the service
+//@param svc Service map
+//@return error in case of invalid config or nil
+func breakerSetup(svc *ServiceMap) error {
+
+	if !svc.Breaker {
+		return nil
+	}
+
+	if BREAKER_FAILFAST != svc.BreakerMode && BREAKER_UNADVERTISE != svc.BreakerMode {
+		return fmt.Errorf("Service [%s]: invalid breaker_mode [%s], must be "+
+			"'%s' or '%s'", svc.Svc, svc.BreakerMode, BREAKER_FAILFAST,
+			BREAKER_UNADVERTISE)
+	}
+
+	if svc.BreakerFails < 0 || svc.BreakerErrRate < 0 || svc.BreakerErrRate > 100 ||
+		(0 == svc.BreakerFails && 0 == svc.BreakerErrRate) {
+		return fmt.Errorf("Service [%s]: invalid breaker_fails %d or "+
+			"breaker_err_rate %d (0..100), at least one must be set",
+			svc.Svc, svc.BreakerFails, svc.BreakerErrRate)
+	}
+
+	if svc.BreakerWindow < 1 || svc.BreakerOpenTime < 1 || svc.BreakerProbes < 1 {
+		return fmt.Errorf("Service [%s]: invalid breaker_window %d, "+
+			"breaker_open_time %d or breaker_probes %d, must be >=1",
+			svc.Svc, svc.BreakerWindow, svc.BreakerOpenTime, svc.BreakerProbes)
+	}
+
+	svc.breakerStatus = make(map[int]bool)
+
+	for code := range retryParseSet(svc.BreakerStatus, false) {
+
+		status, err := strconv.Atoi(code)
+
+		if nil != err || status < 100 || status > 599 {
+			return fmt.Errorf("Service [%s]: invalid HTTP status [%s] "+
+				"in breaker_status", svc.Svc, code)
+		}
+
+		svc.breakerStatus[status] = true
+	}
+
+	svc.breaker = &Breaker{window: make([]bool, svc.BreakerWindow)}
+
+	return nil
+}
+
+//Open the breaker. Must be called with mutex locked.
+func (b *Breaker) open() {
+	b.state = BREAKER_OPEN
+	b.openedAt = time.Now()
+	b.probing = false
+	b.probeOK = 0
+}
+
+//Close the breaker and reset the statistics. Must be called with mutex locked.
+func (b *Breaker) reset() {
+	b.state = BREAKER_CLOSED
+	b.fails = 0
+	b.pos = 0
+	b.count = 0
+	b.nfail = 0
+	b.probeOK = 0
+
+	for i := range b.window {
+		b.window[i] = false
+	}
+}
+
+//Check is call allowed to be sent to remote service. If open time is
+//elapsed, breaker goes to half-open state and single probe call is allowed
+//at the time.
+//@param ac ATMI Context
+//@return true if call may be sent, false if must fail fast
+func (s *ServiceMap) breakerAllow(ac *atmi.ATMICtx) bool {
+
+	b := s.breaker
+
+	if nil == b {
+		return true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case BREAKER_OPEN:
+
+		if time.Since(b.openedAt) < time.Second*time.Duration(s.BreakerOpenTime) {
+			return false
+		}
+
+		ac.TpLogWarn("Service [%s] breaker half-open", s.Svc)
+		b.state = BREAKER_HALF
+		b.probeOK = 0
+
+		fallthrough
+	case BREAKER_HALF:
+
+		if b.probing {
+			return false
+		}
+
+		ac.TpLogInfo("Service [%s] breaker probe call", s.Svc)
+		b.probing = true
+	}
+
+	return true
+}
+
+//Release the call allowed by breakerAllow() with out recording the outcome,
+//as the call to service endpoint was not completed for other reasons (e.g.
+//OAuth2 token endpoint failure). Probe slot is freed in half-open state.
+//@param ac ATMI Context
+func (s *ServiceMap) breakerCancel(ac *atmi.ATMICtx) {
+
+	b := s.breaker
+
+	if nil == b {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if BREAKER_HALF == b.state && b.probing {
+		ac.TpLogInfo("Service [%s] breaker probe not completed", s.Svc)
+		b.probing = false
+	}
+}
+
+//Record outcome of the call allowed by breakerAllow()
+//@param ac ATMI Context
+//@param ok true if call succeeded
+func (s *ServiceMap) breakerRecord(ac *atmi.ATMICtx, ok bool) {
+
+	b := s.breaker
+
+	if nil == b {
+		return
+	}
+
+	opened := false
+
+	b.mutex.Lock()
+
+	switch b.state {
+	case BREAKER_HALF:
+
+		b.probing = false
+
+		if !ok {
+			ac.TpLogError("Service [%s] breaker probe failed - open", s.Svc)
+			b.open()
+			opened = true
+		} else {
+
+			b.probeOK++
+
+			if b.probeOK >= s.BreakerProbes {
+				ac.TpLogWarn("Service [%s] breaker closed", s.Svc)
+				b.reset()
+			}
+		}
+
+	case BREAKER_CLOSED:
+
+		if b.count == len(b.window) {
+			if b.window[b.pos] {
+				b.nfail--
+			}
+		} else {
+			b.count++
+		}
+
+		b.window[b.pos] = !ok
+		b.pos = (b.pos + 1) % len(b.window)
+
+		if ok {
+			b.fails = 0
+		} else {
+			b.fails++
+			b.nfail++
+		}
+
+		if (s.BreakerFails > 0 && b.fails >= s.BreakerFails) ||
+			(s.BreakerErrRate > 0 && b.count == len(b.window) &&
+				b.nfail*100 >= s.BreakerErrRate*b.count) {
+
+			ac.TpLogError("Service [%s] breaker open: consecutive fails %d, "+
+				"failed %d of last %d calls", s.Svc, b.fails, b.nfail, b.count)
+			b.open()
+			opened = true
+		}
+	}
+
+	b.mutex.Unlock()
+
+	if opened && BREAKER_UNADVERTISE == s.BreakerMode {
+
+		MadvertiseLock.Lock()
+
+		if s.echoIsAdvertised || s.echoSchedAdv {
+			ac.TpLogWarn("Scheduling [%s] by breaker to unadvertise!", s.Svc)
+			s.echoSchedAdv = false
+			s.echoSchedUnAdv = true
+		}
+
+		MadvertiseLock.Unlock()
+	}
+}
+
+//Is advertise of the service held by open breaker
+//@return true if service must stay unadvertised
+func (s *ServiceMap) breakerHeld() bool {
+
+	b := s.breaker
+
+	if nil == b || BREAKER_UNADVERTISE != s.BreakerMode {
+		return false
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return BREAKER_OPEN == b.state &&
+		time.Since(b.openedAt) < time.Second*time.Duration(s.BreakerOpenTime)
+}
+
+//Schedule advertise of service unadvertised by breaker when open time is
+//elapsed (unless echo service keeps it down), so that probe calls can
+//come in. Called from Periodic() with MadvertiseLock locked.
+//@param ac ATMI Context
+func (s *ServiceMap) breakerPeriodic(ac *atmi.ATMICtx) {
+
+	if nil == s.breaker || BREAKER_UNADVERTISE != s.BreakerMode {
+		return
+	}
+
+	if !s.echoIsAdvertised && !s.echoSchedAdv && !s.echoDown && !s.breakerHeld() {
+		ac.TpLogWarn("Scheduling [%s] by breaker to advertise for probes!",
+			s.Svc)
+		s.echoSchedAdv = true
+		s.echoSchedUnAdv = false
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
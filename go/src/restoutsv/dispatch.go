@@ -34,14 +34,12 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
 	"io/ioutil"
 	//	"io"
 	"exutil"
 	"net"
 	"net/http"
 	"strconv"
-	"time"
 	u "ubftab"
 
 	atmi "github.com/endurox-dev/endurox-go"
@@ -193,28 +191,33 @@ func XATMIDispatchCall(pool *XATMIPool, nr int, ctxData *atmi.TPSRVCTXDATA,
 			ac.TpLogSetReqFile(buf, "", "")
 		}
 
-		json, errA := bufu.TpUBFToJSON()
+		//In ext mode JSON is needed only for URL template
+		if ERRORS_EXT != svc.Errors_int || svc.urlTpl || len(svc.queryParams) > 0 {
 
-		if nil == errA {
-			ac.TpLogDebug("Got json to send: [%s]", json)
-			//Set content to send
-			content_to_send = []byte(json)
-		} else {
+			json, errA := bufu.TpUBFToJSON()
 
-			ac.TpLogError("Failed to cast UBF to JSON: %s", errA.Error())
-			ret = FAIL
-			return
+			if nil == errA {
+				ac.TpLogDebug("Got json to send: [%s]", json)
+				//Set content to send
+				content_to_send = []byte(json)
+			} else {
+
+				ac.TpLogError("Failed to cast UBF to JSON: %s", errA.Error())
+				ret = FAIL
+				return
+			}
 		}
 
-		if svc.Errors_int != ERRORS_HTTP && svc.Errors_int != ERRORS_JSON2UBF {
+		if svc.Errors_int != ERRORS_HTTP && svc.Errors_int != ERRORS_JSON2UBF &&
+			svc.Errors_int != ERRORS_EXT {
 
 			ac.TpLogError("Invalid configuration! Sending UBF buffer "+
-				"with non 'http' or 'json2ubf' buffer handling methods. "+
+				"with non 'http', 'json2ubf' or 'ext' buffer handling methods. "+
 				" Current method: %s", svc.Errors)
 
 			ac.UserLog("Service [%s] configuration error! Processing "+
 				"buffer UBF, but errors marked as [%s]. "+
-				"Must be 'json2ubf' or 'http'. Check field 'errors' "+
+				"Must be 'json2ubf', 'ext' or 'http'. Check field 'errors' "+
 				"in service config block", svc.Errors)
 			ret = FAIL
 			return
@@ -350,11 +353,35 @@ func XATMIDispatchCall(pool *XATMIPool, nr int, ctxData *atmi.TPSRVCTXDATA,
 		break
 	}
 
-	ac.TpLogInfo("Sending POST request to: [%s] skip HTTPS cert check: %t",
-		svc.Url, svc.SSLInsecure)
+	//Fill the URL template & query string from the buffer
+	reqUrl, content_to_send, errT := urlTplBuild(ac, svc, buftype, content_to_send)
+
+	if nil != errT {
+		ac.TpLogError("Failed to build request URL: %s", errT.Error())
+		ret = FAIL
+		return
+	}
+
+	var req *http.Request
+	var errReq error
+
+	if ERRORS_EXT == svc.Errors_int {
+		//Method, headers, cookies & body from UBF fields
+		req, errReq = extBuildRequest(ac, svc, bufu, reqUrl)
+	} else {
+
+		if !svc.methodBody {
+			ac.TpLogDebug("Method %s - no request body sent", svc.Method)
+			content_to_send = nil
+		}
+
+		ac.TpLogInfo("Sending %s request to: [%s] skip HTTPS cert check: %t",
+			svc.Method, reqUrl, svc.SSLInsecure)
+
+		ac.TpLogDump(atmi.LOG_DEBUG, "Data To send", content_to_send, len(content_to_send))
+		req, errReq = http.NewRequest(svc.Method, reqUrl, bytes.NewBuffer(content_to_send))
+	}
 
-	ac.TpLogDump(atmi.LOG_DEBUG, "Data To send", content_to_send, len(content_to_send))
-	req, errReq := http.NewRequest("POST", svc.Url, bytes.NewBuffer(content_to_send))
 	if nil != errReq {
 		ac.TpLogError("Failed to make request object: %s", errReq.Error())
 		ret = FAIL
@@ -362,26 +389,43 @@ func XATMIDispatchCall(pool *XATMIPool, nr int, ctxData *atmi.TPSRVCTXDATA,
 	}
 
 	//req.Header.Set("X-Custom-Header", "myvalue")
-	req.Header.Set("Content-Type", content_type)
+	if svc.methodBody && ERRORS_EXT != svc.Errors_int {
+		req.Header.Set("Content-Type", content_type)
+	}
 
-	tr := &http.Transport{
-		DisableKeepAlives: true,
-		TLSClientConfig:   &tls.Config{InsecureSkipVerify: svc.SSLInsecure},
+	client := transportClient(svc)
+
+	if !svc.breakerAllow(ac) {
+		ac.TpLogError("Service [%s] breaker is open - fail fast", svc.Svc)
+		retFlags |= atmi.TPSOFTNOENT
+		ret = FAIL
+		return
+	}
+
+	if errA := oauth2Authorize(ac, svc, client, req, ""); nil != errA {
+		ac.TpLogError("Failed to authorize request: %s", errA.Error())
+		svc.breakerCancel(ac)
+		ret = FAIL
+		return
 	}
-	client := &http.Client{
-		Timeout:   time.Second * time.Duration(svc.Timeout),
-		Transport: tr}
 
 	//measure and log request time...
 	var rspWatch exutil.StopWatch
 
 	rspWatch.Reset()
 
-	resp, errClt := client.Do(req)
+	resp, errClt := retryDo(ac, svc, client, req)
+
+	//Token refresh failure is not the failure of the service endpoint
+	if oauth2TokenFailed(errClt) {
+		svc.breakerCancel(ac)
+	} else {
+		svc.breakerRecord(ac, nil == errClt && !svc.breakerStatus[resp.StatusCode])
+	}
 
 	//Log the response
 	if nil != resp {
-		ac.TpLogWarn("Response Status [%s]: %s (%d ms)", svc.Url,
+		ac.TpLogWarn("Response Status [%s]: %s (%d ms)", reqUrl,
 			resp.Status, rspWatch.GetDeltaMillis())
 	}
 
@@ -426,7 +470,8 @@ func XATMIDispatchCall(pool *XATMIPool, nr int, ctxData *atmi.TPSRVCTXDATA,
 	//If we are nont handling in http way and http is bad
 	//then return fail...
 	//Check the status now
-	if svc.Errors_int != ERRORS_HTTP && resp.StatusCode != http.StatusOK {
+	if svc.Errors_int != ERRORS_HTTP && svc.Errors_int != ERRORS_EXT &&
+		resp.StatusCode != http.StatusOK {
 
 		netCode = MapHttpError(ac, svc, resp.StatusCode)
 		ac.TpLogError("Expected http status [%d], but got: [%s] - fail "+
@@ -464,6 +509,30 @@ func XATMIDispatchCall(pool *XATMIPool, nr int, ctxData *atmi.TPSRVCTXDATA,
 
 		netCode = MapHttpError(ac, svc, resp.StatusCode)
 
+		break
+	case ERRORS_EXT:
+
+		//Response is loaded regardless of the status
+		if errU := extLoadResponse(ac, bufu, resp, body); nil != errU {
+			ac.TpLogError("Failed to load ext response: %s - dropping",
+				errU.Error())
+
+			retFlags |= atmi.TPSOFTTIMEOUT
+			ret = FAIL
+			return
+		}
+
+		//Any 2xx is success, status is available in EX_NETRCODE
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			ac.TpLogInfo("ext mode, status %s - succeed", resp.Status)
+			netCode = atmi.TPMINVAL
+		} else {
+			ac.TpLogInfo("Error conv mode is ext - looking up mapping table by %s",
+				resp.Status)
+
+			netCode = MapHttpError(ac, svc, resp.StatusCode)
+		}
+
 		break
 	case ERRORS_JSON:
 		//Try to find our fields into which we are interested
@@ -676,6 +745,12 @@ func XATMIDispatchCall(pool *XATMIPool, nr int, ctxData *atmi.TPSRVCTXDATA,
 	ac.TpLogInfo("Status after remap: code: %d message: [%s]",
 		netCode, netMessage)
 
+	//ext response is already in the buffer
+	if ERRORS_EXT == svc.Errors_int {
+		retBuf = bufu.GetBuf()
+		return
+	}
+
 	//Should we parse content in case of error
 	//Well we could try that if we have some data returned!
 	//This should be done only in http error mapping case.
@@ -0,0 +1,277 @@
+/**
+ * @brief Ext mode - HTTP request/response carried in UBF fields
+ *
+ * @file ext.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	u "ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Response fields of ext mode, removed before loading new response
+var MextRspFields = []int{
+	u.EX_NETRCODE,
+	u.EX_IF_RSPHN,
+	u.EX_IF_RSPHV,
+	u.EX_IF_RSPCN,
+	u.EX_IF_RSPCV,
+	u.EX_IF_RSPCPATH,
+	u.EX_IF_RSPCDOMAIN,
+	u.EX_IF_RSPCEXPIRES,
+	u.EX_IF_RSPCMAXAGE,
+	u.EX_IF_RSPCSECURE,
+	u.EX_IF_RSPCHTTPONLY,
+	u.EX_IF_RSPDATA}
+
+//Read name/value pairs from the UBF buffer
+//@param bufu UBF buffer
+//@param namefld name field id
+//@param valfld value field id
+//@return names, values, UBF error
+func extPairs(bufu *atmi.TypedUBF, namefld int, valfld int) ([]string,
+	[]string, atmi.UBFError) {
+
+	var names []string
+	var vals []string
+
+	occs, _ := bufu.BOccur(namefld)
+
+	for occ := 0; occ < occs; occ++ {
+
+		name, errU := bufu.BGetString(namefld, occ)
+
+		if nil != errU {
+			return nil, nil, errU
+		}
+
+		//Missing value means empty
+		val, _ := bufu.BGetString(valfld, occ)
+
+		names = append(names, name)
+		vals = append(vals, val)
+	}
+
+	return names, vals, nil
+}
+
+//Build the HTTP request from the UBF buffer for ext mode. Method is taken
+//from EX_IF_METHOD (or service 'method'), EX_IF_URL is appended to
+//the service URL path, query parameters come from EX_IF_REQQUERYN/V,
+//headers from EX_IF_REQHN/V, cookies from EX_IF_REQCN/V and body
+//from EX_IF_REQDATA.
+//@param ac ATMI Context
+//@param svc Service map
+//@param bufu UBF buffer
+//@param reqUrl service URL (with template filled)
+//@return HTTP request, error
+func extBuildRequest(ac *atmi.ATMICtx, svc *ServiceMap, bufu *atmi.TypedUBF,
+	reqUrl string) (*http.Request, error) {
+
+	method := svc.Method
+
+	if bufu.BPres(u.EX_IF_METHOD, 0) {
+		method, _ = bufu.BGetString(u.EX_IF_METHOD, 0)
+		method = strings.ToUpper(method)
+
+		if _, ok := Mmethods[method]; !ok {
+			return nil, fmt.Errorf("Unsupported EX_IF_METHOD [%s]", method)
+		}
+	}
+
+	//URL suffix goes before the query string
+	base := reqUrl
+	query := ""
+
+	if pos := strings.Index(reqUrl, "?"); pos >= 0 {
+		base = reqUrl[:pos]
+		query = reqUrl[pos+1:]
+	}
+
+	if bufu.BPres(u.EX_IF_URL, 0) {
+		suffix, _ := bufu.BGetString(u.EX_IF_URL, 0)
+		base += suffix
+	}
+
+	names, vals, errU := extPairs(bufu, u.EX_IF_REQQUERYN, u.EX_IF_REQQUERYV)
+
+	if nil != errU {
+		return nil, fmt.Errorf("Failed to read query params: %s", errU.Error())
+	}
+
+	if len(names) > 0 {
+
+		params := url.Values{}
+
+		for i := range names {
+			params.Add(names[i], vals[i])
+		}
+
+		if "" != query {
+			query += "&"
+		}
+
+		query += params.Encode()
+	}
+
+	if "" != query {
+		base += "?" + query
+	}
+
+	var body []byte
+
+	if bufu.BPres(u.EX_IF_REQDATA, 0) {
+		body, errU = bufu.BGetByteArr(u.EX_IF_REQDATA, 0)
+
+		if nil != errU {
+			return nil, fmt.Errorf("Failed to read EX_IF_REQDATA: %s",
+				errU.Error())
+		}
+	}
+
+	ac.TpLogInfo("ext: %s [%s] body %d bytes", method, base, len(body))
+	ac.TpLogDump(atmi.LOG_DEBUG, "Data To send", body, len(body))
+
+	req, err := http.NewRequest(method, base, bytes.NewBuffer(body))
+
+	if nil != err {
+		return nil, err
+	}
+
+	names, vals, errU = extPairs(bufu, u.EX_IF_REQHN, u.EX_IF_REQHV)
+
+	if nil != errU {
+		return nil, fmt.Errorf("Failed to read headers: %s", errU.Error())
+	}
+
+	for i := range names {
+		req.Header.Add(names[i], vals[i])
+	}
+
+	if len(body) > 0 && "" == req.Header.Get("Content-Type") {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+
+	names, vals, errU = extPairs(bufu, u.EX_IF_REQCN, u.EX_IF_REQCV)
+
+	if nil != errU {
+		return nil, fmt.Errorf("Failed to read cookies: %s", errU.Error())
+	}
+
+	for i := range names {
+		req.AddCookie(&http.Cookie{Name: names[i], Value: vals[i]})
+	}
+
+	return req, nil
+}
+
+//Load the HTTP response into UBF buffer for ext mode: status into
+//EX_NETRCODE, headers into EX_IF_RSPHN/V, cookies into EX_IF_RSPC*
+//and body into EX_IF_RSPDATA.
+//@param ac ATMI Context
+//@param bufu UBF buffer
+//@param resp HTTP response
+//@param body response body
+//@return UBF error or nil
+func extLoadResponse(ac *atmi.ATMICtx, bufu *atmi.TypedUBF, resp *http.Response,
+	body []byte) atmi.UBFError {
+
+	//Remove response data of previous calls (if any)
+	bufu.BDelete(MextRspFields)
+
+	if errU := bufu.BChg(u.EX_NETRCODE, 0, resp.StatusCode); nil != errU {
+		return errU
+	}
+
+	for name, vals := range resp.Header {
+
+		//Cookies are loaded in separate fields
+		if "Set-Cookie" == name {
+			continue
+		}
+
+		for _, v := range vals {
+
+			if errU := bufu.BAdd(u.EX_IF_RSPHN, name); nil != errU {
+				return errU
+			}
+
+			if errU := bufu.BAdd(u.EX_IF_RSPHV, v); nil != errU {
+				return errU
+			}
+		}
+	}
+
+	for occ, c := range resp.Cookies() {
+
+		expires := ""
+		maxAge := ""
+
+		if !c.Expires.IsZero() {
+			expires = c.Expires.UTC().Format(time.RFC1123)
+		}
+
+		if 0 != c.MaxAge {
+			maxAge = strconv.Itoa(c.MaxAge)
+		}
+
+		flds := []int{u.EX_IF_RSPCN, u.EX_IF_RSPCV, u.EX_IF_RSPCPATH,
+			u.EX_IF_RSPCDOMAIN, u.EX_IF_RSPCEXPIRES, u.EX_IF_RSPCMAXAGE,
+			u.EX_IF_RSPCSECURE, u.EX_IF_RSPCHTTPONLY}
+
+		vals := []string{c.Name, c.Value, c.Path, c.Domain, expires, maxAge,
+			strconv.FormatBool(c.Secure), strconv.FormatBool(c.HttpOnly)}
+
+		for i, fld := range flds {
+			if errU := bufu.BChg(fld, occ, vals[i]); nil != errU {
+				return errU
+			}
+		}
+	}
+
+	if errU := bufu.BChg(u.EX_IF_RSPDATA, 0, body); nil != errU {
+		return errU
+	}
+
+	bufu.TpLogPrintUBF(atmi.LOG_DEBUG, "ext: response loaded")
+
+	return nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
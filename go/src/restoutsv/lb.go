@@ -0,0 +1,466 @@
+/**
+ * @brief Multiple upstream endpoints - load balancing and failover
+ *
+ * @file lb.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Load balancing modes
+const (
+	LB_ROUNDROBIN = "roundrobin" //Healthy endpoints in turn
+	LB_WEIGHTED   = "weighted"   //Smooth weighted round robin
+	LB_STANDBY    = "standby"    //First healthy endpoint in the list
+)
+
+//Upstream endpoint of the service
+type Endpoint struct {
+	Base      string //Normalized base URL
+	Weight    int
+	cur       int       //Current weight for weighted mode
+	fails     int       //Consecutive failures
+	downUntil time.Time //Endpoint is skipped until
+}
+
+//Endpoints & balancer state of the service
+type Balancer struct {
+	mutex     sync.Mutex
+	endpoints []*Endpoint
+	next      int //Next endpoint for round robin
+}
+
+//Parse endpoint list & prepare balancer. Service url must be relative, it
+//is built with the first endpoint (thus url templates, transport etc. work
+//as with single urlbase) and swapped at the request time.
+//@param ac ATMI Context
+//@param svc Service map
+//@return error in case of invalid config or nil
+func lbSetup(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if "" == svc.UrlBases {
+		return nil
+	}
+
+	if !strings.HasPrefix(svc.Url, "/") {
+		return fmt.Errorf("Service [%s]: url must start with / when "+
+			"urlbases is used", svc.Svc)
+	}
+
+	if LB_ROUNDROBIN != svc.Lb && LB_WEIGHTED != svc.Lb && LB_STANDBY != svc.Lb {
+		return fmt.Errorf("Service [%s]: invalid lb [%s], must be '%s', "+
+			"'%s' or '%s'", svc.Svc, svc.Lb, LB_ROUNDROBIN, LB_WEIGHTED,
+			LB_STANDBY)
+	}
+
+	if svc.LbMaxFails < 1 || svc.LbFailTime < 0 {
+		return fmt.Errorf("Service [%s]: invalid lb_max_fails %d (must be "+
+			">=1) or lb_fail_time %d (must be >=0)", svc.Svc, svc.LbMaxFails,
+			svc.LbFailTime)
+	}
+
+	var weights []string
+
+	if "" != svc.LbWeights {
+		weights = strings.Split(svc.LbWeights, ",")
+	}
+
+	lb := &Balancer{}
+
+	for i, base := range strings.Split(svc.UrlBases, ",") {
+
+		u, err := url.Parse(strings.TrimSpace(base))
+
+		if nil != err || "" == u.Scheme || "" == u.Host {
+			return fmt.Errorf("Service [%s]: invalid base url [%s] in urlbases",
+				svc.Svc, base)
+		}
+
+		ep := &Endpoint{Base: strings.TrimSuffix(u.String(), "/"), Weight: 1}
+
+		if len(weights) > 0 {
+
+			if len(weights) <= i {
+				return fmt.Errorf("Service [%s]: lb_weights must have "+
+					"weight for each of urlbases", svc.Svc)
+			}
+
+			ep.Weight, err = strconv.Atoi(strings.TrimSpace(weights[i]))
+
+			if nil != err || ep.Weight < 1 {
+				return fmt.Errorf("Service [%s]: invalid weight [%s] in "+
+					"lb_weights", svc.Svc, weights[i])
+			}
+		}
+
+		ac.TpLogInfo("Service [%s] endpoint %d: [%s] weight %d", svc.Svc, i,
+			ep.Base, ep.Weight)
+
+		lb.endpoints = append(lb.endpoints, ep)
+	}
+
+	if len(weights) > len(lb.endpoints) {
+		return fmt.Errorf("Service [%s]: lb_weights has more entries than "+
+			"urlbases", svc.Svc)
+	}
+
+	svc.lbStatus = make(map[int]bool)
+
+	for code := range retryParseSet(svc.LbStatus, false) {
+
+		status, err := strconv.Atoi(code)
+
+		if nil != err || status < 100 || status > 599 {
+			return fmt.Errorf("Service [%s]: invalid HTTP status [%s] "+
+				"in lb_status", svc.Svc, code)
+		}
+
+		svc.lbStatus[status] = true
+	}
+
+	svc.UrlBase = lb.endpoints[0].Base
+	svc.lb = lb
+
+	return nil
+}
+
+//Select endpoint by balancing mode, from the ones accepted by filter.
+//Must be called with mutex locked.
+//@param mode balancing mode
+//@param accept filter
+//@return endpoint index or -1
+func (lb *Balancer) choose(mode string, accept func(i int) bool) int {
+
+	n := len(lb.endpoints)
+
+	switch mode {
+	case LB_WEIGHTED:
+
+		best := -1
+		total := 0
+
+		for i, ep := range lb.endpoints {
+
+			if !accept(i) {
+				continue
+			}
+
+			ep.cur += ep.Weight
+			total += ep.Weight
+
+			if -1 == best || ep.cur > lb.endpoints[best].cur {
+				best = i
+			}
+		}
+
+		if best > -1 {
+			lb.endpoints[best].cur -= total
+		}
+
+		return best
+
+	case LB_ROUNDROBIN:
+
+		for k := 0; k < n; k++ {
+
+			i := (lb.next + k) % n
+
+			if accept(i) {
+				lb.next = (i + 1) % n
+				return i
+			}
+		}
+
+	default:
+
+		for i := 0; i < n; i++ {
+			if accept(i) {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+//Pick endpoint for the attempt. Healthy endpoints not tried in this call are
+//preferred, then not tried ones which are down (earliest recovery first).
+//If all are tried, selection starts over.
+//@param svc Service map
+//@param tried endpoints tried by the call
+//@return endpoint index
+func (lb *Balancer) pick(svc *ServiceMap, tried []bool) int {
+
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	now := time.Now()
+
+	healthy := func(i int) bool {
+		return !lb.endpoints[i].downUntil.After(now)
+	}
+
+	earliest := func(skipTried bool) int {
+
+		best := -1
+
+		for i, ep := range lb.endpoints {
+			if (!skipTried || !tried[i]) && (-1 == best ||
+				ep.downUntil.Before(lb.endpoints[best].downUntil)) {
+				best = i
+			}
+		}
+
+		return best
+	}
+
+	if i := lb.choose(svc.Lb, func(i int) bool {
+		return !tried[i] && healthy(i)
+	}); i > -1 {
+		return i
+	}
+
+	if i := earliest(true); i > -1 {
+		return i
+	}
+
+	if i := lb.choose(svc.Lb, healthy); i > -1 {
+		return i
+	}
+
+	return earliest(false)
+}
+
+//Are there endpoints not yet tried by the call
+//@param tried endpoints tried by the call
+//@return true if failover is possible
+func (lb *Balancer) untried(tried []bool) bool {
+
+	for _, t := range tried {
+		if !t {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Record outcome of the call to endpoint
+//@param ac ATMI Context
+//@param svc Service map
+//@param i endpoint index
+//@param ok true if endpoint responded properly
+func (lb *Balancer) record(ac *atmi.ATMICtx, svc *ServiceMap, i int, ok bool) {
+
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	ep := lb.endpoints[i]
+
+	if ok {
+
+		if ep.fails >= svc.LbMaxFails {
+			ac.TpLogWarn("Service [%s] endpoint [%s] is up", svc.Svc, ep.Base)
+		}
+
+		ep.fails = 0
+		ep.downUntil = time.Time{}
+		return
+	}
+
+	ep.fails++
+
+	if ep.fails >= svc.LbMaxFails {
+		ep.downUntil = time.Now().Add(time.Second * time.Duration(svc.LbFailTime))
+		ac.TpLogError("Service [%s] endpoint [%s] is down for %d sec "+
+			"(consecutive fails: %d)", svc.Svc, ep.Base, svc.LbFailTime, ep.fails)
+	}
+}
+
+//Record outcome for endpoint with given base url (if service has such)
+//@param ac ATMI Context
+//@param svc Service map
+//@param base endpoint base url
+//@param ok true if endpoint responded properly
+func (lb *Balancer) recordBase(ac *atmi.ATMICtx, svc *ServiceMap, base string, ok bool) {
+
+	for i, ep := range lb.endpoints {
+		if base == ep.Base {
+			lb.record(ac, svc, i, ok)
+		}
+	}
+}
+
+//Send echo data to each endpoint of the echo service directly, so that
+//endpoints are marked down and brought back up by the echo too, not only
+//by the outcomes of live calls. Result is recorded for the endpoint of the
+//echo service and for endpoints with the same base of the dependent services.
+//Endpoint is ok if it responds with http status below 400.
+//@param ac ATMI Context
+//@param s echo service
+func (lb *Balancer) echo(ac *atmi.ATMICtx, s *ServiceMap) {
+
+	buftype := "JSON"
+	contentType := "application/json"
+	content := []byte(s.EchoData)
+
+	switch s.echoConvInt {
+	case CONV_JSON2UBF:
+		buftype = "UBF"
+	case CONV_JSON2VIEW:
+		buftype = "VIEW"
+	case CONV_TEXT:
+		buftype = "STRING"
+		contentType = "text/plain"
+	case CONV_RAW:
+		buftype = "CARRAY"
+		contentType = "application/octet-stream"
+		content = s.echoCARRAY.GetBytes()
+	}
+
+	reqUrl, content, err := urlTplBuild(ac, s, buftype, content)
+
+	if nil != err {
+		ac.TpLogError("Service [%s] endpoint echo: failed to build URL: %s",
+			s.Svc, err.Error())
+		return
+	}
+
+	//Ext mode builds method, headers & body from the echo buffer
+	var bufu *atmi.TypedUBF
+
+	if ERRORS_EXT == s.Errors_int && CONV_JSON2UBF == s.echoConvInt {
+
+		var errA atmi.ATMIError
+
+		if bufu, errA = ac.NewUBF(atmi.ATMIMsgSizeMax()); nil != errA {
+			ac.TpLogError("Service [%s] endpoint echo: failed to alloc "+
+				"buffer: %s", s.Svc, errA.Error())
+			return
+		}
+
+		if errB := ac.BCpy(bufu, s.echoUBF); nil != errB {
+			ac.TpLogError("Service [%s] endpoint echo: failed to copy echo "+
+				"buffer: %s", s.Svc, errB.Error())
+			return
+		}
+	}
+
+	if !s.methodBody {
+		content = nil
+	}
+
+	rest := strings.TrimPrefix(reqUrl, s.UrlBase)
+	client := transportClient(s)
+
+	for i, ep := range lb.endpoints {
+
+		var req *http.Request
+
+		if nil != bufu {
+			req, err = extBuildRequest(ac, s, bufu, reqUrl)
+		} else if req, err = http.NewRequest(s.Method, reqUrl,
+			bytes.NewBuffer(content)); nil == err && s.methodBody {
+			req.Header.Set("Content-Type", contentType)
+		}
+
+		if nil == err {
+			err = ep.route(req, rest)
+		}
+
+		if nil != err {
+			ac.TpLogError("Service [%s] endpoint echo: failed to make "+
+				"request: %s", s.Svc, err.Error())
+			return
+		}
+
+		//Token endpoint failure says nothing about the endpoint
+		if errA := oauth2Authorize(ac, s, client, req, ""); nil != errA {
+			ac.TpLogError("Service [%s] endpoint echo: failed to authorize: %s",
+				s.Svc, errA.Error())
+			return
+		}
+
+		resp, err := retryAttempt(ac, s, client, req)
+		ok := nil == err && resp.StatusCode < http.StatusBadRequest
+
+		if nil != err {
+			ac.TpLogWarn("Service [%s] endpoint [%s] echo failed: %s",
+				s.Svc, ep.Base, err.Error())
+		} else {
+			ac.TpLogInfo("Service [%s] endpoint [%s] echo: %s",
+				s.Svc, ep.Base, resp.Status)
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		lb.record(ac, s, i, ok)
+
+		for _, ds := range s.Dependies {
+			if nil != ds.lb {
+				ds.lb.recordBase(ac, ds, ep.Base, ok)
+			}
+		}
+	}
+}
+
+//Route the request to endpoint
+//@param req HTTP request
+//@param ep endpoint
+//@param rest request url part after the service base url
+//@return error or nil
+func (ep *Endpoint) route(req *http.Request, rest string) error {
+
+	u, err := url.Parse(ep.Base + rest)
+
+	if nil != err {
+		return err
+	}
+
+	req.URL = u
+	req.Host = u.Host
+
+	return nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,361 @@
+/**
+ * @brief OAuth2 client credentials tokens for outgoing services
+ *
+ * @file oauth2.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//OAuth2 client authentication methods
+const (
+	OAUTH2_AUTH_BASIC = "basic" //HTTP Basic auth header
+	OAUTH2_AUTH_BODY  = "body"  //client_id & client_secret in form body
+)
+
+//Cached OAuth2 access token, shared by services with the same token source
+type OAuth2Token struct {
+	Url      string
+	ClientId string
+	secret   string
+	Scopes   string
+	Audience string
+	Auth     string
+	Skew     time.Duration
+
+	mutex   sync.Mutex
+	token   string
+	expires time.Time //Zero if token does not expire
+}
+
+//Token sources by key
+var Moauth2Tokens map[string]*OAuth2Token
+
+//Token endpoint response
+type oauth2Rsp struct {
+	AccessToken string      `json:"access_token"`
+	TokenType   string      `json:"token_type"`
+	ExpiresIn   json.Number `json:"expires_in"`
+}
+
+//Resolve secret setting: env:<NAME> reads environment variable,
+//file:<PATH> reads the file (trimmed), other values are literal.
+//@param val setting value
+//@return resolved value, error
+func cfgSecret(val string) (string, error) {
+
+	if strings.HasPrefix(val, "env:") {
+		return os.Getenv(val[4:]), nil
+	}
+
+	if strings.HasPrefix(val, "file:") {
+
+		data, err := ioutil.ReadFile(val[5:])
+
+		if nil != err {
+			return "", err
+		}
+
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	return val, nil
+}
+
+//Prepare OAuth2 settings of the service
+//@param ac ATMI Context
+//@param svc Service map
+//@return error in case of invalid config or nil
+func oauth2Setup(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if "" == svc.OAuth2TokenUrl {
+		return nil
+	}
+
+	if OAUTH2_AUTH_BASIC != svc.OAuth2Auth && OAUTH2_AUTH_BODY != svc.OAuth2Auth {
+		return fmt.Errorf("Service [%s]: invalid oauth2_auth [%s], must be "+
+			"'%s' or '%s'", svc.Svc, svc.OAuth2Auth, OAUTH2_AUTH_BASIC,
+			OAUTH2_AUTH_BODY)
+	}
+
+	if svc.OAuth2Skew < 0 {
+		return fmt.Errorf("Service [%s]: invalid oauth2_skew %d, must be >=0",
+			svc.Svc, svc.OAuth2Skew)
+	}
+
+	id, err := cfgSecret(svc.OAuth2ClientId)
+
+	if nil != err || "" == id {
+		return fmt.Errorf("Service [%s]: oauth2_client_id not available "+
+			"(err: %v)", svc.Svc, err)
+	}
+
+	secret, err := cfgSecret(svc.OAuth2ClientSecret)
+
+	if nil != err || "" == secret {
+		return fmt.Errorf("Service [%s]: oauth2_client_secret not available "+
+			"(err: %v)", svc.Svc, err)
+	}
+
+	//Scopes are space separated in the request
+	scopes := strings.Join(strings.FieldsFunc(svc.OAuth2Scopes, func(r rune) bool {
+		return ' ' == r || ',' == r
+	}), " ")
+
+	key := strings.Join([]string{svc.OAuth2TokenUrl, id, scopes,
+		svc.OAuth2Audience}, "|")
+
+	if nil == Moauth2Tokens {
+		Moauth2Tokens = make(map[string]*OAuth2Token)
+	}
+
+	tok := Moauth2Tokens[key]
+
+	if nil == tok {
+		tok = &OAuth2Token{Url: svc.OAuth2TokenUrl, ClientId: id, secret: secret,
+			Scopes: scopes, Audience: svc.OAuth2Audience, Auth: svc.OAuth2Auth,
+			Skew: time.Second * time.Duration(svc.OAuth2Skew)}
+		Moauth2Tokens[key] = tok
+	}
+
+	svc.oauth2 = tok
+
+	ac.TpLogInfo("Service [%s] uses OAuth2 tokens from [%s] client [%s] "+
+		"scopes [%s]", svc.Svc, svc.OAuth2TokenUrl, id, scopes)
+
+	return nil
+}
+
+//Request new token from the token endpoint. Must be called with mutex locked.
+//@param ac ATMI Context
+//@param client HTTP client
+func (t *OAuth2Token) fetch(ac *atmi.ATMICtx, client *http.Client) error {
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+
+	if "" != t.Scopes {
+		form.Set("scope", t.Scopes)
+	}
+
+	if "" != t.Audience {
+		form.Set("audience", t.Audience)
+	}
+
+	if OAUTH2_AUTH_BODY == t.Auth {
+		form.Set("client_id", t.ClientId)
+		form.Set("client_secret", t.secret)
+	}
+
+	req, err := http.NewRequest("POST", t.Url, strings.NewReader(form.Encode()))
+
+	if nil != err {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	if OAUTH2_AUTH_BASIC == t.Auth {
+		req.SetBasicAuth(url.QueryEscape(t.ClientId), url.QueryEscape(t.secret))
+	}
+
+	ac.TpLogInfo("Requesting OAuth2 token from [%s]", t.Url)
+
+	resp, err := client.Do(req)
+
+	if nil != err {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if nil != err {
+		return err
+	}
+
+	if http.StatusOK != resp.StatusCode {
+		return fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+
+	var rsp oauth2Rsp
+
+	if err := json.Unmarshal(body, &rsp); nil != err {
+		return fmt.Errorf("invalid token response: %s", err.Error())
+	}
+
+	if "" == rsp.AccessToken {
+		return fmt.Errorf("access_token missing in token response")
+	}
+
+	if "" != rsp.TokenType && !strings.EqualFold("bearer", rsp.TokenType) {
+		return fmt.Errorf("unsupported token_type [%s]", rsp.TokenType)
+	}
+
+	t.token = rsp.AccessToken
+	t.expires = time.Time{}
+
+	if secs, err := rsp.ExpiresIn.Int64(); nil == err && secs > 0 {
+		t.expires = time.Now().Add(time.Second * time.Duration(secs))
+	}
+
+	ac.TpLogInfo("Got OAuth2 token, expires in [%s] sec", rsp.ExpiresIn)
+
+	return nil
+}
+
+//Get valid access token. New token is requested if there is none, if it
+//expires within skew time, or if the token equals to stale one (rejected
+//by server). Concurrent callers wait for single token request.
+//@param ac ATMI Context
+//@param client HTTP client
+//@param stale token rejected by server or empty
+//@return access token, error
+func (t *OAuth2Token) Get(ac *atmi.ATMICtx, client *http.Client,
+	stale string) (string, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	valid := "" != t.token && (t.expires.IsZero() ||
+		time.Now().Add(t.Skew).Before(t.expires))
+
+	if valid && ("" == stale || stale != t.token) {
+		return t.token, nil
+	}
+
+	t.token = ""
+
+	if err := t.fetch(ac, client); nil != err {
+		ac.TpLogError("Failed to get OAuth2 token from [%s]: %s",
+			t.Url, err.Error())
+		return "", err
+	}
+
+	return t.token, nil
+}
+
+//Failure to get the token from token endpoint. It is not accounted as the
+//failure of the service endpoint (breaker, load balancer)
+type oauth2TokenError struct {
+	err error
+}
+
+func (e *oauth2TokenError) Error() string {
+	return e.err.Error()
+}
+
+//Check is error a failure of the token endpoint
+//@param err error or nil
+//@return true if token could not be acquired
+func oauth2TokenFailed(err error) bool {
+	_, ok := err.(*oauth2TokenError)
+	return ok
+}
+
+//Set the bearer token on the request (if service uses OAuth2)
+//@param ac ATMI Context
+//@param svc Service map
+//@param client HTTP client
+//@param req HTTP request
+//@param stale token rejected by server or empty
+//@return error or nil
+func oauth2Authorize(ac *atmi.ATMICtx, svc *ServiceMap, client *http.Client,
+	req *http.Request, stale string) error {
+
+	if nil == svc.oauth2 {
+		return nil
+	}
+
+	token, err := svc.oauth2.Get(ac, client, stale)
+
+	if nil != err {
+		return &oauth2TokenError{err: err}
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return nil
+}
+
+//Retry the request once with refreshed token, after server responded 401
+//@param ac ATMI Context
+//@param svc Service map
+//@param client HTTP client
+//@param req HTTP request sent
+//@param resp 401 response (closed here)
+//@return new response, error
+func oauth2Retry(ac *atmi.ATMICtx, svc *ServiceMap, client *http.Client,
+	req *http.Request, resp *http.Response) (*http.Response, error) {
+
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	stale := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+
+	ac.TpLogWarn("Got 401 from [%s] - refreshing OAuth2 token", req.URL.String())
+
+	if err := oauth2Authorize(ac, svc, client, req, stale); nil != err {
+		return nil, err
+	}
+
+	if nil != req.GetBody {
+
+		body, err := req.GetBody()
+
+		if nil != err {
+			return nil, err
+		}
+
+		req.Body = body
+	} else {
+		req.Body = ioutil.NopCloser(bytes.NewReader(nil))
+	}
+
+	return client.Do(req)
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -50,7 +50,14 @@ func Periodic(ac *atmi.ATMICtx) int {
 	//Loop over the all services and check the required actions
 	for _, v := range Mservices {
 
-		if v.echoSchedAdv {
+		v.breakerPeriodic(ac)
+
+		if v.echoSchedAdv && v.breakerHeld() {
+
+			ac.TpLogDebug("periodic: [%s] advertise held by breaker",
+				v.Svc)
+
+		} else if v.echoSchedAdv {
 
 			ac.TpLogInfo("periodic: [%s] needs to be advertised",
 				v.Svc)
@@ -0,0 +1,155 @@
+/**
+ * @brief Outbound HTTP/HTTPS proxy settings
+ *
+ * @file proxy.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Proxy taken from HTTPS_PROXY/HTTP_PROXY/NO_PROXY environment variables
+const PROXY_ENV = "env"
+
+//Check is host excluded from proxying by no_proxy list
+//@param noProxy list of host names, domains, IPs or CIDRs
+//@param host host name (without port)
+//@return true if request goes directly
+func proxyBypass(noProxy []string, host string) bool {
+
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, np := range noProxy {
+
+		if "*" == np {
+			return true
+		}
+
+		if _, cidr, err := net.ParseCIDR(np); nil == err {
+
+			if nil != ip && cidr.Contains(ip) {
+				return true
+			}
+
+			continue
+		}
+
+		np = strings.TrimPrefix(np, ".")
+
+		if host == np || strings.HasSuffix(host, "."+np) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Prepare proxy settings of the service
+//@param ac ATMI Context
+//@param svc Service map
+//@return error in case of invalid config or nil
+func proxySetup(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	svc.proxyFunc = nil
+	svc.proxyKey = ""
+
+	if "" == svc.Proxy {
+		return nil
+	}
+
+	if PROXY_ENV == svc.Proxy {
+		ac.TpLogInfo("Service [%s] uses proxy from environment", svc.Svc)
+		svc.proxyFunc = http.ProxyFromEnvironment
+		svc.proxyKey = PROXY_ENV
+		return nil
+	}
+
+	proxy, err := url.Parse(svc.Proxy)
+
+	if nil != err || "" == proxy.Host || ("http" != proxy.Scheme &&
+		"https" != proxy.Scheme && "socks5" != proxy.Scheme) {
+		return fmt.Errorf("Service [%s]: invalid proxy [%s], must be "+
+			"http://, https:// or socks5:// url, or '%s'", svc.Svc, svc.Proxy,
+			PROXY_ENV)
+	}
+
+	pass, err := cfgSecret(svc.ProxyPassword)
+
+	if nil != err {
+		return fmt.Errorf("Service [%s]: proxy_password not available: %s",
+			svc.Svc, err.Error())
+	}
+
+	if "" != svc.ProxyUser {
+		proxy.User = url.UserPassword(svc.ProxyUser, pass)
+	} else if "" != pass {
+		return fmt.Errorf("Service [%s]: proxy_password set without proxy_user",
+			svc.Svc)
+	}
+
+	var noProxy []string
+
+	for _, np := range strings.Split(svc.NoProxy, ",") {
+
+		if np = strings.ToLower(strings.TrimSpace(np)); "" != np {
+			noProxy = append(noProxy, np)
+		}
+	}
+
+	svc.proxyFunc = func(req *http.Request) (*url.URL, error) {
+
+		if proxyBypass(noProxy, req.URL.Hostname()) {
+			return nil, nil
+		}
+
+		return proxy, nil
+	}
+
+	//Password is not put in the key (it is logged), just a short hash
+	passHash := sha256.Sum256([]byte(pass))
+	svc.proxyKey = fmt.Sprintf("%s|%s|%x|%s", proxy.Redacted(), svc.ProxyUser,
+		passHash[:4], strings.Join(noProxy, ","))
+
+	ac.TpLogInfo("Service [%s] uses proxy [%s] user [%s] no_proxy [%s]",
+		svc.Svc, proxy.Redacted(), svc.ProxyUser, strings.Join(noProxy, ","))
+
+	return nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
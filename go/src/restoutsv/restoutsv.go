@@ -39,9 +39,11 @@ package main
 
 //Hmm we might need to put in channels a free ATMI contexts..
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
@@ -77,6 +79,7 @@ const (
 	//Return the error code as UBF response (usable only in case if CONV_JSON2UBF used)
 	ERRORS_JSON2UBF  = 4
 	ERRORS_JSON2VIEW = 5
+	ERRORS_EXT       = 6 //HTTP request/response in UBF fields
 )
 
 //Conversion types resolved
@@ -104,6 +107,39 @@ const (
 	ERRFMT_TEXT_DEFAULT        = "^([0-9]+):(.*)$"
 	WORKERS_DEFAULT            = 10 /* Number of worker processes */
 	NOREQFILE_DEFAULT          = true
+	METHOD_DEFAULT             = "POST"
+	KEEPALIVE_DEFAULT          = true
+	TRANSPORT_DEFAULT          = TRANSPORT_HOST
+	MAX_IDLE_CONNS_DEFAULT     = 100
+	MAX_IDLE_PER_HOST_DEFAULT  = 10
+	MAX_CONNS_PER_HOST_DEFAULT = 0  /* unlimited */
+	IDLE_TIMEOUT_DEFAULT       = 90 /* seconds */
+	HTTP2_DEFAULT              = false
+	OAUTH2_AUTH_DEFAULT        = OAUTH2_AUTH_BASIC
+	OAUTH2_SKEW_DEFAULT        = 30 /* seconds before expiry */
+	RETRY_ATTEMPTS_DEFAULT     = 1  /* no retries */
+	RETRY_BACKOFF_DEFAULT      = 100
+	RETRY_BACKOFF_MAX_DEFAULT  = 2000
+	RETRY_STATUS_DEFAULT       = "502,503,504"
+	RETRY_ERRORS_DEFAULT       = RETRY_ERR_CONNECT + "," + RETRY_ERR_RESET
+	RETRY_METHODS_DEFAULT      = "GET,HEAD,OPTIONS,PUT,DELETE"
+	BREAKER_DEFAULT            = false
+	BREAKER_MODE_DEFAULT       = BREAKER_FAILFAST
+	BREAKER_FAILS_DEFAULT      = 5
+	BREAKER_ERR_RATE_DEFAULT   = 0 /* percent, off */
+	BREAKER_WINDOW_DEFAULT     = 20
+	BREAKER_OPEN_TIME_DEFAULT  = 30 /* seconds */
+	BREAKER_PROBES_DEFAULT     = 1
+	BREAKER_STATUS_DEFAULT     = "500,502,503,504"
+	LB_DEFAULT                 = LB_ROUNDROBIN
+	LB_MAX_FAILS_DEFAULT       = 1
+	LB_FAIL_TIME_DEFAULT       = 30 /* seconds */
+	LB_STATUS_DEFAULT          = "502,503,504"
+	SIGN_HEADER_DEFAULT        = "X-Signature"
+	SIGN_TS_HEADER_DEFAULT     = "X-Timestamp"
+	SIGN_KEY_ID_HEADER_DEFAULT = "X-Key-Id"
+	SIGN_ENCODING_DEFAULT      = "hex"
+	SIGN_SERVICE_DEFAULT       = "s3"
 )
 
 //We will have most of the settings as defaults
@@ -114,6 +150,104 @@ type ServiceMap struct {
 	Url         string `json:"url"`
 	SSLInsecure bool   `json:"sslinsecure"`
 
+	//Multiple endpoints, used instead of urlbase
+	UrlBases   string `json:"urlbases"`
+	Lb         string `json:"lb"`
+	LbWeights  string `json:"lb_weights"`
+	LbMaxFails int    `json:"lb_max_fails"`
+	LbFailTime int    `json:"lb_fail_time"`
+	LbStatus   string `json:"lb_status"`
+	lb         *Balancer
+	lbStatus   map[int]bool
+
+	//HTTP method, url placeholders and query string fields
+	Method      string `json:"method"`
+	Query       string `json:"query"`
+	methodBody  bool   //Is request body sent with method
+	urlTpl      bool   //Url contains placeholders
+	queryParams []QueryParam
+
+	//Connection pooling
+	KeepAlive       bool   `json:"keepalive"`
+	Transport       string `json:"transport"`
+	MaxIdleConns    int    `json:"max_idle_conns"`
+	MaxIdlePerHost  int    `json:"max_idle_per_host"`
+	MaxConnsPerHost int    `json:"max_conns_per_host"`
+	IdleTimeout     int    `json:"idle_timeout"`
+	HTTP2           bool   `json:"http2"`
+
+	//Pooled client, nil if keepalive off
+	client *http.Client
+
+	//TLS client settings
+	TLSCertFile   string `json:"tls_cert_file"`
+	TLSKeyFile    string `json:"tls_key_file"`
+	TLSCARoots    string `json:"tls_ca_roots"`
+	TLSServerName string `json:"tls_server_name"`
+	TLSMinVersion string `json:"tls_min_version"`
+	TLSPins       string `json:"tls_pins"`
+
+	tlsConfig *tls.Config
+
+	//Outbound proxy
+	Proxy         string `json:"proxy"`
+	ProxyUser     string `json:"proxy_user"`
+	ProxyPassword string `json:"proxy_password"`
+	NoProxy       string `json:"no_proxy"`
+
+	proxyFunc func(*http.Request) (*url.URL, error)
+	proxyKey  string
+
+	//OAuth2 client credentials
+	OAuth2TokenUrl     string `json:"oauth2_token_url"`
+	OAuth2ClientId     string `json:"oauth2_client_id"`
+	OAuth2ClientSecret string `json:"oauth2_client_secret"`
+	OAuth2Scopes       string `json:"oauth2_scopes"`
+	OAuth2Audience     string `json:"oauth2_audience"`
+	OAuth2Auth         string `json:"oauth2_auth"`
+	OAuth2Skew         int    `json:"oauth2_skew"`
+
+	oauth2 *OAuth2Token
+
+	//Retry policy, backoff in milliseconds
+	RetryAttempts   int    `json:"retry_attempts"`
+	RetryBackoff    int    `json:"retry_backoff"`
+	RetryBackoffMax int    `json:"retry_backoff_max"`
+	RetryStatus     string `json:"retry_status"`
+	RetryErrors     string `json:"retry_errors"`
+	RetryMethods    string `json:"retry_methods"`
+	IdempotencyKey  string `json:"idempotency_key"`
+
+	retryStatus  map[int]bool
+	retryErrors  map[string]bool
+	retryMethods map[string]bool
+
+	//Circuit breaker
+	Breaker         bool   `json:"breaker"`
+	BreakerMode     string `json:"breaker_mode"`
+	BreakerFails    int    `json:"breaker_fails"`
+	BreakerErrRate  int    `json:"breaker_err_rate"`
+	BreakerWindow   int    `json:"breaker_window"`
+	BreakerOpenTime int    `json:"breaker_open_time"`
+	BreakerProbes   int    `json:"breaker_probes"`
+	BreakerStatus   string `json:"breaker_status"`
+
+	breaker       *Breaker
+	breakerStatus map[int]bool
+
+	//Request signing
+	Sign            string `json:"sign"`
+	SignKeyFile     string `json:"sign_key_file"`
+	SignKeyId       string `json:"sign_key_id"`
+	SignHeader      string `json:"sign_header"`
+	SignTsHeader    string `json:"sign_ts_header"`
+	SignKeyIdHeader string `json:"sign_key_id_header"`
+	SignEncoding    string `json:"sign_encoding"`
+	SignRegion      string `json:"sign_region"`
+	SignService     string `json:"sign_service"`
+
+	signer Signer
+
 	Timeout int `json:"timeout"`
 
 	Errors string `json:"errors"`
@@ -168,6 +302,8 @@ type ServiceMap struct {
 
 	echoIsAdvertised bool //Are we advertised?
 
+	echoDown bool //Echo service reports remote down
+
 	DependsOn string `json:"depends_on"`
 
 	//Wait for shutdown message
@@ -232,6 +368,9 @@ func remapErrors(ac *atmi.ATMICtx, svc *ServiceMap) error {
 	case "json2view":
 		svc.Errors_int = ERRORS_JSON2VIEW
 		break
+	case "ext":
+		svc.Errors_int = ERRORS_EXT
+		break
 	default:
 		return fmt.Errorf("Unsupported error type [%s]", svc.Errors)
 	}
@@ -301,8 +440,9 @@ func parseHTTPErrorMap(ac *atmi.ATMICtx, svc *ServiceMap) error {
 
 //Print the summary of the service after init
 func printSvcSummary(ac *atmi.ATMICtx, svc *ServiceMap) {
-	ac.TpLogWarn("Service: [%s], Url: [%s], Errors:%d (%s), Echo %t",
+	ac.TpLogWarn("Service: [%s], Method: [%s], Url: [%s], Errors:%d (%s), Echo %t",
 		svc.Svc,
+		svc.Method,
 		svc.Url,
 		svc.Errors_int,
 		svc.Errors,
@@ -327,6 +467,39 @@ func appinit(ctx *atmi.ATMICtx) int {
 	Mdefaults.Errfmt_json_code = ERRFMT_JSON_CODE_DEFAULT
 	Mdefaults.Errfmt_json_onsucc = ERRFMT_JSON_ONSUCC_DEFAULT
 	Mdefaults.Errfmt_text = ERRFMT_TEXT_DEFAULT
+	Mdefaults.Method = METHOD_DEFAULT
+	Mdefaults.KeepAlive = KEEPALIVE_DEFAULT
+	Mdefaults.Transport = TRANSPORT_DEFAULT
+	Mdefaults.MaxIdleConns = MAX_IDLE_CONNS_DEFAULT
+	Mdefaults.MaxIdlePerHost = MAX_IDLE_PER_HOST_DEFAULT
+	Mdefaults.MaxConnsPerHost = MAX_CONNS_PER_HOST_DEFAULT
+	Mdefaults.IdleTimeout = IDLE_TIMEOUT_DEFAULT
+	Mdefaults.HTTP2 = HTTP2_DEFAULT
+	Mdefaults.OAuth2Auth = OAUTH2_AUTH_DEFAULT
+	Mdefaults.OAuth2Skew = OAUTH2_SKEW_DEFAULT
+	Mdefaults.RetryAttempts = RETRY_ATTEMPTS_DEFAULT
+	Mdefaults.RetryBackoff = RETRY_BACKOFF_DEFAULT
+	Mdefaults.RetryBackoffMax = RETRY_BACKOFF_MAX_DEFAULT
+	Mdefaults.RetryStatus = RETRY_STATUS_DEFAULT
+	Mdefaults.RetryErrors = RETRY_ERRORS_DEFAULT
+	Mdefaults.RetryMethods = RETRY_METHODS_DEFAULT
+	Mdefaults.Breaker = BREAKER_DEFAULT
+	Mdefaults.BreakerMode = BREAKER_MODE_DEFAULT
+	Mdefaults.BreakerFails = BREAKER_FAILS_DEFAULT
+	Mdefaults.BreakerErrRate = BREAKER_ERR_RATE_DEFAULT
+	Mdefaults.BreakerWindow = BREAKER_WINDOW_DEFAULT
+	Mdefaults.BreakerOpenTime = BREAKER_OPEN_TIME_DEFAULT
+	Mdefaults.BreakerProbes = BREAKER_PROBES_DEFAULT
+	Mdefaults.BreakerStatus = BREAKER_STATUS_DEFAULT
+	Mdefaults.Lb = LB_DEFAULT
+	Mdefaults.LbMaxFails = LB_MAX_FAILS_DEFAULT
+	Mdefaults.LbFailTime = LB_FAIL_TIME_DEFAULT
+	Mdefaults.LbStatus = LB_STATUS_DEFAULT
+	Mdefaults.SignHeader = SIGN_HEADER_DEFAULT
+	Mdefaults.SignTsHeader = SIGN_TS_HEADER_DEFAULT
+	Mdefaults.SignKeyIdHeader = SIGN_KEY_ID_HEADER_DEFAULT
+	Mdefaults.SignEncoding = SIGN_ENCODING_DEFAULT
+	Mdefaults.SignService = SIGN_SERVICE_DEFAULT
 
 	Mworkers = WORKERS_DEFAULT
 
@@ -502,6 +675,12 @@ func appinit(ctx *atmi.ATMICtx) int {
 			//or if echo not set, then auto advertise all
 			//http.HandleFunc(fldName, dispatchRequest)
 
+			if err := lbSetup(ctx, &tmp); nil != err {
+				ctx.TpLogError("Invalid endpoint settings: %s",
+					err.Error())
+				return FAIL
+			}
+
 			if strings.HasPrefix(tmp.Url, "/") {
 				//This is partial URL, so use base
 				tmp.Url = tmp.UrlBase + tmp.Url
@@ -515,6 +694,56 @@ func appinit(ctx *atmi.ATMICtx) int {
 					tmp.Url)
 			}
 
+			if err := urlTplSetup(ctx, &tmp); nil != err {
+				ctx.TpLogError("Invalid method/url settings: %s",
+					err.Error())
+				return FAIL
+			}
+
+			if err := transportValidate(&tmp); nil != err {
+				ctx.TpLogError("Invalid transport settings: %s",
+					err.Error())
+				return FAIL
+			}
+
+			if err := tlsSetup(ctx, &tmp); nil != err {
+				ctx.TpLogError("Invalid TLS settings: %s",
+					err.Error())
+				return FAIL
+			}
+
+			if err := proxySetup(ctx, &tmp); nil != err {
+				ctx.TpLogError("Invalid proxy settings: %s",
+					err.Error())
+				return FAIL
+			}
+
+			transportSetup(ctx, &tmp)
+
+			if err := oauth2Setup(ctx, &tmp); nil != err {
+				ctx.TpLogError("Invalid OAuth2 settings: %s",
+					err.Error())
+				return FAIL
+			}
+
+			if err := retrySetup(&tmp); nil != err {
+				ctx.TpLogError("Invalid retry settings: %s",
+					err.Error())
+				return FAIL
+			}
+
+			if err := breakerSetup(&tmp); nil != err {
+				ctx.TpLogError("Invalid breaker settings: %s",
+					err.Error())
+				return FAIL
+			}
+
+			if err := signSetup(ctx, &tmp); nil != err {
+				ctx.TpLogError("Invalid signing settings: %s",
+					err.Error())
+				return FAIL
+			}
+
 			if tmp.Echo {
 				tmp.echoConvInt = Mconvs[tmp.EchoConv]
 				if tmp.echoConvInt == 0 {
@@ -593,6 +822,7 @@ func appinit(ctx *atmi.ATMICtx) int {
 	}
 
 	haveEcho := false
+	haveBreaker := false
 	//Advertise services which are not dependent
 	for _, v := range Mservices {
 
@@ -600,6 +830,10 @@ func appinit(ctx *atmi.ATMICtx) int {
 			haveEcho = true
 		}
 
+		if nil != v.breaker && BREAKER_UNADVERTISE == v.BreakerMode {
+			haveBreaker = true
+		}
+
 		if v.DependsOn == "" || v.Echo {
 			//Advertize service
 			if errA := v.Advertise(ctx); nil != errA {
@@ -614,6 +848,7 @@ func appinit(ctx *atmi.ATMICtx) int {
 				ctx.TpLogInfo("Adding [%s] to [%s] as dependie",
 					v.Svc, echoSvc.Svc)
 				echoSvc.Dependies = append(echoSvc.Dependies, v)
+				v.echoDown = true
 			} else {
 				ctx.TpLogError("Invalid echo service "+
 					"('depends_on') [%s] for [%s]",
@@ -623,8 +858,9 @@ func appinit(ctx *atmi.ATMICtx) int {
 		}
 	}
 
-	if haveEcho {
-		ctx.TpLogWarn("Echo services present - installing periodic callback")
+	if haveEcho || haveBreaker {
+		ctx.TpLogWarn("Echo or breaker services present - installing " +
+			"periodic callback")
 		if err := ctx.TpExtAddPeriodCB(MScanTime, Periodic); err != nil {
 			ctx.TpLogError("Advertise failed %d: %s",
 				err.Code(), err.Message())
@@ -705,6 +941,8 @@ func unInit(ac *atmi.ATMICtx) {
 
 	deInitPoll(ac, &MoutXPool)
 
+	transportClose()
+
 	ac.TpLogInfo("Shutdown ok")
 
 }
@@ -0,0 +1,383 @@
+/**
+ * @brief Retry policy of outgoing calls - backoff, idempotency, deadline
+ *
+ * @file retry.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Network error classes which may be retried
+const (
+	RETRY_ERR_CONNECT = "connect" //Connection could not be established
+	RETRY_ERR_RESET   = "reset"   //Connection reset/closed by peer
+	RETRY_ERR_TIMEOUT = "timeout" //Attempt timed out (total deadline is never retried)
+)
+
+//Response body which releases the call deadline context on close
+type retryBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+//Close the body and release the context
+func (b *retryBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+//Parse comma separated list to the set
+//@param list comma separated values
+//@param upper convert values to upper case
+//@return set of values
+func retryParseSet(list string, upper bool) map[string]bool {
+
+	set := make(map[string]bool)
+
+	for _, v := range strings.Split(list, ",") {
+
+		v = strings.TrimSpace(v)
+
+		if upper {
+			v = strings.ToUpper(v)
+		}
+
+		if "" != v {
+			set[v] = true
+		}
+	}
+
+	return set
+}
+
+//Validate and prepare retry settings of the service
+//@param svc Service map
+//@return error in case of invalid config or nil
+func retrySetup(svc *ServiceMap) error {
+
+	if svc.RetryAttempts < 1 || svc.RetryBackoff < 0 ||
+		svc.RetryBackoffMax < svc.RetryBackoff {
+		return fmt.Errorf("Service [%s]: invalid retry_attempts %d (must be >=1), "+
+			"retry_backoff %d or retry_backoff_max %d (must be >= retry_backoff)",
+			svc.Svc, svc.RetryAttempts, svc.RetryBackoff, svc.RetryBackoffMax)
+	}
+
+	svc.retryStatus = make(map[int]bool)
+
+	for code := range retryParseSet(svc.RetryStatus, false) {
+
+		status, err := strconv.Atoi(code)
+
+		if nil != err || status < 100 || status > 599 {
+			return fmt.Errorf("Service [%s]: invalid HTTP status [%s] "+
+				"in retry_status", svc.Svc, code)
+		}
+
+		svc.retryStatus[status] = true
+	}
+
+	svc.retryErrors = retryParseSet(svc.RetryErrors, false)
+
+	for class := range svc.retryErrors {
+		if RETRY_ERR_CONNECT != class && RETRY_ERR_RESET != class &&
+			RETRY_ERR_TIMEOUT != class {
+			return fmt.Errorf("Service [%s]: invalid error class [%s] in "+
+				"retry_errors, must be '%s', '%s' or '%s'", svc.Svc, class,
+				RETRY_ERR_CONNECT, RETRY_ERR_RESET, RETRY_ERR_TIMEOUT)
+		}
+	}
+
+	svc.retryMethods = retryParseSet(svc.RetryMethods, true)
+
+	return nil
+}
+
+//Get network error class of the failed attempt
+//@param err error returned by client
+//@return error class or empty string if not classified
+func retryErrClass(err error) string {
+
+	var opErr *net.OpError
+
+	if errors.As(err, &opErr) && "dial" == opErr.Op {
+		return RETRY_ERR_CONNECT
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return RETRY_ERR_CONNECT
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return RETRY_ERR_RESET
+	}
+
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return RETRY_ERR_TIMEOUT
+	}
+
+	return ""
+}
+
+//Calculate delay before next attempt: exponential backoff, capped by
+//retry_backoff_max, with random jitter of up to half of the delay
+//@param svc Service map
+//@param attempt number of attempt done (1..)
+//@return delay
+func retryDelay(svc *ServiceMap, attempt int) time.Duration {
+
+	delay := int64(svc.RetryBackoff)
+
+	for i := 1; i < attempt && delay < int64(svc.RetryBackoffMax); i++ {
+		delay *= 2
+	}
+
+	if delay > int64(svc.RetryBackoffMax) {
+		delay = int64(svc.RetryBackoffMax)
+	}
+
+	if delay > 1 {
+		delay = delay/2 + mrand.Int63n(delay/2+1)
+	}
+
+	return time.Millisecond * time.Duration(delay)
+}
+
+//Generate random idempotency key (UUID v4 format)
+//@return key
+func retryNewKey() string {
+
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+//Sign and send request once (with OAuth2 token refresh on 401)
+//@param ac ATMI Context
+//@param svc Service map
+//@param client HTTP client
+//@param req HTTP request
+//@return response, error
+func retryAttempt(ac *atmi.ATMICtx, svc *ServiceMap, client *http.Client,
+	req *http.Request) (*http.Response, error) {
+
+	//Signed per attempt, as url and time may change
+	if err := signRequest(ac, svc, req); nil != err {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+
+	//Token may be revoked before expiry - refresh once
+	if nil == err && http.StatusUnauthorized == resp.StatusCode &&
+		nil != svc.oauth2 {
+		resp, err = oauth2Retry(ac, svc, client, req, resp)
+	}
+
+	return resp, err
+}
+
+//Send the request, repeating it according to service retry policy. Retries
+//are done for idempotent methods only, or if idempotency key header is
+//generated. With multiple endpoints, connection errors fail over to the next
+//endpoint. All attempts and delays are bound by the service timeout.
+//@param ac ATMI Context
+//@param svc Service map
+//@param client HTTP client
+//@param req HTTP request
+//@return response, error
+func retryDo(ac *atmi.ATMICtx, svc *ServiceMap, client *http.Client,
+	req *http.Request) (*http.Response, error) {
+
+	canRetry := svc.RetryAttempts > 1
+
+	if canRetry && "" != svc.IdempotencyKey {
+
+		if "" == req.Header.Get(svc.IdempotencyKey) {
+			req.Header.Set(svc.IdempotencyKey, retryNewKey())
+		}
+	} else if canRetry && !svc.retryMethods[req.Method] {
+		ac.TpLogDebug("Method %s is not idempotent - no retries", req.Method)
+		canRetry = false
+	}
+
+	if !canRetry && nil == svc.lb {
+		return retryAttempt(ac, svc, client, req)
+	}
+
+	var deadline time.Time
+	var ctx context.Context
+	var cancel context.CancelFunc
+
+	if svc.Timeout > 0 {
+		deadline = time.Now().Add(time.Second * time.Duration(svc.Timeout))
+		ctx, cancel = context.WithDeadline(context.Background(), deadline)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	req = req.WithContext(ctx)
+
+	//Request url part after the base, for routing to endpoints
+	var tried []bool
+	rest := ""
+
+	if nil != svc.lb {
+		tried = make([]bool, len(svc.lb.endpoints))
+		rest = strings.TrimPrefix(req.URL.String(), svc.UrlBase)
+	}
+
+	sent := false
+
+	for attempt := 1; ; {
+
+		if sent && nil != req.GetBody {
+
+			body, err := req.GetBody()
+
+			if nil != err {
+				cancel()
+				return nil, err
+			}
+
+			req.Body = body
+		}
+
+		ep := -1
+
+		if nil != svc.lb {
+
+			ep = svc.lb.pick(svc, tried)
+			tried[ep] = true
+
+			if err := svc.lb.endpoints[ep].route(req, rest); nil != err {
+				cancel()
+				return nil, err
+			}
+
+			ac.TpLogInfo("Attempt %d to endpoint [%s]", attempt,
+				svc.lb.endpoints[ep].Base)
+		}
+
+		sent = true
+		resp, err := retryAttempt(ac, svc, client, req)
+
+		retry := false
+		reason := ""
+		class := ""
+
+		if nil != err {
+			class = retryErrClass(err)
+			retry = canRetry && nil == ctx.Err() && svc.retryErrors[class]
+			reason = fmt.Sprintf("error [%s] class [%s]", err.Error(), class)
+		} else {
+			retry = canRetry && svc.retryStatus[resp.StatusCode]
+			reason = "status " + resp.Status
+		}
+
+		if ep > -1 {
+
+			//Token endpoint failure says nothing about the endpoint
+			if !oauth2TokenFailed(err) {
+				svc.lb.record(ac, svc, ep,
+					nil == err && !svc.lbStatus[resp.StatusCode])
+			}
+
+			//Request was not sent, thus safe to send to other endpoint
+			if RETRY_ERR_CONNECT == class && nil == ctx.Err() &&
+				svc.lb.untried(tried) {
+				ac.TpLogWarn("Endpoint [%s] failed (%s) - failover",
+					svc.lb.endpoints[ep].Base, reason)
+				continue
+			}
+		}
+
+		if retry && attempt >= svc.RetryAttempts {
+			ac.TpLogError("Attempt %d/%d failed (%s) - no attempts left",
+				attempt, svc.RetryAttempts, reason)
+			retry = false
+		}
+
+		delay := retryDelay(svc, attempt)
+
+		if retry && !deadline.IsZero() && time.Now().Add(delay).After(deadline) {
+			ac.TpLogError("Attempt %d/%d failed (%s) - next attempt would "+
+				"exceed the deadline", attempt, svc.RetryAttempts, reason)
+			retry = false
+		}
+
+		if !retry {
+
+			if nil != err {
+				cancel()
+				return nil, err
+			}
+
+			resp.Body = &retryBody{ReadCloser: resp.Body, cancel: cancel}
+
+			return resp, nil
+		}
+
+		ac.TpLogWarn("Attempt %d/%d to [%s] failed (%s) - retry in %d ms",
+			attempt, svc.RetryAttempts, req.URL.String(), reason,
+			delay/time.Millisecond)
+
+		if nil != resp {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		time.Sleep(delay)
+		attempt++
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -330,6 +330,12 @@ func (s *ServiceMap) Monitor() {
 
 		select {
 		case <-wakeUp:
+
+			//Health of the individual endpoints
+			if nil != s.lb {
+				s.lb.echo(ac, s)
+			}
+
 			//Send echo (we will do tpcall, right?)
 			//We will support all types of the buffer formats!
 			//To Echo services....
@@ -385,6 +391,7 @@ func (s *ServiceMap) Monitor() {
 				ac.TpLogWarn("Scheduling services to advertise")
 
 				for _, ds := range s.Dependies {
+					ds.echoDown = false
 					if !ds.echoIsAdvertised && !ds.echoSchedAdv {
 						ac.TpLogWarn("Scheduling [%s] by "+
 							"[%s] to advertise!",
@@ -398,6 +405,7 @@ func (s *ServiceMap) Monitor() {
 				ac.TpLogWarn("Scheduling services to unadvertise")
 
 				for _, ds := range s.Dependies {
+					ds.echoDown = true
 					if ds.echoIsAdvertised && !ds.echoSchedUnAdv {
 						ac.TpLogWarn("Scheduling [%s] by "+
 							"[%s] to unadvertise!",
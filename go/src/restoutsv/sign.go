@@ -0,0 +1,323 @@
+/**
+ * @brief Request signing of outgoing calls - HMAC and AWS SigV4
+ *
+ * @file sign.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Request signer, applied to each attempt before sending
+type Signer interface {
+	//Sign the request
+	//@param req HTTP request, url is final
+	//@param body request body
+	//@param now signing time
+	//@return error or nil
+	Sign(req *http.Request, body []byte, now time.Time) error
+}
+
+//Signer constructors by 'sign' setting
+var Msigners = map[string]func(svc *ServiceMap, key []byte) (Signer, error){
+	"hmac":  newHMACSigner,
+	"sigv4": newSigV4Signer,
+}
+
+//HMAC-SHA256 signer. Signature is calculated over:
+//METHOD \n path?query \n timestamp \n body
+type HMACSigner struct {
+	key         []byte
+	keyId       string
+	header      string
+	tsHeader    string
+	keyIdHeader string
+	base64      bool
+}
+
+//Create HMAC signer
+//@param svc Service map
+//@param key secret key
+//@return signer, error
+func newHMACSigner(svc *ServiceMap, key []byte) (Signer, error) {
+
+	if "hex" != svc.SignEncoding && "base64" != svc.SignEncoding {
+		return nil, fmt.Errorf("invalid sign_encoding [%s], must be 'hex' "+
+			"or 'base64'", svc.SignEncoding)
+	}
+
+	if "" == svc.SignHeader || "" == svc.SignTsHeader {
+		return nil, fmt.Errorf("sign_header and sign_ts_header must be set")
+	}
+
+	return &HMACSigner{key: key, keyId: svc.SignKeyId, header: svc.SignHeader,
+		tsHeader: svc.SignTsHeader, keyIdHeader: svc.SignKeyIdHeader,
+		base64: "base64" == svc.SignEncoding}, nil
+}
+
+//Sign the request with HMAC-SHA256
+func (s *HMACSigner) Sign(req *http.Request, body []byte, now time.Time) error {
+
+	ts := strconv.FormatInt(now.Unix(), 10)
+
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(req.Method + "\n" + req.URL.RequestURI() + "\n" + ts + "\n"))
+	mac.Write(body)
+	sum := mac.Sum(nil)
+
+	req.Header.Set(s.tsHeader, ts)
+
+	if s.base64 {
+		req.Header.Set(s.header, base64.StdEncoding.EncodeToString(sum))
+	} else {
+		req.Header.Set(s.header, hex.EncodeToString(sum))
+	}
+
+	if "" != s.keyId && "" != s.keyIdHeader {
+		req.Header.Set(s.keyIdHeader, s.keyId)
+	}
+
+	return nil
+}
+
+//AWS Signature Version 4 signer (S3 compatible storage, unsigned headers
+//other than host, x-amz-content-sha256 and x-amz-date)
+type SigV4Signer struct {
+	accessKey string
+	secretKey []byte
+	region    string
+	service   string
+}
+
+//Create SigV4 signer
+//@param svc Service map
+//@param key secret access key
+//@return signer, error
+func newSigV4Signer(svc *ServiceMap, key []byte) (Signer, error) {
+
+	if "" == svc.SignKeyId || "" == svc.SignRegion || "" == svc.SignService {
+		return nil, fmt.Errorf("sign_key_id (access key), sign_region and " +
+			"sign_service must be set for sigv4")
+	}
+
+	if nil != svc.oauth2 {
+		return nil, fmt.Errorf("sigv4 cannot be used together with oauth2")
+	}
+
+	return &SigV4Signer{accessKey: svc.SignKeyId, secretKey: key,
+		region: svc.SignRegion, service: svc.SignService}, nil
+}
+
+//HMAC-SHA256 helper
+func sigV4HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+//URI encode by RFC 3986 (unreserved characters kept)
+func sigV4Escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+//Sign the request with AWS SigV4
+func (s *SigV4Signer) Sign(req *http.Request, body []byte, now time.Time) error {
+
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadSum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payloadSum[:])
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	//Canonical query string, sorted by encoded key, then by value
+	//(not as "k=v" strings, e.g. "a-b=" would go before "a=")
+	var pairs [][2]string
+
+	for k, vals := range req.URL.Query() {
+		for _, v := range vals {
+			pairs = append(pairs, [2]string{sigV4Escape(k), sigV4Escape(v)})
+		}
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+
+	query := make([]string, len(pairs))
+
+	for i, p := range pairs {
+		query[i] = p[0] + "=" + p[1]
+	}
+
+	path := req.URL.EscapedPath()
+
+	if "" == path {
+		path = "/"
+	}
+
+	host := req.Host
+
+	if "" == host {
+		host = req.URL.Host
+	}
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Join(query, "&"),
+		"host:" + host + "\n" +
+			"x-amz-content-sha256:" + payloadHash + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash}, "\n")
+
+	scope := date + "/" + s.region + "/" + s.service + "/aws4_request"
+	canonicalSum := sha256.Sum256([]byte(canonical))
+
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(canonicalSum[:])
+
+	key := sigV4HMAC(append([]byte("AWS4"), s.secretKey...), date)
+	key = sigV4HMAC(key, s.region)
+	key = sigV4HMAC(key, s.service)
+	key = sigV4HMAC(key, "aws4_request")
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+
+		s.accessKey+"/"+scope+", SignedHeaders="+signedHeaders+
+		", Signature="+hex.EncodeToString(sigV4HMAC(key, toSign)))
+
+	return nil
+}
+
+//Prepare request signer of the service
+//@param ac ATMI Context
+//@param svc Service map
+//@return error in case of invalid config or nil
+func signSetup(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if "" == svc.Sign {
+		return nil
+	}
+
+	newSigner := Msigners[svc.Sign]
+
+	if nil == newSigner {
+		return fmt.Errorf("Service [%s]: unsupported sign [%s]", svc.Svc, svc.Sign)
+	}
+
+	if "" == svc.SignKeyFile {
+		return fmt.Errorf("Service [%s]: sign_key_file must be set", svc.Svc)
+	}
+
+	key, err := ioutil.ReadFile(svc.SignKeyFile)
+
+	if nil != err {
+		return fmt.Errorf("Service [%s]: failed to read sign_key_file: %s",
+			svc.Svc, err.Error())
+	}
+
+	key = []byte(strings.TrimSpace(string(key)))
+
+	if 0 == len(key) {
+		return fmt.Errorf("Service [%s]: sign_key_file [%s] is empty",
+			svc.Svc, svc.SignKeyFile)
+	}
+
+	if svc.signer, err = newSigner(svc, key); nil != err {
+		return fmt.Errorf("Service [%s]: %s", svc.Svc, err.Error())
+	}
+
+	ac.TpLogInfo("Service [%s] requests are signed by [%s], key id [%s]",
+		svc.Svc, svc.Sign, svc.SignKeyId)
+
+	return nil
+}
+
+//Sign the request (if service uses signing)
+//@param ac ATMI Context
+//@param svc Service map
+//@param req HTTP request
+//@return error or nil
+func signRequest(ac *atmi.ATMICtx, svc *ServiceMap, req *http.Request) error {
+
+	if nil == svc.signer {
+		return nil
+	}
+
+	var body []byte
+
+	if nil != req.GetBody {
+
+		rd, err := req.GetBody()
+
+		if nil != err {
+			return err
+		}
+
+		body, err = ioutil.ReadAll(rd)
+		rd.Close()
+
+		if nil != err {
+			return err
+		}
+	}
+
+	if err := svc.signer.Sign(req, body, time.Now()); nil != err {
+		ac.TpLogError("Failed to sign request: %s", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,221 @@
+/**
+ * @brief TLS client settings of outgoing services - mTLS, CA roots, pinning
+ *
+ * @file tlsclient.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"exutil"
+	"fmt"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Loaded CA root pools by tls_ca_roots setting
+var MtlsRoots map[string]*x509.CertPool
+
+//Parse tls_min_version setting
+//@param ver version string (empty for default)
+//@return TLS version, error
+func tlsParseMinVersion(ver string) (uint16, error) {
+
+	switch ver {
+	case "":
+		return 0, nil
+	case "TLS10":
+		return tls.VersionTLS10, nil
+	case "TLS11":
+		return tls.VersionTLS11, nil
+	case "TLS12":
+		return tls.VersionTLS12, nil
+	case "TLS13":
+		return tls.VersionTLS13, nil
+	}
+
+	return 0, fmt.Errorf("Invalid tls_min_version [%s], "+
+		"expected: TLS10,TLS11,TLS12,TLS13", ver)
+}
+
+//Get SPKI pin of the certificate
+//@param cert certificate
+//@return base64 encoded SHA-256 of Subject Public Key Info
+func tlsSPKIPin(cert *x509.Certificate) string {
+
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+//Build peer certificate check for pinning. With verification on, connection
+//is accepted if any certificate of the verified chains matches any of the pins.
+//With sslinsecure nothing is verified, thus only the leaf is matched, as the
+//rest of the presented certificates could be anything the server sends.
+//@param svc service name
+//@param pins pinned SPKI hashes
+//@param insecure server certificate verification is off (sslinsecure)
+//@return verify function
+func tlsPinVerifier(svc string, pins map[string]bool,
+	insecure bool) func([][]byte, [][]*x509.Certificate) error {
+
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+
+		if insecure {
+
+			if len(rawCerts) > 0 {
+
+				cert, err := x509.ParseCertificate(rawCerts[0])
+
+				if nil == err && pins[tlsSPKIPin(cert)] {
+					return nil
+				}
+			}
+		} else {
+
+			for _, chain := range verifiedChains {
+				for _, cert := range chain {
+					if pins[tlsSPKIPin(cert)] {
+						return nil
+					}
+				}
+			}
+		}
+
+		//Called from worker goroutines, error is logged by the dispatcher
+		return fmt.Errorf("Service [%s]: server certificate does not "+
+			"match tls_pins", svc)
+	}
+}
+
+//Prepare TLS client config of the service: client certificate (mTLS),
+//CA roots, server name, min version and pinning.
+//@param ac ATMI Context
+//@param svc Service map
+//@return error in case of invalid config or nil
+func tlsSetup(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	cfg := &tls.Config{InsecureSkipVerify: svc.SSLInsecure,
+		ServerName: svc.TLSServerName}
+
+	if ("" == svc.TLSCertFile) != ("" == svc.TLSKeyFile) {
+		return fmt.Errorf("Service [%s]: TLS client certificate must have "+
+			"settings: tls_cert_file and tls_key_file (one is missing)", svc.Svc)
+	}
+
+	if "" != svc.TLSCertFile {
+
+		cert, err := tls.LoadX509KeyPair(svc.TLSCertFile, svc.TLSKeyFile)
+
+		if nil != err {
+			return fmt.Errorf("Service [%s]: failed to load TLS client "+
+				"certificate: %s", svc.Svc, err.Error())
+		}
+
+		cfg.Certificates = []tls.Certificate{cert}
+		ac.TpLogInfo("Service [%s] uses client certificate [%s]",
+			svc.Svc, svc.TLSCertFile)
+	}
+
+	if "" != svc.TLSCARoots {
+
+		if nil == MtlsRoots {
+			MtlsRoots = make(map[string]*x509.CertPool)
+		}
+
+		//LoadRootCAs() builds new pool on each call
+		if nil == MtlsRoots[svc.TLSCARoots] {
+
+			if err := exutil.LoadRootCAs(ac, svc.TLSCARoots); nil != err {
+				return fmt.Errorf("Service [%s]: %s", svc.Svc, err.Error())
+			}
+
+			MtlsRoots[svc.TLSCARoots] = exutil.MRootCAs
+		}
+
+		cfg.RootCAs = MtlsRoots[svc.TLSCARoots]
+	}
+
+	ver, err := tlsParseMinVersion(svc.TLSMinVersion)
+
+	if nil != err {
+		return fmt.Errorf("Service [%s]: %s", svc.Svc, err.Error())
+	}
+
+	cfg.MinVersion = ver
+
+	if "" != strings.TrimSpace(svc.TLSPins) {
+
+		pins := make(map[string]bool)
+
+		for _, p := range strings.Split(svc.TLSPins, ",") {
+
+			//Accept HPKP style "sha256/<base64>" too
+			p = strings.TrimPrefix(strings.TrimSpace(p), "sha256/")
+
+			if raw, err := base64.StdEncoding.DecodeString(p); nil != err ||
+				sha256.Size != len(raw) {
+				return fmt.Errorf("Service [%s]: invalid tls_pins entry [%s], "+
+					"expected base64 SHA-256 of SPKI", svc.Svc, p)
+			}
+
+			pins[p] = true
+		}
+
+		cfg.VerifyPeerCertificate = tlsPinVerifier(svc.Svc, pins,
+			svc.SSLInsecure)
+		ac.TpLogInfo("Service [%s] server keys pinned: %d", svc.Svc, len(pins))
+	}
+
+	if svc.SSLInsecure {
+		ac.TpLogWarn("Service [%s] - server certificate verification is OFF "+
+			"(sslinsecure)", svc.Svc)
+	}
+
+	svc.tlsConfig = cfg
+
+	return nil
+}
+
+//TLS settings key part for sharing the transports
+//@param svc Service map
+//@return key
+func tlsKey(svc *ServiceMap) string {
+
+	return fmt.Sprintf("%t|%s|%s|%s|%s|%s|%s", svc.SSLInsecure, svc.TLSCertFile,
+		svc.TLSKeyFile, svc.TLSCARoots, svc.TLSServerName, svc.TLSMinVersion,
+		svc.TLSPins)
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,171 @@
+/**
+ * @brief Pooled keep-alive HTTP transports of outgoing services
+ *
+ * @file transport.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Transport sharing scopes
+const (
+	TRANSPORT_HOST    = "host"    //Shared by services with same target host & settings
+	TRANSPORT_SERVICE = "service" //Own transport per service
+)
+
+//Pooled transports by key
+var Mtransports map[string]*http.Transport
+
+//Validate transport settings of the service
+//@param svc Service map
+//@return error in case of invalid config or nil
+func transportValidate(svc *ServiceMap) error {
+
+	if TRANSPORT_HOST != svc.Transport && TRANSPORT_SERVICE != svc.Transport {
+		return fmt.Errorf("Invalid 'transport' [%s] for service [%s], must be "+
+			"'%s' or '%s'", svc.Transport, svc.Svc, TRANSPORT_HOST, TRANSPORT_SERVICE)
+	}
+
+	if svc.MaxIdleConns < 0 || svc.MaxIdlePerHost < 0 ||
+		svc.MaxConnsPerHost < 0 || svc.IdleTimeout < 0 {
+		return fmt.Errorf("Invalid connection pool settings for service [%s], "+
+			"values must be >=0", svc.Svc)
+	}
+
+	return nil
+}
+
+//Build the transport key. Services sharing a host get the same transport
+//only if their connection settings match.
+//@param svc Service map
+//@return transport key
+func transportKey(svc *ServiceMap) string {
+
+	if TRANSPORT_SERVICE == svc.Transport {
+		return "svc:" + svc.Svc
+	}
+
+	host := svc.Url
+
+	if u, err := url.Parse(svc.Url); nil == err && "" != u.Host {
+		host = u.Scheme + "://" + u.Host
+	}
+
+	return fmt.Sprintf("host:%s|%s|%d|%d|%d|%d|%t|%s", host, tlsKey(svc),
+		svc.MaxIdleConns, svc.MaxIdlePerHost, svc.MaxConnsPerHost,
+		svc.IdleTimeout, svc.HTTP2, svc.proxyKey)
+}
+
+//Create new HTTP transport according to service settings
+//@param svc Service map
+//@return transport
+func newTransport(svc *ServiceMap) *http.Transport {
+
+	if !svc.KeepAlive {
+		//Connection per request
+		return &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig:   svc.tlsConfig,
+			Proxy:             svc.proxyFunc,
+		}
+	}
+
+	return &http.Transport{
+		TLSClientConfig:     svc.tlsConfig,
+		Proxy:               svc.proxyFunc,
+		MaxIdleConns:        svc.MaxIdleConns,
+		MaxIdleConnsPerHost: svc.MaxIdlePerHost,
+		MaxConnsPerHost:     svc.MaxConnsPerHost,
+		IdleConnTimeout:     time.Second * time.Duration(svc.IdleTimeout),
+		ForceAttemptHTTP2:   svc.HTTP2,
+	}
+}
+
+//Setup the pooled HTTP client of the service
+//@param ac ATMI Context
+//@param svc Service map
+func transportSetup(ac *atmi.ATMICtx, svc *ServiceMap) {
+
+	if !svc.KeepAlive {
+		ac.TpLogInfo("Service [%s] keepalive off - connection per request",
+			svc.Svc)
+		return
+	}
+
+	if nil == Mtransports {
+		Mtransports = make(map[string]*http.Transport)
+	}
+
+	key := transportKey(svc)
+	tr := Mtransports[key]
+
+	if nil == tr {
+		ac.TpLogInfo("New HTTP transport [%s]", key)
+		tr = newTransport(svc)
+		Mtransports[key] = tr
+	}
+
+	ac.TpLogInfo("Service [%s] uses pooled transport [%s]", svc.Svc, key)
+
+	svc.client = &http.Client{
+		Timeout:   time.Second * time.Duration(svc.Timeout),
+		Transport: tr}
+}
+
+//Get HTTP client for the request
+//@param svc Service map
+//@return pooled client or new client with own transport (keepalive off)
+func transportClient(svc *ServiceMap) *http.Client {
+
+	if nil != svc.client {
+		return svc.client
+	}
+
+	return &http.Client{
+		Timeout:   time.Second * time.Duration(svc.Timeout),
+		Transport: newTransport(svc)}
+}
+
+//Close idle connections of pooled transports
+func transportClose() {
+
+	for _, tr := range Mtransports {
+		tr.CloseIdleConnections()
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,373 @@
+/**
+ * @brief HTTP method, URL templates and query string mapping of outgoing requests
+ *
+ * @file urltemplate.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//HTTP methods supported for outgoing requests
+var Mmethods = map[string]bool{
+	"GET":     false, //No body sent
+	"HEAD":    false,
+	"POST":    true, //Body is sent
+	"PUT":     true,
+	"PATCH":   true,
+	"DELETE":  true,
+	"OPTIONS": true,
+}
+
+//URL template placeholder: {name} or {path.to.value}
+var MurlTplRegexp = regexp.MustCompile("{([^{}]*)}")
+
+//Query string parameter loaded from the request buffer
+type QueryParam struct {
+	Name string   //Query parameter name
+	Path []string //Path in the buffer (field/member name or JSON path)
+}
+
+//Split the buffer path in elements
+//@param path dot separated path
+//@return path elements or nil if path invalid
+func bufPathSplit(path string) []string {
+
+	elms := strings.Split(strings.TrimSpace(path), ".")
+
+	for _, e := range elms {
+		if "" == e {
+			return nil
+		}
+	}
+
+	return elms
+}
+
+//Prepare the method, URL template and query parameters of the service
+//@param ac ATMI Context
+//@param svc Service map
+//@return error in case of invalid config or nil
+func urlTplSetup(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	svc.Method = strings.ToUpper(strings.TrimSpace(svc.Method))
+
+	if "" == svc.Method {
+		svc.Method = METHOD_DEFAULT
+	}
+
+	withBody, ok := Mmethods[svc.Method]
+
+	if !ok {
+		return fmt.Errorf("Unsupported 'method' [%s] for service [%s]",
+			svc.Method, svc.Svc)
+	}
+
+	svc.methodBody = withBody
+
+	for _, m := range MurlTplRegexp.FindAllStringSubmatch(svc.Url, -1) {
+
+		if nil == bufPathSplit(m[1]) {
+			return fmt.Errorf("Invalid URL placeholder [%s] for service [%s]",
+				m[0], svc.Svc)
+		}
+
+		svc.urlTpl = true
+	}
+
+	svc.queryParams = nil
+
+	if "" != strings.TrimSpace(svc.Query) {
+
+		for _, p := range strings.Split(svc.Query, ",") {
+
+			var qp QueryParam
+
+			//Either <param>=<path> or <path> (param named by last element)
+			pair := strings.SplitN(p, "=", 2)
+
+			if 2 == len(pair) {
+				qp.Name = strings.TrimSpace(pair[0])
+				qp.Path = bufPathSplit(pair[1])
+			} else {
+				qp.Path = bufPathSplit(pair[0])
+
+				if nil != qp.Path {
+					qp.Name = qp.Path[len(qp.Path)-1]
+				}
+			}
+
+			if "" == qp.Name || nil == qp.Path {
+				return fmt.Errorf("Invalid 'query' entry [%s] for service [%s]",
+					p, svc.Svc)
+			}
+
+			svc.queryParams = append(svc.queryParams, qp)
+		}
+	}
+
+	ac.TpLogInfo("Service [%s] method [%s] url template: %t query params: %d",
+		svc.Svc, svc.Method, svc.urlTpl, len(svc.queryParams))
+
+	return nil
+}
+
+//Locate value in decoded buffer JSON
+//@param doc decoded JSON document
+//@param path path elements, numbers index arrays
+//@return value and true if found
+func bufPathGet(doc interface{}, path []string) (interface{}, bool) {
+
+	cur := doc
+
+	for _, e := range path {
+
+		switch v := cur.(type) {
+		case map[string]interface{}:
+			next, ok := v[e]
+			if !ok {
+				return nil, false
+			}
+			cur = next
+		case []interface{}:
+			idx, err := strconv.Atoi(e)
+			if nil != err || idx < 0 || idx >= len(v) {
+				return nil, false
+			}
+			cur = v[idx]
+		default:
+			return nil, false
+		}
+	}
+
+	return cur, true
+}
+
+//Remove the value from the decoded buffer JSON. Only object keys are removed.
+//@param doc decoded JSON document
+//@param path path elements
+func bufPathDel(doc interface{}, path []string) {
+
+	parent, ok := bufPathGet(doc, path[:len(path)-1])
+
+	if !ok {
+		return
+	}
+
+	if m, ok := parent.(map[string]interface{}); ok {
+		delete(m, path[len(path)-1])
+	}
+}
+
+//Convert JSON value to string for URL
+//@param v JSON value
+//@return string value, error if value is not a scalar
+func bufValueString(v interface{}) (string, error) {
+
+	switch val := v.(type) {
+	case string:
+		return val, nil
+	case json.Number:
+		return val.String(), nil
+	case bool:
+		return strconv.FormatBool(val), nil
+	case nil:
+		return "", nil
+	}
+
+	return "", fmt.Errorf("value is not a scalar")
+}
+
+//Resolve the values of the path. Arrays (e.g. UBF occurrences) give all values.
+//@param doc decoded JSON document
+//@param path path elements
+//@return values, found flag, error
+func bufPathValues(doc interface{}, path []string) ([]string, bool, error) {
+
+	v, ok := bufPathGet(doc, path)
+
+	if !ok {
+		return nil, false, nil
+	}
+
+	var ret []string
+
+	arr, isArr := v.([]interface{})
+
+	if !isArr {
+		arr = []interface{}{v}
+	}
+
+	for _, e := range arr {
+
+		s, err := bufValueString(e)
+
+		if nil != err {
+			return nil, true, err
+		}
+
+		ret = append(ret, s)
+	}
+
+	return ret, true, nil
+}
+
+//Build the request URL and body. URL placeholders are filled from the buffer,
+//query parameters are moved from the body to the URL query string. Paths
+//are resolved as: UBF - field name, VIEW - member name, JSON - dot separated path.
+//@param ac ATMI Context
+//@param svc Service map
+//@param buftype XATMI buffer type
+//@param content body converted from the buffer
+//@return URL, body to send, error
+func urlTplBuild(ac *atmi.ATMICtx, svc *ServiceMap, buftype string,
+	content []byte) (string, []byte, error) {
+
+	reqUrl := svc.Url
+
+	if !svc.urlTpl && 0 == len(svc.queryParams) {
+		return reqUrl, content, nil
+	}
+
+	var doc interface{}
+
+	switch buftype {
+	case "UBF", "UBF32", "FML", "FML32", "JSON", "VIEW", "VIEW32":
+		break
+	default:
+		return "", nil, fmt.Errorf("URL template/query params are not "+
+			"supported for %s buffer", buftype)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&doc); nil != err {
+		return "", nil, fmt.Errorf("Failed to parse request JSON: %s", err.Error())
+	}
+
+	root := doc
+
+	//VIEW JSON is {"<VIEW_NAME>":{<members>}}
+	if "VIEW" == buftype || "VIEW32" == buftype {
+		if m, ok := doc.(map[string]interface{}); ok {
+			for _, v := range m {
+				root = v
+			}
+		}
+	}
+
+	var errT error
+
+	reqUrl = MurlTplRegexp.ReplaceAllStringFunc(reqUrl, func(m string) string {
+
+		path := bufPathSplit(m[1 : len(m)-1])
+		vals, found, err := bufPathValues(root, path)
+
+		if nil == errT {
+			if nil != err {
+				errT = fmt.Errorf("URL placeholder %s: %s", m, err.Error())
+			} else if !found || 0 == len(vals) {
+				errT = fmt.Errorf("URL placeholder %s not found in buffer", m)
+			}
+		}
+
+		if nil != errT {
+			return ""
+		}
+
+		return url.PathEscape(vals[0])
+	})
+
+	if nil != errT {
+		return "", nil, errT
+	}
+
+	if len(svc.queryParams) > 0 {
+
+		query := url.Values{}
+
+		for _, qp := range svc.queryParams {
+
+			vals, found, err := bufPathValues(root, qp.Path)
+
+			if nil != err {
+				return "", nil, fmt.Errorf("Query parameter [%s]: %s",
+					qp.Name, err.Error())
+			}
+
+			if !found {
+				ac.TpLogDebug("Query parameter [%s] not in buffer - skip", qp.Name)
+				continue
+			}
+
+			for _, v := range vals {
+				query.Add(qp.Name, v)
+			}
+
+			bufPathDel(root, qp.Path)
+		}
+
+		if len(query) > 0 {
+			if strings.Contains(reqUrl, "?") {
+				reqUrl += "&" + query.Encode()
+			} else {
+				reqUrl += "?" + query.Encode()
+			}
+		}
+
+		//Encode the body without the query fields
+		var out bytes.Buffer
+		encoder := json.NewEncoder(&out)
+		encoder.SetEscapeHTML(false)
+
+		if err := encoder.Encode(doc); nil != err {
+			return "", nil, fmt.Errorf("Failed to build request JSON: %s",
+				err.Error())
+		}
+
+		content = bytes.TrimRight(out.Bytes(), "\n")
+	}
+
+	ac.TpLogDebug("Request URL built: [%s]", reqUrl)
+
+	return reqUrl, content, nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -65,9 +65,11 @@ cd conf
 
 # Remove certificate files
 rm localhost* 2>/dev/null
+rm sni.example.com* 2>/dev/null
 
 # Generate new ceritificate
 ./gencert.sh localhost 
+./gencert.sh sni.example.com
 
 . settest1
 
@@ -79,6 +81,10 @@ unset NDRX_CCTAG
 xadmin down -y
 xadmin start -y
 
+# Slow upstream for reverse proxy tests
+testupstream localhost:9091 1000 &
+UPSTREAM_PID=$!
+
 # Let restin to start
 sleep 12
 
@@ -87,6 +93,7 @@ sleep 12
 #
 function go_out {
     echo "Test exiting with: $1"
+    kill $UPSTREAM_PID 2>/dev/null
     xadmin stop -y
     xadmin down -y
 
@@ -96,6 +103,581 @@ function go_out {
 
 
 
+###############################################################################
+echo "Filter decisions: skip remaining filters"
+###############################################################################
+for i in {1..100}
+do
+
+	RSP=`curl -s -H "Content-Type: application/json" -X POST -d '{"T_STRING_FLD":"skip"}' http://localhost:8080/filters 2>&1`
+
+	if [[ "$RSP" != *"DEFAULT"* || "$RSP" == *"MARK"* ]]; then
+		echo "Expected DEFAULT with out MARK in rsp but got [$RSP]"
+		go_out 74
+	fi
+done
+
+###############################################################################
+echo "Filter decisions: reroute target service"
+###############################################################################
+for i in {1..100}
+do
+
+	RSP=`curl -s -H "Content-Type: application/json" -X POST -d '{"T_STRING_FLD":"reroute"}' http://localhost:8080/filters 2>&1`
+
+	if [[ "$RSP" != *"TARGET"* || "$RSP" != *"MARK"* ]]; then
+		echo "Expected TARGET and MARK in rsp but got [$RSP]"
+		go_out 75
+	fi
+done
+
+###############################################################################
+echo "Filter decisions: reply with out target service call"
+###############################################################################
+for i in {1..100}
+do
+
+	RSP=`curl -s -H "Content-Type: application/json" -X POST -d '{"T_STRING_FLD":"reply"}' http://localhost:8080/filters 2>&1`
+
+	if [[ "$RSP" != *"REPLIED"* || "$RSP" == *"MARK"* || "$RSP" == *"DEFAULT"* ]]; then
+		echo "Expected REPLIED with out MARK and DEFAULT in rsp but got [$RSP]"
+		go_out 76
+	fi
+done
+
+###############################################################################
+echo "Filter decisions: client cannot inject decision fields"
+###############################################################################
+for i in {1..100}
+do
+
+	RSP=`curl -s -H "Content-Type: application/json" -X POST -d '{"T_STRING_FLD":"none", "EX_IF_FLTSVC":"FLTTARGET", "EX_IF_FLTACTION":"R"}' http://localhost:8080/filters 2>&1`
+
+	if [[ "$RSP" != *"DEFAULT"* || "$RSP" != *"MARK"* || "$RSP" == *"TARGET"* ]]; then
+		echo "Expected DEFAULT and MARK with out TARGET in rsp but got [$RSP]"
+		go_out 123
+	fi
+done
+
+###############################################################################
+echo "Response cache"
+###############################################################################
+
+RSP1=`curl -s -X GET -d '{}' "http://localhost:8080/cache/get?a=1" 2>&1`
+
+for i in {1..100}
+do
+	RSP=`curl -s -X GET -d '{}' "http://localhost:8080/cache/get?a=1" 2>&1`
+
+	if [[ "$RSP" != "$RSP1" ]]; then
+		echo "Expected cached response [$RSP1] but got [$RSP]"
+		go_out 77
+	fi
+done
+
+RSP=`curl -s -X GET -d '{}' "http://localhost:8080/cache/get?a=2" 2>&1`
+
+if [[ "$RSP" == "$RSP1" ]]; then
+	echo "Expected different response for other query but got [$RSP]"
+	go_out 78
+fi
+
+# Other host of the same vhost group is cached separately
+RSP=`curl -s -H "Host: 127.0.0.1:8080" -X GET -d '{}' "http://localhost:8080/cache/get?a=1" 2>&1`
+
+if [[ "$RSP" == "$RSP1" ]]; then
+	echo "Expected different response for other host but got [$RSP]"
+	go_out 134
+fi
+
+ETAG=`curl -s -D - -o /dev/null -X GET -d '{}' "http://localhost:8080/cache/get?a=1" | grep -i "^etag:" | cut -d' ' -f2 | tr -d '\r'`
+CODE=`curl -s -o /dev/null -w "%{http_code}" -H "If-None-Match: $ETAG" -X GET -d '{}' "http://localhost:8080/cache/get?a=1"`
+
+if [[ "X$CODE" != "X304" ]]; then
+	echo "Expected 304 for etag [$ETAG] but got [$CODE]"
+	go_out 79
+fi
+
+RSP=`curl -s -X POST "http://localhost:8080/admin/cache?url=/cache/get" 2>&1`
+
+if [[ "$RSP" != *"purged"* ]]; then
+	echo "Expected purge response but got [$RSP]"
+	go_out 80
+fi
+
+RSP=`curl -s -X GET -d '{}' "http://localhost:8080/cache/get?a=1" 2>&1`
+
+if [[ "$RSP" == "$RSP1" ]]; then
+	echo "Expected fresh response after purge but got [$RSP]"
+	go_out 81
+fi
+
+###############################################################################
+echo "Reverse proxy"
+###############################################################################
+for i in {1..100}
+do
+
+	RSP=`curl -s -H "Content-Type: application/json" -X POST -d '{"T_STRING_FLD":"PROXIED"}' http://localhost:8080/proxy/echo 2>&1`
+
+	if [[ "$RSP" != *"PROXIED"* ]]; then
+		echo "Expected PROXIED in rsp but got [$RSP]"
+		go_out 82
+	fi
+done
+
+CODE=`curl -s -o /dev/null -w "%{http_code}" -X POST -d '{}' http://localhost:8080/proxy/down`
+
+if [[ "X$CODE" != "X502" ]]; then
+	echo "Expected 502 for failed upstream but got [$CODE]"
+	go_out 83
+fi
+
+#Filter decisions of proxy route
+RSP=`curl -s -i -X POST -d 'DATA' "http://localhost:8080/proxy/flt?action=reply" 2>&1`
+
+if [[ "$RSP" != *"403"* || "$RSP" != *"DENIED"* ]]; then
+	echo "Expected 403 DENIED from proxy filter but got [$RSP]"
+	go_out 127
+fi
+
+RSP=`curl -s -X POST -d 'DATA' "http://localhost:8080/proxy/flt?action=reroute" 2>&1`
+
+if [[ "$RSP" != *"REROUTED DATA"* ]]; then
+	echo "Expected REROUTED DATA from proxy filter reroute but got [$RSP]"
+	go_out 128
+fi
+
+#Upstream calls hold the worker, thus parallel calls are limited by workers (10)
+PIDS=""
+for i in {1..25}
+do
+	curl -s -o /dev/null http://localhost:8080/proxy/slow/req$i &
+	PIDS="$PIDS $!"
+done
+
+wait $PIDS
+
+RSP=`curl -s http://localhost:9091/peak 2>&1`
+PEAK=${RSP#PEAK=}
+
+if [[ "$RSP" != "PEAK="* || $PEAK -gt 10 || $PEAK -lt 2 ]]; then
+	echo "Expected 2..10 parallel upstream calls but got [$RSP]"
+	go_out 136
+fi
+
+###############################################################################
+echo "XML conversion"
+###############################################################################
+for i in {1..100}
+do
+
+	RSP=`curl -s -H "Content-Type: application/xml" -X POST -d '<req><T_STRING_FLD>HELLO</T_STRING_FLD><T_STRING_FLD>W&amp;RLD</T_STRING_FLD></req>' http://localhost:8080/xml/echo 2>&1`
+
+	if [[ "$RSP" != *"<T_STRING_FLD>HELLO</T_STRING_FLD><T_STRING_FLD>W&amp;RLD</T_STRING_FLD>"*"<error_code>0</error_code>"* ]]; then
+		echo "Expected XML echo in rsp but got [$RSP]"
+		go_out 84
+	fi
+done
+
+RSP=`curl -s -H "Content-Type: application/xml" -X POST -d '<req><T_STRING_FLD>HELLO</req>' http://localhost:8080/xml/echo 2>&1`
+
+if [[ "$RSP" != *"<error_code>4</error_code>"* ]]; then
+	echo "Expected XML error 4 in rsp but got [$RSP]"
+	go_out 85
+fi
+
+###############################################################################
+echo "Query string and form parameters mapping"
+###############################################################################
+
+RSP=`curl -s "http://localhost:8080/params/ubf?T_STRING_FLD=HELLO&T_STRING_FLD=WORLD&T_LONG_FLD=77&UNKNOWN=1" 2>&1`
+
+if [[ "$RSP" != *'"T_LONG_FLD":77'* || "$RSP" != *'"T_STRING_FLD":["HELLO","WORLD"]'* ]]; then
+	echo "Expected query params in rsp but got [$RSP]"
+	go_out 86
+fi
+
+RSP=`curl -s -X POST -d 'tstring1=HELLO&tlong1=55' "http://localhost:8080/params/view?tshort1=3" 2>&1`
+
+if [[ "$RSP" != *'"REQUEST1"'* || "$RSP" != *'"tshort1":3'* || "$RSP" != *'"tlong1":55'* || "$RSP" != *'"tstring1":"HELLO"'* ]]; then
+	echo "Expected form params in view rsp but got [$RSP]"
+	go_out 87
+fi
+
+RSP=`curl -s -X POST -d 'T_LONG_FLD=ABC' http://localhost:8080/params/ubf 2>&1`
+
+if [[ "$RSP" == *'"error_code":0'* ]]; then
+	echo "Expected conversion error but got [$RSP]"
+	go_out 88
+fi
+
+RSP=`curl -s "http://localhost:8080/params/ubf?T_STRING_FLD=HELLO&EX_IF_CACHETTL=100&EX_IF_FLTSVC=FLTTARGET" 2>&1`
+
+if [[ "$RSP" != *'"T_STRING_FLD":"HELLO"'* || "$RSP" == *'EX_IF_CACHETTL'* || "$RSP" == *'EX_IF_FLTSVC'* ]]; then
+	echo "Expected reserved params to be ignored but got [$RSP]"
+	go_out 124
+fi
+
+###############################################################################
+echo "Binary UBF wire format"
+###############################################################################
+rm -f ubf_rsp.bin 2>/dev/null
+
+CODE=`curl -s -o ubf_rsp.bin -w "%{http_code}:%{content_type}" -H "Accept: application/x-ubf" -H "Content-Type: application/json" -X POST -d '{"T_STRING_FLD":"UBFWIRE","T_LONG_FLD":5}' http://localhost:8080/ubf/echo`
+
+if [[ "X$CODE" != "X200:application/x-ubf" ]]; then
+	echo "Expected UBF rsp but got [$CODE]"
+	go_out 89
+fi
+
+# Send the binary buffer back, get it as JSON
+RSP=`curl -s -H "Accept: application/json" -H "Content-Type: application/x-ubf" -X POST --data-binary @ubf_rsp.bin http://localhost:8080/ubf/echo 2>&1`
+
+if [[ "$RSP" != *'"T_STRING_FLD":"UBFWIRE"'* || "$RSP" != *'"T_LONG_FLD":5'* || "$RSP" != *'"error_code":0'* ]]; then
+	echo "Expected UBF request converted to JSON but got [$RSP]"
+	go_out 90
+fi
+
+CODE=`curl -s -o /dev/null -w "%{http_code}" -H "Content-Type: application/json" -X POST -d '{"T_STRING_FLD":"UBFWIRE"}' http://localhost:8080/ubf/only`
+
+if [[ "X$CODE" != "X415" ]]; then
+	echo "Expected 415 for JSON on UBF only route but got [$CODE]"
+	go_out 91
+fi
+
+CODE=`curl -s -o /dev/null -w "%{http_code}" -H "Content-Type:" -X POST -d '{"T_STRING_FLD":"UBFWIRE"}' http://localhost:8080/ubf/only`
+
+if [[ "X$CODE" != "X415" ]]; then
+	echo "Expected 415 for missing content type on UBF only route but got [$CODE]"
+	go_out 129
+fi
+
+# UBF request, but UBF response refused by q=0
+CODE=`curl -s -o /dev/null -w "%{http_code}:%{content_type}" -H "Accept: application/x-ubf;q=0, */*" -H "Content-Type: application/x-ubf" -X POST --data-binary @ubf_rsp.bin http://localhost:8080/ubf/echo`
+
+if [[ "X$CODE" != "X200:application/json" ]]; then
+	echo "Expected JSON rsp for refused UBF but got [$CODE]"
+	go_out 130
+fi
+
+CODE=`curl -s -o /dev/null -w "%{http_code}" -H "Accept: application/x-ubf;q=0" -H "Content-Type: application/x-ubf" -X POST --data-binary @ubf_rsp.bin http://localhost:8080/ubf/only`
+
+if [[ "X$CODE" != "X406" ]]; then
+	echo "Expected 406 for refused UBF on UBF only route but got [$CODE]"
+	go_out 131
+fi
+
+rm -f ubf_rsp.bin 2>/dev/null
+
+###############################################################################
+echo "Access log"
+###############################################################################
+
+RSP=`curl -s -H "Content-Type: application/json" -X POST -d '{"T_STRING_FLD":"LOG"}' "http://localhost:8080/echo?accesslogmark=1" 2>&1`
+
+sleep 1
+
+LINE=`grep 'accesslogmark=1' log/access.log`
+
+if [[ "$LINE" != *'"method":"POST"'* || "$LINE" != *'"route":"/echo"'* || "$LINE" != *'"status":200'* || "$LINE" != *'"tperrno":0'* || "$LINE" != *'"bytes_in":22'* ]]; then
+	echo "Expected access log record but got [$LINE]"
+	go_out 92
+fi
+
+CODE=`curl -s -o /dev/null -w "%{http_code}" http://localhost:8080/no/such/route/accesslogmark404`
+
+sleep 1
+
+if [[ "X`grep -c 'accesslogmark404.*"status":404' log/access.log`" != "X1" ]]; then
+	echo "Expected access log record for 404"
+	go_out 93
+fi
+
+# Service rerouted by filter is logged
+RSP=`curl -s -H "Content-Type: application/json" -X POST -d '{"T_STRING_FLD":"reroute"}' "http://localhost:8080/filters?accesslogreroute=1" 2>&1`
+
+sleep 1
+
+LINE=`grep 'accesslogreroute=1' log/access.log`
+
+if [[ "$LINE" != *'"svc":"FLTTARGET"'* ]]; then
+	echo "Expected rerouted service in access log but got [$LINE]"
+	go_out 132
+fi
+
+###############################################################################
+echo "W3C trace context"
+###############################################################################
+TRACEID=4bf92f3577b34da6a3ce929d0e0e4736
+
+RSP=`curl -s -i -H "traceparent: 00-$TRACEID-00f067aa0ba902b7-01" -H "tracestate: rojo=00f067aa0ba902b7" -X POST -d '{}' http://localhost:8080/trace 2>&1`
+
+if [[ "$RSP" != *"\"T_STRING_FLD\":\"00-$TRACEID-"* || "$RSP" == *"00f067aa0ba902b7-01\""* || "$RSP" != *'"T_STRING_2_FLD":"rojo=00f067aa0ba902b7"'* ]]; then
+	echo "Expected trace context in service but got [$RSP]"
+	go_out 94
+fi
+
+if ! echo "$RSP" | grep -i -q "^traceparent: 00-$TRACEID-"; then
+	echo "Expected traceparent in rsp headers but got [$RSP]"
+	go_out 95
+fi
+
+if [ ! -f log/$TRACEID.log ]; then
+	echo "Expected request log file log/$TRACEID.log"
+	go_out 96
+fi
+
+RSP=`curl -s -i -X POST -d '{}' http://localhost:8080/trace 2>&1`
+
+if ! echo "$RSP" | grep -E -i -q '^traceparent: 00-[0-9a-f]{32}-[0-9a-f]{16}-01'; then
+	echo "Expected new trace in rsp headers but got [$RSP]"
+	go_out 97
+fi
+
+#JSON payload is passed as is, trace context is in headers only
+REQ='{"z":1.50, "a":"x\u0041", "n":[1e2]}'
+RSP=`curl -s -D tmp/trace_json.hdr -H "traceparent: 00-$TRACEID-00f067aa0ba902b7-01" -H "tracestate: rojo=00f067aa0ba902b7" -X POST -d "$REQ" http://localhost:8080/trace/json 2>&1`
+
+if [[ "$RSP" != "$REQ" ]] || ! grep -i -q "^traceparent: 00-$TRACEID-" tmp/trace_json.hdr; then
+	echo "Expected unchanged JSON [$REQ] with trace headers but got [$RSP]"
+	go_out 125
+fi
+
+rm -f tmp/trace_json.hdr
+
+###############################################################################
+echo "Masking of data in logs"
+###############################################################################
+TRACEID=0af7651916cd43dd8448eb211c80319c
+
+RSP=`curl -s -H "traceparent: 00-$TRACEID-b7ad6b7169203331-01" -X POST -d '{"T_STRING_FLD":"CARD 4111111111111111","T_STRING_2_FLD":"SECRETPWD"}' "http://localhost:8080/mask?T_STRING_2_FLD=SECRETQ" 2>&1`
+
+if [[ "$RSP" != *"SECRETPWD"* ]]; then
+	echo "Expected unmasked response but got [$RSP]"
+	go_out 98
+fi
+
+if [ "X`grep -c 'CARD \*\*\*' log/$TRACEID.log`" == "X0" ]; then
+	echo "Expected masked data in log/$TRACEID.log"
+	go_out 99
+fi
+
+sleep 1
+
+if [ "X`cat log/$TRACEID.log log/access.log | grep -c -E 'SECRETPWD|SECRETQ|4111111111111111'`" != "X0" ]; then
+	echo "Unmasked data found in log/$TRACEID.log or access log"
+	go_out 100
+fi
+
+#Response cookie values
+TRACEID=0af7651916cd43dd8448eb211c80319d
+
+RSP=`curl -s -i -H "traceparent: 00-$TRACEID-b7ad6b7169203331-01" -X POST -d '{"T_STRING_FLD":"HEADER"}' "http://localhost:8080/mask/cookies" 2>&1`
+
+if [[ "$RSP" != *"RspCookie=qqqqqqqq"* ]]; then
+	echo "Expected unmasked response cookie but got [$RSP]"
+	go_out 137
+fi
+
+if [ "X`grep -c 'EX_IF_RSPCN' log/$TRACEID.log`" == "X0" ] || \
+	[ "X`grep -c 'qqqqqqqq' log/$TRACEID.log`" != "X0" ]; then
+	echo "Expected masked response cookie value in log/$TRACEID.log"
+	go_out 138
+fi
+
+###############################################################################
+echo "HTTP/2 cleartext (h2c) and metrics"
+###############################################################################
+
+VER=`curl -s --http2-prior-knowledge -o /dev/null -w "%{http_version}" -H "Content-Type: application/json" -X POST -d '{}' http://localhost:8080/echo`
+
+if [[ "X$VER" != "X2" ]]; then
+	echo "Expected HTTP/2 but got [$VER]"
+	go_out 101
+fi
+
+RSP=`curl -s http://localhost:8080/admin/metrics 2>&1`
+
+if [[ "$RSP" != *'"proto":"HTTP/2.0"'* || "$RSP" != *'"proto":"HTTP/1.1"'* || "$RSP" != *'"http2_max_streams":'* ]]; then
+	echo "Expected protocol metrics but got [$RSP]"
+	go_out 102
+fi
+
+###############################################################################
+echo "Virtual hosts"
+###############################################################################
+
+RSP=`curl -s -H "Host: api.partner.example.com:8080" http://localhost:8080/vhost 2>&1`
+
+if [[ "$RSP" != *"HOST:api.partner.example.com:8080;VHOST:partner"* ]]; then
+	echo "Expected partner group but got [$RSP]"
+	go_out 106
+fi
+
+RSP=`curl -s http://localhost:8080/vhost 2>&1`
+
+if [[ "$RSP" != *"HOST:localhost:8080;VHOST:default"* ]]; then
+	echo "Expected default group but got [$RSP]"
+	go_out 107
+fi
+
+# route exists only in default group
+CODE=`curl -s -o /dev/null -w "%{http_code}" -H "Host: partner.example.com" http://localhost:8080/ext_query 2>&1`
+
+if [[ "X$CODE" != "X404" ]]; then
+	echo "Expected 404 for route of other group but got [$CODE]"
+	go_out 108
+fi
+
+RSP=`curl -s -w "%{http_code}" -H "Host: unknown.example.com" http://localhost:8080/vhost 2>&1`
+
+if [[ "$RSP" != "Unknown host421" ]]; then
+	echo "Expected unknown host response but got [$RSP]"
+	go_out 109
+fi
+
+###############################################################################
+echo "Client IP access lists"
+###############################################################################
+
+CODE=`curl -s -o /dev/null -w "%{http_code}" -H "Content-Type: application/json" -X POST -d '{}' http://localhost:8080/ipacl/deny 2>&1`
+
+if [[ "X$CODE" != "X403" ]]; then
+	echo "Expected 403 for denied network but got [$CODE]"
+	go_out 110
+fi
+
+CODE=`curl -s -o /dev/null -w "%{http_code}" -H "Content-Type: application/json" -X POST -d '{}' http://localhost:8080/ipacl/allow 2>&1`
+
+if [[ "X$CODE" != "X403" ]]; then
+	echo "Expected 403 for network not in allow list but got [$CODE]"
+	go_out 111
+fi
+
+# localhost is trusted proxy, real client taken from forwarding headers
+CODE=`curl -s -o /dev/null -w "%{http_code}" -H "X-Forwarded-For: 192.0.2.10" -H "Content-Type: application/json" -X POST -d '{}' http://localhost:8080/ipacl/allow 2>&1`
+
+if [[ "X$CODE" != "X200" ]]; then
+	echo "Expected 200 for allowed forwarded client but got [$CODE]"
+	go_out 112
+fi
+
+CODE=`curl -s -o /dev/null -w "%{http_code}" -H "X-Forwarded-For: 2001:db8::1" -H "Content-Type: application/json" -X POST -d '{}' http://localhost:8080/ipacl/allow 2>&1`
+
+if [[ "X$CODE" != "X200" ]]; then
+	echo "Expected 200 for allowed IPv6 forwarded client but got [$CODE]"
+	go_out 113
+fi
+
+# Forwarded header is not set by our proxy (ip_forward_header is
+# X-Forwarded-For), thus client sent one is ignored
+CODE=`curl -s -o /dev/null -w "%{http_code}" -H 'Forwarded: for="[2001:db8::1]:4711";proto=http' -H "X-Forwarded-For: 198.51.100.7" -H "Content-Type: application/json" -X POST -d '{}' http://localhost:8080/ipacl/allow 2>&1`
+
+if [[ "X$CODE" != "X403" ]]; then
+	echo "Expected 403 for spoofed Forwarded header but got [$CODE]"
+	go_out 133
+fi
+
+# spoofed left most address is ignored, last untrusted hop is the client
+CODE=`curl -s -o /dev/null -w "%{http_code}" -H "X-Forwarded-For: 192.0.2.10, 198.51.100.7" -H "Content-Type: application/json" -X POST -d '{}' http://localhost:8080/ipacl/allow 2>&1`
+
+if [[ "X$CODE" != "X403" ]]; then
+	echo "Expected 403 for spoofed forwarding chain but got [$CODE]"
+	go_out 114
+fi
+
+###############################################################################
+echo "Streamed file upload (chunks / conversation)"
+###############################################################################
+
+openssl rand -out tmp/stream_upload.blob 1234567 || go_out 115
+CKSUM1=`cd tmp && cksum stream_upload.blob`
+CKSUM2=`cd .. && cksum Makefile`
+
+for URL in ext_upload_chunks ext_upload_conv
+do
+	RSP=`curl -s -F "files[]=@tmp/stream_upload.blob" -F "files[]=@../Makefile" http://localhost:8080/$URL 2>&1`
+
+	if [[ "$RSP" != *"$CKSUM1"* || "$RSP" != *"$CKSUM2"* ]]; then
+		echo "Expected [$CKSUM1] and [$CKSUM2] from $URL but got [$RSP]"
+		go_out 116
+	fi
+done
+
+#Second chunk exceeds max size, first one shall be aborted at upload service
+CODE=`curl -s -o /dev/null -w "%{http_code}" -F "files[]=@tmp/stream_upload.blob" http://localhost:8080/ext_upload_chunks_max 2>&1`
+
+if [ "X$CODE" != "X413" ]; then
+	echo "Expected 413 for too large streamed upload but got [$CODE]"
+	go_out 126
+fi
+
+rm -f tmp/stream_upload.blob
+
+CNT=`ls -1 tmp/upld-* 2>/dev/null | wc -l | awk '{print $1}'`
+
+if [ "X$CNT" != "X0" ]; then
+	echo "Invalid count of upload files left: $CNT"
+	go_out 117
+fi
+
+###############################################################################
+echo "Upload content verification"
+###############################################################################
+
+printf '\x89PNG\r\n\x1a\n' > tmp/chk.png
+openssl rand 1000 >> tmp/chk.png
+SUM=`sha256sum tmp/chk.png | cut -d ' ' -f1`
+
+RSP=`curl -s -F "files[]=@tmp/chk.png;filename=../../evil.png" http://localhost:8080/ext_upload_check 2>&1`
+
+if [[ "$RSP" != *"evil.png|image/png|$SUM"* ]]; then
+	echo "Expected sanitized name, sniffed type and checksum but got [$RSP]"
+	go_out 118
+fi
+
+openssl rand -out tmp/chk.bin 1000
+CODE=`curl -s -o /dev/null -w "%{http_code}" -F "files[]=@tmp/chk.bin;type=image/png" http://localhost:8080/ext_upload_check 2>&1`
+
+if [[ "X$CODE" != "X415" ]]; then
+	echo "Expected 415 for not allowed content but got [$CODE]"
+	go_out 119
+fi
+
+echo "plain text" > tmp/chk.txt
+CODE=`curl -s -o /dev/null -w "%{http_code}" -F "files[]=@tmp/chk.txt" -F "files[]=@tmp/chk.txt" -F "files[]=@tmp/chk.txt" http://localhost:8080/ext_upload_check 2>&1`
+
+if [[ "X$CODE" != "X413" ]]; then
+	echo "Expected 413 for too many files but got [$CODE]"
+	go_out 120
+fi
+
+echo "this is VIRUS" > tmp/chk.txt
+CODE=`curl -s -o /dev/null -w "%{http_code}" -F "files[]=@tmp/chk.txt" http://localhost:8080/ext_upload_check 2>&1`
+
+if [[ "X$CODE" != "X422" ]]; then
+	echo "Expected 422 for file rejected by scanner service but got [$CODE]"
+	go_out 121
+fi
+
+CODE=`curl -s -o /dev/null -w "%{http_code}" -F "files[]=@tmp/chk.txt;filename=...." http://localhost:8080/ext_upload_check 2>&1`
+
+if [[ "X$CODE" != "X422" ]]; then
+	echo "Expected 422 for file with empty sanitized name rejected by scanner service but got [$CODE]"
+	go_out 135
+fi
+
+: > tmp/chk.txt
+CODE=`curl -s -o /dev/null -w "%{http_code}" -F "files[]=@tmp/chk.txt" http://localhost:8080/ext_upload_scancmd 2>&1`
+
+if [[ "X$CODE" != "X422" ]]; then
+	echo "Expected 422 for file rejected by scanner command but got [$CODE]"
+	go_out 122
+fi
+
+rm -f tmp/chk.png tmp/chk.bin tmp/chk.txt
+
 ###############################################################################
 echo "Checking transactional Web Services API"
 ###############################################################################
@@ -1176,6 +1758,38 @@ https://localhost:8080/svc1`
 	fi
 done
 } >> $LOGFILE 2>&1
+
+echo "TLS SNI certificate selection"
+
+CERT=`curl -s -v --insecure --resolve sni.example.com:8080:127.0.0.1 -o /dev/null -X POST -d '{}' https://sni.example.com:8080/echo 2>&1`
+
+if [[ "$CERT" != *"CN=sni.example.com"* && "$CERT" != *"CN = sni.example.com"* ]]; then
+	echo "Expected sni.example.com certificate but got [$CERT]"
+	go_out 103
+fi
+
+echo "TLS min version"
+
+if curl -s --insecure --tlsv1.0 --tls-max 1.1 -o /dev/null -X POST -d '{}' https://localhost:8080/echo; then
+	echo "Expected TLS 1.1 handshake to fail"
+	go_out 104
+fi
+
+echo "TLS certificate reload"
+
+FP1=`openssl s_client -connect localhost:8080 -servername localhost </dev/null 2>/dev/null | openssl x509 -noout -fingerprint`
+
+(cd conf && ./gencert.sh localhost > /dev/null 2>&1)
+
+sleep 3
+
+FP2=`openssl s_client -connect localhost:8080 -servername localhost </dev/null 2>/dev/null | openssl x509 -noout -fingerprint`
+
+if [[ "X$FP1" == "X" || "X$FP1" == "X$FP2" ]]; then
+	echo "Expected reloaded certificate, fingerprints [$FP1] [$FP2]"
+	go_out 105
+fi
+
 unset NDRX_CCTAG
 kill -2 $RPID
 sleep 10
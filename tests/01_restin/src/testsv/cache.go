@@ -0,0 +1,44 @@
+package main
+
+import (
+	"time"
+	"ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Service returning unique value, for response cache tests
+//@param ac ATMI Context
+//@param svc Service call information
+func CACHESV(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	ret := SUCCEED
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	//Return to the caller
+	defer func() {
+		if SUCCEED == ret {
+			ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+		} else {
+			ac.TpReturn(atmi.TPFAIL, 0, ub, 0)
+		}
+	}()
+
+	//Resize buffer, to have some more space
+	used, _ := ub.BUsed()
+	if err := ub.TpRealloc(used + 1024); err != nil {
+		ac.TpLogError("TpRealloc() Got error: %d:[%s]\n", err.Code(), err.Message())
+		ret = FAIL
+		return
+	}
+
+	if err := ub.BChg(ubftab.T_LONG_FLD, 0, time.Now().UnixNano()); nil != err {
+		ac.TpLogError("Failed to set T_LONG_FLD: %s", err.Message())
+		ret = FAIL
+		return
+	}
+
+	return
+}
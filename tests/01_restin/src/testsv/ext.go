@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"ubftab"
 
 	atmi "github.com/endurox-dev/endurox-go"
@@ -350,6 +353,131 @@ func REQPARAMS(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
 
 }
 
+//Return the request host and virtual host group
+func VHOSTSV(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	//Print the buffer to stdout
+	ub.TpLogPrintUBF(atmi.LOG_DEBUG, "Incoming request (VHOSTSV):")
+
+	host, _ := ub.BGetString(ubftab.EX_IF_HOST, 0)
+	vhost, _ := ub.BGetString(ubftab.EX_IF_VHOST, 0)
+
+	ub.BChg(ubftab.EX_IF_RSPDATA, 0, "HOST:"+host+";VHOST:"+vhost)
+
+	ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+}
+
+//Echo request for restout ext mode tests: response header X-Echo is set to
+//<X-Test header>|<Sess cookie>, cookie Back=42 is set, body is
+//<method> <path> <query> <body>. Status is 201, or 409 for paths ending
+//with /fail
+func EXTOUTSV(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	//Print the buffer to stdout
+	ub.TpLogPrintUBF(atmi.LOG_DEBUG, "Incoming request (EXTOUTSV):")
+
+	hdr := ""
+	sess := ""
+
+	names, _ := ub.BOccur(ubftab.EX_IF_REQHN)
+
+	for i := 0; i < names; i++ {
+		nam, _ := ub.BGetString(ubftab.EX_IF_REQHN, i)
+		if "X-Test" == nam {
+			hdr, _ = ub.BGetString(ubftab.EX_IF_REQHV, i)
+		}
+	}
+
+	names, _ = ub.BOccur(ubftab.EX_IF_REQCN)
+
+	for i := 0; i < names; i++ {
+		nam, _ := ub.BGetString(ubftab.EX_IF_REQCN, i)
+		if "Sess" == nam {
+			sess, _ = ub.BGetString(ubftab.EX_IF_REQCV, i)
+		}
+	}
+
+	var query []string
+	names, _ = ub.BOccur(ubftab.EX_IF_REQQUERYN)
+
+	for i := 0; i < names; i++ {
+		nam, _ := ub.BGetString(ubftab.EX_IF_REQQUERYN, i)
+		val, _ := ub.BGetString(ubftab.EX_IF_REQQUERYV, i)
+		query = append(query, nam+"="+val)
+	}
+
+	sort.Strings(query)
+
+	method, _ := ub.BGetString(ubftab.EX_IF_METHOD, 0)
+	path, _ := ub.BGetString(ubftab.EX_IF_URL, 0)
+	body, _ := ub.BGetString(ubftab.EX_IF_REQDATA, 0)
+
+	ub.BDel(ubftab.EX_IF_REQDATA, 0)
+
+	ub.BAdd(ubftab.EX_IF_RSPHN, "X-Echo")
+	ub.BAdd(ubftab.EX_IF_RSPHV, hdr+"|"+sess)
+
+	ub.BAdd(ubftab.EX_IF_RSPCN, "Back")
+	ub.BAdd(ubftab.EX_IF_RSPCV, "42")
+
+	if strings.HasSuffix(path, "/fail") {
+		ub.BChg(ubftab.EX_NETRCODE, 0, 409)
+	} else {
+		ub.BChg(ubftab.EX_NETRCODE, 0, 201)
+	}
+
+	ub.BChg(ubftab.EX_IF_RSPDATA, 0, method+" "+path+" "+
+		strings.Join(query, "&")+" "+body)
+
+	ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+}
+
+//Return request method, path, sorted query and body as json2ubf JSON
+//(used by restout URL template tests)
+func URLTPLSV(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	//Print the buffer to stdout
+	ub.TpLogPrintUBF(atmi.LOG_DEBUG, "Incoming request (URLTPLSV):")
+
+	var query []string
+	occs, _ := ub.BOccur(ubftab.EX_IF_REQQUERYN)
+
+	for i := 0; i < occs; i++ {
+		nam, _ := ub.BGetString(ubftab.EX_IF_REQQUERYN, i)
+		val, _ := ub.BGetString(ubftab.EX_IF_REQQUERYV, i)
+		query = append(query, nam+"="+val)
+	}
+
+	sort.Strings(query)
+
+	method, _ := ub.BGetString(ubftab.EX_IF_METHOD, 0)
+	path, _ := ub.BGetString(ubftab.EX_IF_URL, 0)
+	body, _ := ub.BGetString(ubftab.EX_IF_REQDATA, 0)
+
+	rsp, _ := json.Marshal(map[string]string{
+		"EX_IF_METHOD":   method,
+		"EX_IF_URL":      path,
+		"T_STRING_3_FLD": strings.Join(query, "&"),
+		"T_STRING_4_FLD": body,
+	})
+
+	ub.BDel(ubftab.EX_IF_REQDATA, 0)
+	used, _ := ub.BUsed()
+	ub.TpRealloc(used + int64(len(rsp)) + 1024)
+	ub.BChg(ubftab.EX_IF_RSPDATA, 0, string(rsp))
+
+	ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+}
+
 //Just receive some request
 //Set the tpurcode and in case of data 3, set error response too
 func REQERRCODES(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
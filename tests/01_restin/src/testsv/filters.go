@@ -0,0 +1,164 @@
+package main
+
+import (
+	"ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Filter which returns routing decisions, according to T_STRING_FLD
+//@param ac ATMI Context
+//@param svc Service call information
+func FLTDECIDE(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	ret := SUCCEED
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	//Return to the caller
+	defer func() {
+		if SUCCEED == ret {
+			ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+		} else {
+			ac.TpReturn(atmi.TPFAIL, 0, ub, 0)
+		}
+	}()
+
+	//Resize buffer, to have some more space
+	used, _ := ub.BUsed()
+	if err := ub.TpRealloc(used + 1024); err != nil {
+		ac.TpLogError("TpRealloc() Got error: %d:[%s]\n", err.Code(), err.Message())
+		ret = FAIL
+		return
+	}
+
+	ub.TpLogPrintUBF(atmi.LOG_DEBUG, "Incoming request:")
+
+	decision, _ := ub.BGetString(ubftab.T_STRING_FLD, 0)
+
+	switch decision {
+	case "skip":
+		ub.BChg(ubftab.EX_IF_FLTACTION, 0, "S")
+	case "reply":
+		ub.BChg(ubftab.EX_IF_FLTACTION, 0, "R")
+		ub.BChg(ubftab.T_STRING_2_FLD, 0, "REPLIED")
+	case "reroute":
+		ub.BChg(ubftab.EX_IF_FLTSVC, 0, "FLTTARGET")
+	}
+
+	return
+}
+
+//Filter which marks the buffer, to see that it was called
+//@param ac ATMI Context
+//@param svc Service call information
+func FLTMARK(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+	fltSetString(ac, svc, ubftab.T_STRING_3_FLD, "MARK")
+}
+
+//Rerouted target service
+//@param ac ATMI Context
+//@param svc Service call information
+func FLTTARGET(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+	fltSetString(ac, svc, ubftab.T_STRING_4_FLD, "TARGET")
+}
+
+//Default target service of the filter route
+//@param ac ATMI Context
+//@param svc Service call information
+func FLTDEFAULT(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+	fltSetString(ac, svc, ubftab.T_STRING_4_FLD, "DEFAULT")
+}
+
+//Set string field in incoming buffer and return it
+//@param ac ATMI Context
+//@param svc Service call information
+//@param fld field to set
+//@param val value to set
+func fltSetString(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO, fld int, val string) {
+
+	ret := SUCCEED
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	//Return to the caller
+	defer func() {
+		if SUCCEED == ret {
+			ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+		} else {
+			ac.TpReturn(atmi.TPFAIL, 0, ub, 0)
+		}
+	}()
+
+	//Resize buffer, to have some more space
+	used, _ := ub.BUsed()
+	if err := ub.TpRealloc(used + 1024); err != nil {
+		ac.TpLogError("TpRealloc() Got error: %d:[%s]\n", err.Code(), err.Message())
+		ret = FAIL
+		return
+	}
+
+	if err := ub.BChg(fld, 0, val); nil != err {
+		ac.TpLogError("Failed to set field: %s", err.Message())
+		ret = FAIL
+		return
+	}
+
+	return
+}
+
+//Proxy route filter, returns decisions according to "action" query parameter:
+//"reply" - reply 403 DENIED, "reroute" - route to PROXYTARGET
+//@param ac ATMI Context
+//@param svc Service call information
+func PROXYFLT(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	ub.TpLogPrintUBF(atmi.LOG_DEBUG, "Incoming request (PROXYFLT):")
+
+	action := ""
+	occs, _ := ub.BOccur(ubftab.EX_IF_REQQUERYN)
+
+	for i := 0; i < occs; i++ {
+		if nam, _ := ub.BGetString(ubftab.EX_IF_REQQUERYN, i); "action" == nam {
+			action, _ = ub.BGetString(ubftab.EX_IF_REQQUERYV, i)
+		}
+	}
+
+	switch action {
+	case "reply":
+		ub.BChg(ubftab.EX_IF_FLTACTION, 0, "R")
+		ub.BChg(ubftab.EX_NETRCODE, 0, 403)
+		ub.BChg(ubftab.EX_IF_RSPDATA, 0, "DENIED")
+	case "reroute":
+		ub.BChg(ubftab.EX_IF_FLTSVC, 0, "PROXYTARGET")
+	}
+
+	ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+}
+
+//Rerouted proxy request target, responds with "REROUTED " and request body
+//@param ac ATMI Context
+//@param svc Service call information
+func PROXYTARGET(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	ub.TpLogPrintUBF(atmi.LOG_DEBUG, "Incoming request (PROXYTARGET):")
+
+	body, _ := ub.BGetString(ubftab.EX_IF_REQDATA, 0)
+	ub.BDel(ubftab.EX_IF_REQDATA, 0)
+
+	used, _ := ub.BUsed()
+	ub.TpRealloc(used + 1024)
+
+	ub.BChg(ubftab.EX_NETRCODE, 0, 200)
+	ub.BChg(ubftab.EX_IF_RSPDATA, 0, "REROUTED "+body)
+
+	ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+}
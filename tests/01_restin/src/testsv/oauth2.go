@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Test client credentials
+const (
+	OAUTH2_CLIENT_ID     = "testcl"
+	OAUTH2_CLIENT_SECRET = "s3cr3t"
+	OAUTH2_SCOPES        = "read write"
+)
+
+//Get request header value from ext buffer
+//@param ub UBF buffer
+//@param name header name
+//@return header value or empty string
+func extReqHeader(ub *atmi.TypedUBF, name string) string {
+
+	occs, _ := ub.BOccur(ubftab.EX_IF_REQHN)
+
+	for i := 0; i < occs; i++ {
+		nam, _ := ub.BGetString(ubftab.EX_IF_REQHN, i)
+		if strings.EqualFold(name, nam) {
+			val, _ := ub.BGetString(ubftab.EX_IF_REQHV, i)
+			return val
+		}
+	}
+
+	return ""
+}
+
+//File in app log dir, shared by testsv instances
+func appLogFile(name string) string {
+	return os.Getenv("NDRX_APPHOME") + "/log/" + name
+}
+
+//OAuth2 token endpoint, issues "tok-<nanotime>" tokens for client credentials
+//grant. Issued tokens are appended to log/oauth2.tokens
+//@param ac ATMI Context
+//@param svc Service call information
+func OAUTH2TOKENSV(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	//Print the buffer to stdout
+	ub.TpLogPrintUBF(atmi.LOG_DEBUG, "Incoming request (OAUTH2TOKENSV):")
+
+	body, _ := ub.BGetString(ubftab.EX_IF_REQDATA, 0)
+	ub.BDel(ubftab.EX_IF_REQDATA, 0)
+
+	form, _ := url.ParseQuery(body)
+
+	auth := "Basic " + base64.StdEncoding.EncodeToString(
+		[]byte(OAUTH2_CLIENT_ID+":"+OAUTH2_CLIENT_SECRET))
+
+	if auth != extReqHeader(ub, "Authorization") ||
+		"client_credentials" != form.Get("grant_type") ||
+		OAUTH2_SCOPES != form.Get("scope") {
+
+		ac.TpLogError("Invalid token request: [%s]", body)
+		ub.BChg(ubftab.EX_NETRCODE, 0, 401)
+		ub.BChg(ubftab.EX_IF_RSPDATA, 0, "{\"error\":\"invalid_client\"}")
+		ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+		return
+	}
+
+	token := fmt.Sprintf("tok-%d", time.Now().UnixNano())
+
+	f, err := os.OpenFile(appLogFile("oauth2.tokens"),
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+
+	if nil == err {
+		f.WriteString(token + "\n")
+		f.Close()
+	}
+
+	ac.TpLogInfo("Issued token [%s]", token)
+
+	ub.BAdd(ubftab.EX_IF_RSPHN, "Content-Type")
+	ub.BAdd(ubftab.EX_IF_RSPHV, "application/json")
+	ub.BChg(ubftab.EX_NETRCODE, 0, 200)
+	ub.BChg(ubftab.EX_IF_RSPDATA, 0, "{\"access_token\":\""+token+
+		"\",\"token_type\":\"Bearer\",\"expires_in\":3600}")
+
+	ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+}
+
+//OAuth2 protected API. Tokens issued before the time stored in
+//log/oauth2.revoke are rejected with 401
+//@param ac ATMI Context
+//@param svc Service call information
+func OAUTH2APISV(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	//Print the buffer to stdout
+	ub.TpLogPrintUBF(atmi.LOG_DEBUG, "Incoming request (OAUTH2APISV):")
+
+	ub.BDel(ubftab.EX_IF_REQDATA, 0)
+
+	var revoked int64
+
+	if data, err := ioutil.ReadFile(appLogFile("oauth2.revoke")); nil == err {
+		revoked, _ = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	}
+
+	auth := extReqHeader(ub, "Authorization")
+	issued, err := strconv.ParseInt(strings.TrimPrefix(auth, "Bearer tok-"), 10, 64)
+
+	if !strings.HasPrefix(auth, "Bearer tok-") || nil != err || issued < revoked {
+		ac.TpLogError("Token rejected: [%s]", auth)
+		ub.BChg(ubftab.EX_NETRCODE, 0, 401)
+		ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+		return
+	}
+
+	ub.BAdd(ubftab.EX_IF_RSPHN, "Content-Type")
+	ub.BAdd(ubftab.EX_IF_RSPHV, "application/json")
+	ub.BChg(ubftab.EX_NETRCODE, 0, 200)
+	ub.BChg(ubftab.EX_IF_RSPDATA, 0, "{\"T_STRING_2_FLD\":\"AUTHORIZED\"}")
+
+	ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Number of attempts failed with 503 by /retry/flaky
+const RETRY_FAILS = 2
+
+//Count attempts of request (by T_STRING_FLD id in JSON body) in
+//log/retry.<id> file. Path ending with /flaky responds with 503 for the first
+//RETRY_FAILS attempts, path containing /down responds with 503 until
+//log/<last path element>.up file exists. Idempotency-Key header must be the
+//same on all attempts.
+//Responds with T_STRING_2_FLD "ATTEMPT <n>".
+//@param ac ATMI Context
+//@param svc Service call information
+func RETRYSV(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	//Print the buffer to stdout
+	ub.TpLogPrintUBF(atmi.LOG_DEBUG, "Incoming request (RETRYSV):")
+
+	path, _ := ub.BGetString(ubftab.EX_IF_URL, 0)
+	body, _ := ub.BGetString(ubftab.EX_IF_REQDATA, 0)
+	ub.BDel(ubftab.EX_IF_REQDATA, 0)
+
+	var req map[string]interface{}
+	json.Unmarshal([]byte(body), &req)
+
+	id, _ := req["T_STRING_FLD"].(string)
+	key := extReqHeader(ub, "Idempotency-Key")
+	file := appLogFile("retry." + id)
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+
+	if nil == err {
+		f.WriteString(key + "\n")
+		f.Close()
+	}
+
+	data, _ := ioutil.ReadFile(file)
+	keys := strings.Split(strings.TrimSpace(string(data)), "\n")
+
+	for _, k := range keys {
+		if k != key {
+			ac.TpLogError("Idempotency key changed: [%s] vs [%s]", k, key)
+			ub.BChg(ubftab.EX_NETRCODE, 0, 400)
+			ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+			return
+		}
+	}
+
+	//Backend down until log/<name>.up file is created
+	if strings.Contains(path, "/down") {
+
+		if _, err := os.Stat(appLogFile(filepath.Base(path) + ".up")); nil != err {
+			ac.TpLogInfo("[%s] is down - responding 503", path)
+			ub.BChg(ubftab.EX_NETRCODE, 0, 503)
+			ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+			return
+		}
+	}
+
+	if strings.HasSuffix(path, "/flaky") && len(keys) <= RETRY_FAILS {
+		ac.TpLogInfo("Attempt %d of [%s] - responding 503", len(keys), id)
+		ub.BChg(ubftab.EX_NETRCODE, 0, 503)
+		ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+		return
+	}
+
+	ub.BAdd(ubftab.EX_IF_RSPHN, "Content-Type")
+	ub.BAdd(ubftab.EX_IF_RSPHV, "application/json")
+	ub.BChg(ubftab.EX_NETRCODE, 0, 200)
+	ub.BChg(ubftab.EX_IF_RSPDATA, 0,
+		fmt.Sprintf("{\"T_STRING_2_FLD\":\"ATTEMPT %d\"}", len(keys)))
+
+	ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+}
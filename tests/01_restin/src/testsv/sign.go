@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Read signing key from app conf dir
+func signKey(name string) []byte {
+
+	data, _ := ioutil.ReadFile(os.Getenv("NDRX_APPHOME") + "/conf/" + name)
+
+	return []byte(strings.TrimSpace(string(data)))
+}
+
+//HMAC-SHA256 helper
+func signHMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+//Verify HMAC signature (X-Signature hex over method, path, X-Timestamp, body)
+func signVerifyHMAC(ub *atmi.TypedUBF, method, path, body string) bool {
+
+	ts := extReqHeader(ub, "X-Timestamp")
+	sig := extReqHeader(ub, "X-Signature")
+
+	if "k1" != extReqHeader(ub, "X-Key-Id") || "" == ts {
+		return false
+	}
+
+	exp := signHMAC(signKey("sign.key"), method+"\n"+path+"\n"+ts+"\n"+body)
+
+	return hex.EncodeToString(exp) == sig
+}
+
+//Build SigV4 canonical query from the request query fields: pairs are
+//sorted by encoded key, then by encoded value
+func signSigV4Query(ub *atmi.TypedUBF) string {
+
+	var pairs [][2]string
+	escape := func(s string) string {
+		return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+	}
+
+	occs, _ := ub.BOccur(ubftab.EX_IF_REQQUERYN)
+
+	for i := 0; i < occs; i++ {
+		k, _ := ub.BGetString(ubftab.EX_IF_REQQUERYN, i)
+		v, _ := ub.BGetString(ubftab.EX_IF_REQQUERYV, i)
+		pairs = append(pairs, [2]string{escape(k), escape(v)})
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+
+	var query []string
+
+	for _, p := range pairs {
+		query = append(query, p[0]+"="+p[1])
+	}
+
+	return strings.Join(query, "&")
+}
+
+//Verify AWS SigV4 Authorization header (host localhost:8080)
+func signVerifySigV4(ub *atmi.TypedUBF, method, path, body string) bool {
+
+	amzDate := extReqHeader(ub, "X-Amz-Date")
+	payloadHash := extReqHeader(ub, "X-Amz-Content-Sha256")
+	bodySum := sha256.Sum256([]byte(body))
+
+	if len(amzDate) < 8 || hex.EncodeToString(bodySum[:]) != payloadHash {
+		return false
+	}
+
+	date := amzDate[:8]
+	scope := date + "/eu-west-1/s3/aws4_request"
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+
+	canonical := method + "\n" + path + "\n" + signSigV4Query(ub) + "\n" +
+		"host:localhost:8080\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n\n" +
+		signedHeaders + "\n" + payloadHash
+
+	canonicalSum := sha256.Sum256([]byte(canonical))
+
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(canonicalSum[:])
+
+	key := signHMAC(append([]byte("AWS4"), signKey("sigv4.key")...), date)
+	key = signHMAC(key, "eu-west-1")
+	key = signHMAC(key, "s3")
+	key = signHMAC(key, "aws4_request")
+
+	exp := "AWS4-HMAC-SHA256 Credential=AKIDTEST/" + scope +
+		", SignedHeaders=" + signedHeaders +
+		", Signature=" + hex.EncodeToString(signHMAC(key, toSign))
+
+	return exp == extReqHeader(ub, "Authorization")
+}
+
+//Verify request signature, path /sign/hmac or /sign/sigv4. Responds with
+//T_STRING_2_FLD "SIGNED" or 401 if signature is invalid.
+//@param ac ATMI Context
+//@param svc Service call information
+func SIGNSV(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	//Print the buffer to stdout
+	ub.TpLogPrintUBF(atmi.LOG_DEBUG, "Incoming request (SIGNSV):")
+
+	method, _ := ub.BGetString(ubftab.EX_IF_METHOD, 0)
+	path, _ := ub.BGetString(ubftab.EX_IF_URL, 0)
+	body, _ := ub.BGetString(ubftab.EX_IF_REQDATA, 0)
+	ub.BDel(ubftab.EX_IF_REQDATA, 0)
+
+	ok := false
+
+	if strings.HasSuffix(path, "/sigv4") {
+		ok = signVerifySigV4(ub, method, path, body)
+	} else {
+		ok = signVerifyHMAC(ub, method, path, body)
+	}
+
+	if !ok {
+		ac.TpLogError("Invalid signature of [%s %s]", method, path)
+		ub.BChg(ubftab.EX_NETRCODE, 0, 401)
+		ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+		return
+	}
+
+	ub.BAdd(ubftab.EX_IF_RSPHN, "Content-Type")
+	ub.BAdd(ubftab.EX_IF_RSPHV, "application/json")
+	ub.BChg(ubftab.EX_NETRCODE, 0, 200)
+	ub.BChg(ubftab.EX_IF_RSPDATA, 0, "{\"T_STRING_2_FLD\":\"SIGNED\"}")
+
+	ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+}
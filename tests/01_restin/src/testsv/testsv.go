@@ -443,6 +443,106 @@ func Init(ac *atmi.ATMICtx) int {
 		return atmi.FAIL
 	}
 
+	if err := ac.TpAdvertise("FLTDECIDE", "FLTDECIDE", FLTDECIDE); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("FLTMARK", "FLTMARK", FLTMARK); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("FLTTARGET", "FLTTARGET", FLTTARGET); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("FLTDEFAULT", "FLTDEFAULT", FLTDEFAULT); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("PROXYFLT", "PROXYFLT", PROXYFLT); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("PROXYTARGET", "PROXYTARGET", PROXYTARGET); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("CACHESV", "CACHESV", CACHESV); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("TRACESV", "TRACESV", TRACESV); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("VHOSTSV", "VHOSTSV", VHOSTSV); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("URLTPLSV", "URLTPLSV", URLTPLSV); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("EXTOUTSV", "EXTOUTSV", EXTOUTSV); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("OAUTH2TOKENSV", "OAUTH2TOKENSV", OAUTH2TOKENSV); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("OAUTH2APISV", "OAUTH2APISV", OAUTH2APISV); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("RETRYSV", "RETRYSV", RETRYSV); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("SIGNSV", "SIGNSV", SIGNSV); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("UPLDCHUNK", "UPLDCHUNK", UPLDCHUNK); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("UPLDCONV", "UPLDCONV", UPLDCONV); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("UPLDTARGET", "UPLDTARGET", UPLDTARGET); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("UPLDINFO", "UPLDINFO", UPLDINFO); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
+	if err := ac.TpAdvertise("UPLDSCAN", "UPLDSCAN", UPLDSCAN); err != nil {
+		fmt.Println(err)
+		return atmi.FAIL
+	}
+
 	return atmi.SUCCEED
 }
 
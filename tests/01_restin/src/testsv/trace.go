@@ -0,0 +1,54 @@
+package main
+
+import (
+	"ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Service returning the trace context it received, for trace tests
+//@param ac ATMI Context
+//@param svc Service call information
+func TRACESV(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	ret := SUCCEED
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	//Return to the caller
+	defer func() {
+		if SUCCEED == ret {
+			ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+		} else {
+			ac.TpReturn(atmi.TPFAIL, 0, ub, 0)
+		}
+	}()
+
+	//Resize buffer, to have some more space
+	used, _ := ub.BUsed()
+	if err := ub.TpRealloc(used + 1024); err != nil {
+		ac.TpLogError("TpRealloc() Got error: %d:[%s]\n", err.Code(), err.Message())
+		ret = FAIL
+		return
+	}
+
+	ub.TpLogPrintUBF(atmi.LOG_DEBUG, "Incoming request:")
+
+	parent, _ := ub.BGetString(ubftab.EX_IF_TRACEPARENT, 0)
+	state, _ := ub.BGetString(ubftab.EX_IF_TRACESTATE, 0)
+
+	if err := ub.BChg(ubftab.T_STRING_FLD, 0, parent); nil != err {
+		ac.TpLogError("Failed to set T_STRING_FLD: %s", err.Message())
+		ret = FAIL
+		return
+	}
+
+	if err := ub.BChg(ubftab.T_STRING_2_FLD, 0, state); nil != err {
+		ac.TpLogError("Failed to set T_STRING_2_FLD: %s", err.Message())
+		ret = FAIL
+		return
+	}
+
+	return
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Path where streamed upload is assembled
+//@param id upload id
+//@return file path
+func upldPath(id string) string {
+	return os.Getenv("NDRX_APPHOME") + "/tmp/upld-" + id
+}
+
+//Write the chunk of streamed upload at its offset
+//@param ac ATMI Context
+//@param ub chunk buffer
+//@return error or nil
+func upldWriteChunk(ac *atmi.ATMICtx, ub *atmi.TypedUBF) error {
+
+	id, _ := ub.BGetString(ubftab.EX_IF_UPLDID, 0)
+	offset, _ := ub.BGetInt64(ubftab.EX_IF_UPLDOFFSET, 0)
+	final, _ := ub.BGetInt(ubftab.EX_IF_UPLDFINAL, 0)
+	data, _ := ub.BGetByteArr(ubftab.EX_IF_REQDATA, 0)
+
+	ac.TpLogInfo("Upload [%s] chunk offset %d size %d final %d",
+		id, offset, len(data), final)
+
+	if "" == id {
+		return fmt.Errorf("Missing EX_IF_UPLDID")
+	}
+
+	//Request failed, remove partial upload
+	if abort, _ := ub.BGetInt(ubftab.EX_IF_UPLDABORT, 0); 1 == abort {
+		ac.TpLogInfo("Upload [%s] aborted", id)
+		os.Remove(upldPath(id))
+		return nil
+	}
+
+	f, err := os.OpenFile(upldPath(id), os.O_CREATE|os.O_WRONLY, 0600)
+
+	if nil != err {
+		return err
+	}
+
+	defer f.Close()
+
+	if _, err = f.WriteAt(data, offset); nil != err {
+		return err
+	}
+
+	if 1 == final {
+		size, _ := ub.BGetInt64(ubftab.EX_IF_UPLDSIZE, 0)
+
+		if size != offset+int64(len(data)) {
+			return fmt.Errorf("Invalid final size %d, expected %d",
+				size, offset+int64(len(data)))
+		}
+	}
+
+	return nil
+}
+
+//Receive streamed upload chunk per call
+//@param ac ATMI Context
+//@param svc Service call information
+func UPLDCHUNK(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	if err := upldWriteChunk(ac, ub); nil != err {
+		ac.TpLogError("TESTERROR: Failed to write chunk: %s", err.Error())
+		ac.TpReturn(atmi.TPFAIL, 0, ub, 0)
+		return
+	}
+
+	ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+}
+
+//Receive streamed upload chunks in conversation, client passes
+//the control after the last chunk
+//@param ac ATMI Context
+//@param svc Service call information
+func UPLDCONV(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	ub, _ := ac.CastToUBF(&svc.Data)
+	haveControl := 0 != svc.Flags&atmi.TPSENDONLY
+
+	for {
+		if err := upldWriteChunk(ac, ub); nil != err {
+			ac.TpLogError("TESTERROR: Failed to write chunk: %s", err.Error())
+			ac.TpReturn(atmi.TPFAIL, 0, ub, 0)
+			return
+		}
+
+		if haveControl {
+			break
+		}
+
+		revent, errA := ac.TpRecv(svc.Cd, ub, 0)
+
+		if nil != errA {
+			if atmi.TPEEVENT == errA.Code() && atmi.TPEV_SENDONLY == revent {
+				haveControl = true
+			} else {
+				ac.TpLogError("TESTERROR: TpRecv failed: %s (event %d)",
+					errA.Error(), revent)
+				ac.TpReturn(atmi.TPFAIL, 0, ub, 0)
+				return
+			}
+		}
+	}
+
+	ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+}
+
+//Target service of streamed upload, returns <file name:chksum> lines
+//of the assembled uploads and removes them
+//@param ac ATMI Context
+//@param svc Service call information
+func UPLDTARGET(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	var reply string
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	ub.TpLogPrintUBF(atmi.LOG_DEBUG, "Incoming request (UPLDTARGET):")
+
+	occs, _ := ub.BOccur(ubftab.EX_IF_UPLDID)
+
+	for i := 0; i < occs; i++ {
+
+		id, _ := ub.BGetString(ubftab.EX_IF_UPLDID, i)
+		fname, _ := ub.BGetString(ubftab.EX_IF_REQFILENAME, i)
+		size, _ := ub.BGetInt64(ubftab.EX_IF_UPLDSIZE, i)
+		path := upldPath(id)
+
+		if info, err := os.Stat(path); nil != err || info.Size() != size {
+			ac.TpLogError("TESTERROR: upload [%s] missing or size not %d", path, size)
+			ac.TpReturn(atmi.TPFAIL, 0, ub, 0)
+			return
+		}
+
+		out, err := exec.Command("cksum", path).Output()
+		os.Remove(path)
+
+		if nil != err {
+			ac.TpLogError("TESTERROR: Failed to get checksum for [%s]: %s",
+				path, err.Error())
+			ac.TpReturn(atmi.TPFAIL, 0, ub, 0)
+			return
+		}
+
+		reply += strings.Replace(string(out), path, fname, -1) + "\n"
+	}
+
+	used, _ := ub.BUsed()
+	ub.TpRealloc(used + int64(len(reply)) + 1024)
+	ub.BChg(ubftab.EX_IF_RSPDATA, 0, reply)
+
+	ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+}
+
+//Return <file name>|<mime>|<sha256> lines of uploaded files
+//@param ac ATMI Context
+//@param svc Service call information
+func UPLDINFO(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	var reply string
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	ub.TpLogPrintUBF(atmi.LOG_DEBUG, "Incoming request (UPLDINFO):")
+
+	occs, _ := ub.BOccur(ubftab.EX_IF_REQFILENAME)
+
+	for i := 0; i < occs; i++ {
+		fname, _ := ub.BGetString(ubftab.EX_IF_REQFILENAME, i)
+		mime, _ := ub.BGetString(ubftab.EX_IF_REQFILEMIME, i)
+		sum, _ := ub.BGetString(ubftab.EX_IF_REQFILESHA256, i)
+
+		reply += fname + "|" + mime + "|" + sum + "\n"
+	}
+
+	used, _ := ub.BUsed()
+	ub.TpRealloc(used + int64(len(reply)) + 1024)
+	ub.BChg(ubftab.EX_IF_RSPDATA, 0, reply)
+
+	ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+}
+
+//Upload scanner, rejects files containing VIRUS
+//@param ac ATMI Context
+//@param svc Service call information
+func UPLDSCAN(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	ub.TpLogPrintUBF(atmi.LOG_DEBUG, "Incoming request (UPLDSCAN):")
+
+	disk, _ := ub.BGetString(ubftab.EX_IF_REQFILEDISK, 0)
+	data, err := ioutil.ReadFile(disk)
+
+	if nil != err || bytes.Contains(data, []byte("VIRUS")) {
+		ac.TpLogInfo("File [%s] rejected", disk)
+		ac.TpReturn(atmi.TPFAIL, 0, ub, 0)
+		return
+	}
+
+	ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Slow HTTP upstream for restin proxy tests. Each request is answered after
+//given delay, max number of requests served in parallel is returned by /peak.
+//usage: testupstream <listen addr> <delay ms>
+
+var Mdelay time.Duration
+var Mactive int
+var Mpeak int
+var Mlock sync.Mutex
+
+//Handle the request
+//@param w response writer
+//@param r request
+func handle(w http.ResponseWriter, r *http.Request) {
+
+	if "/peak" == r.URL.Path {
+		Mlock.Lock()
+		peak := Mpeak
+		Mlock.Unlock()
+
+		fmt.Fprintf(w, "PEAK=%d", peak)
+		return
+	}
+
+	Mlock.Lock()
+	Mactive++
+
+	if Mactive > Mpeak {
+		Mpeak = Mactive
+	}
+
+	Mlock.Unlock()
+
+	time.Sleep(Mdelay)
+
+	Mlock.Lock()
+	Mactive--
+	Mlock.Unlock()
+
+	fmt.Fprint(w, "SLOW OK")
+}
+
+func main() {
+
+	if len(os.Args) != 3 {
+		fmt.Fprintf(os.Stderr, "usage: %s <listen addr> <delay ms>\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	ms, err := strconv.Atoi(os.Args[2])
+
+	if nil != err {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	Mdelay = time.Duration(ms) * time.Millisecond
+
+	if err := http.ListenAndServe(os.Args[1], http.HandlerFunc(handle)); nil != err {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
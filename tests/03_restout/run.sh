@@ -53,11 +53,30 @@ xadmin provision -d \
 cd conf
 
 # Remove certificate files
-rm localhost* 2>/dev/null
+rm localhost* pinextra* 2>/dev/null
 
 # Generate new ceritificate
 ./gencert.sh localhost 
 
+# SPKI pin of the server key for restout tls_pins tests
+export RESTOUT_TLS_PIN=`openssl x509 -in localhost.crt -pubkey -noout | \
+	openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64`
+echo "Server key pin: [$RESTOUT_TLS_PIN]"
+
+# Server sends extra (non-leaf) certificate after its own, pin of the extra
+# one must not be accepted
+./gencert.sh pinextra
+cat localhost.crt pinextra.crt > localhost_chain.crt
+export RESTOUT_TLS_PIN_EXTRA=`openssl x509 -in pinextra.crt -pubkey -noout | \
+	openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64`
+echo "Extra key pin: [$RESTOUT_TLS_PIN_EXTRA]"
+
+# OAuth2 client id for restout, secret is in conf/oauth2.secret
+export RESTOUT_OAUTH2_ID=testcl
+
+# Password of the test proxy
+export RESTOUT_PROXY_PASS=proxypass
+
 . settest1
 
 # So we are in runtime directory
@@ -66,6 +85,10 @@ cd ..
 unset NDRX_CCTAG 
 xadmin start -y
 
+# CONNECT proxy for restout proxy tests
+testproxy localhost:8090 proxyuser $RESTOUT_PROXY_PASS log/proxy.log &
+PROXY_PID=$!
+
 # Let restin to start
 echo "Sleep 15 - let clients to boot..."
 sleep 15
@@ -80,6 +103,7 @@ xadmin pqa
 #
 function go_out {
     echo "Test exiting with: $1"
+    kill $PROXY_PID 2>/dev/null
     xadmin stop -y
     xadmin down -y
 
@@ -571,6 +595,493 @@ if [[ $RET != 0 ]]; then
 	go_out 27
 fi
 
+###############################################################################
+echo "URL template, GET with query param"
+###############################################################################
+COMMAND="urltpl"
+
+testcl $COMMAND URLTPL_GET $TIMES
+RET=$?
+
+if [[ $RET != 0 ]]; then
+	echo "testcl $COMMAND: failed"
+	go_out 38
+fi
+
+###############################################################################
+echo "URL template, PUT with field moved to query"
+###############################################################################
+COMMAND="urltpl"
+
+testcl $COMMAND URLTPL_PUT $TIMES
+RET=$?
+
+if [[ $RET != 0 ]]; then
+	echo "testcl $COMMAND: failed"
+	go_out 39
+fi
+
+###############################################################################
+echo "URL template, JSON paths, DELETE"
+###############################################################################
+COMMAND="urltpl_json"
+
+testcl $COMMAND URLTPL_JSON $TIMES
+RET=$?
+
+if [[ $RET != 0 ]]; then
+	echo "testcl $COMMAND: failed"
+	go_out 40
+fi
+
+###############################################################################
+echo "URL template, placeholder field missing"
+###############################################################################
+COMMAND="urltpl_nofld"
+
+testcl $COMMAND URLTPL_GET 1
+RET=$?
+
+if [[ $RET != 11 ]]; then
+	echo "testcl $COMMAND: failed (ret must be 11, but got: $RET)"
+	go_out 41
+fi
+
+###############################################################################
+echo "Keepalive off, connection per request"
+###############################################################################
+COMMAND="ubfcall"
+
+testcl $COMMAND KEEPALIVE_OFF $TIMES
+RET=$?
+
+if [[ $RET != 0 ]]; then
+	echo "testcl $COMMAND: failed"
+	go_out 42
+fi
+
+###############################################################################
+echo "Service own connection pool, HTTP/2"
+###############################################################################
+COMMAND="ubfcall"
+
+testcl $COMMAND TRANSPORT_SVC $TIMES
+RET=$?
+
+if [[ $RET != 0 ]]; then
+	echo "testcl $COMMAND: failed"
+	go_out 43
+fi
+
+###############################################################################
+echo "Ext mode, request and response in UBF"
+###############################################################################
+COMMAND="extcall"
+
+testcl $COMMAND EXTOUT $TIMES
+RET=$?
+
+if [[ $RET != 0 ]]; then
+	echo "testcl $COMMAND: failed"
+	go_out 44
+fi
+
+###############################################################################
+echo "Ext mode, HTTP 409 mapped to TPESVCFAIL"
+###############################################################################
+COMMAND="extcall_fail"
+
+testcl $COMMAND EXTOUT 1
+RET=$?
+
+if [[ $RET != 11 ]]; then
+	echo "testcl $COMMAND: failed (ret must be 11, but got: $RET)"
+	go_out 45
+fi
+
+###############################################################################
+echo "TLS, client certificate and server key pinned"
+###############################################################################
+COMMAND="ubfcall"
+
+testcl $COMMAND TLS_PIN_OK $TIMES
+RET=$?
+
+if [[ $RET != 0 ]]; then
+	echo "testcl $COMMAND: failed"
+	go_out 46
+fi
+
+###############################################################################
+echo "TLS, server key does not match pin"
+###############################################################################
+COMMAND="ubfcall"
+
+testcl $COMMAND TLS_PIN_FAIL 1
+RET=$?
+
+if [[ $RET != 11 ]]; then
+	echo "testcl $COMMAND: failed (ret must be 11, but got: $RET)"
+	go_out 47
+fi
+
+###############################################################################
+echo "TLS, pin matches only non-leaf certificate sent by server"
+###############################################################################
+COMMAND="ubfcall"
+
+testcl $COMMAND TLS_PIN_NONLEAF 1
+RET=$?
+
+if [[ $RET != 11 ]]; then
+	echo "testcl $COMMAND: failed (ret must be 11, but got: $RET)"
+	go_out 70
+fi
+
+###############################################################################
+echo "OAuth2, token is fetched once and cached"
+###############################################################################
+COMMAND="oauth2call"
+
+testcl $COMMAND OAUTH2_API $TIMES
+RET=$?
+
+if [[ $RET != 0 ]]; then
+	echo "testcl $COMMAND: failed"
+	go_out 48
+fi
+
+TOKENS=`cat log/oauth2.tokens | wc -l`
+
+if [[ $TOKENS != 1 ]]; then
+	echo "testcl $COMMAND: expected 1 token issued, got: $TOKENS"
+	go_out 48
+fi
+
+###############################################################################
+echo "OAuth2, revoked token is refreshed once on 401"
+###############################################################################
+COMMAND="oauth2call"
+
+date +%s%N > log/oauth2.revoke
+
+testcl $COMMAND OAUTH2_API $TIMES
+RET=$?
+
+if [[ $RET != 0 ]]; then
+	echo "testcl $COMMAND: failed"
+	go_out 49
+fi
+
+TOKENS=`cat log/oauth2.tokens | wc -l`
+
+if [[ $TOKENS != 2 ]]; then
+	echo "testcl $COMMAND: expected 2 tokens issued, got: $TOKENS"
+	go_out 49
+fi
+
+###############################################################################
+echo "OAuth2, token endpoint rejects client"
+###############################################################################
+COMMAND="oauth2call"
+
+testcl $COMMAND OAUTH2_BADCRED 1
+RET=$?
+
+if [[ $RET != 11 ]]; then
+	echo "testcl $COMMAND: failed (ret must be 11, but got: $RET)"
+	go_out 50
+fi
+
+###############################################################################
+echo "Retry, idempotent method retried until success"
+###############################################################################
+COMMAND="retrycall"
+
+testcl $COMMAND RETRY_PUT 20
+RET=$?
+
+if [[ $RET != 0 ]]; then
+	echo "testcl $COMMAND: failed"
+	go_out 51
+fi
+
+###############################################################################
+echo "Retry, POST without idempotency key is not retried"
+###############################################################################
+COMMAND="retrycall"
+
+testcl $COMMAND RETRY_POST 1
+RET=$?
+
+if [[ $RET != 11 ]]; then
+	echo "testcl $COMMAND: failed (ret must be 11, but got: $RET)"
+	go_out 52
+fi
+
+###############################################################################
+echo "Retry, POST retried with the same idempotency key"
+###############################################################################
+COMMAND="retrycall"
+
+testcl $COMMAND RETRY_KEY 20
+RET=$?
+
+if [[ $RET != 0 ]]; then
+	echo "testcl $COMMAND: failed"
+	go_out 53
+fi
+
+###############################################################################
+echo "Retry, attempts exhausted"
+###############################################################################
+COMMAND="retrycall"
+
+testcl $COMMAND RETRY_FEW 1
+RET=$?
+
+if [[ $RET != 11 ]]; then
+	echo "testcl $COMMAND: failed (ret must be 11, but got: $RET)"
+	go_out 54
+fi
+
+###############################################################################
+echo "Breaker, opens after consecutive failures and fails fast"
+###############################################################################
+COMMAND="breakercall"
+
+for i in 1 2 3; do
+	testcl $COMMAND BREAKER_FF 1
+	RET=$?
+
+	if [[ $RET != 11 ]]; then
+		echo "testcl $COMMAND: failed (ret must be 11, but got: $RET)"
+		go_out 55
+	fi
+done
+
+# TPENOENT
+testcl $COMMAND BREAKER_FF 1
+RET=$?
+
+if [[ $RET != 6 ]]; then
+	echo "testcl $COMMAND: failed (ret must be 6, but got: $RET)"
+	go_out 55
+fi
+
+###############################################################################
+echo "Breaker, half-open probe closes the breaker"
+###############################################################################
+touch log/down1.up
+sleep 3
+
+testcl $COMMAND BREAKER_FF 10
+RET=$?
+
+if [[ $RET != 0 ]]; then
+	echo "testcl $COMMAND: failed"
+	go_out 56
+fi
+
+###############################################################################
+echo "Breaker, error rate unadvertises the service"
+###############################################################################
+for i in 1 2 3 4; do
+	testcl $COMMAND BREAKER_UNADV 1
+	RET=$?
+
+	if [[ $RET != 11 ]]; then
+		echo "testcl $COMMAND: failed (ret must be 11, but got: $RET)"
+		go_out 57
+	fi
+done
+
+# Let periodic callback to unadvertise
+sleep 2
+
+xadmin psc
+
+# TPENOENT, service not advertised
+testcl $COMMAND BREAKER_UNADV 1
+RET=$?
+
+if [[ $RET != 6 ]]; then
+	echo "testcl $COMMAND: failed (ret must be 6, but got: $RET)"
+	go_out 57
+fi
+
+###############################################################################
+echo "Breaker, service advertised again after open time"
+###############################################################################
+touch log/down2.up
+sleep 5
+
+testcl $COMMAND BREAKER_UNADV 10
+RET=$?
+
+if [[ $RET != 0 ]]; then
+	echo "testcl $COMMAND: failed"
+	go_out 58
+fi
+
+###############################################################################
+echo "Endpoints, standby fails over to second endpoint"
+###############################################################################
+COMMAND="breakercall"
+
+testcl $COMMAND LB_STANDBY $TIMES
+RET=$?
+
+if [[ $RET != 0 ]]; then
+	echo "testcl $COMMAND: failed"
+	go_out 59
+fi
+
+###############################################################################
+echo "Endpoints, weighted with failover"
+###############################################################################
+testcl $COMMAND LB_WEIGHTED $TIMES
+RET=$?
+
+if [[ $RET != 0 ]]; then
+	echo "testcl $COMMAND: failed"
+	go_out 60
+fi
+
+###############################################################################
+echo "Endpoints, all down"
+###############################################################################
+testcl $COMMAND LB_DOWN 1
+RET=$?
+
+if [[ $RET != 11 ]]; then
+	echo "testcl $COMMAND: failed (ret must be 11, but got: $RET)"
+	go_out 61
+fi
+
+###############################################################################
+echo "Endpoints, health by echo"
+###############################################################################
+# Standby endpoint is down, echo marks the primary down and the standby up
+touch log/down_b.up
+sleep 4
+
+testcl $COMMAND LB_ECHO_DEP $TIMES
+RET=$?
+
+if [[ $RET != 0 ]]; then
+	echo "testcl $COMMAND: failed"
+	go_out 68
+fi
+
+# Primary back, standby down: echo brings the primary up before lb_fail_time
+touch log/down_a.up
+rm log/down_b.up
+sleep 4
+
+testcl $COMMAND LB_ECHO_DEP $TIMES
+RET=$?
+
+if [[ $RET != 0 ]]; then
+	echo "testcl $COMMAND: failed"
+	go_out 69
+fi
+
+###############################################################################
+echo "Proxy, HTTPS tunnelled with authentication"
+###############################################################################
+COMMAND="breakercall"
+
+testcl $COMMAND PROXY_OK $TIMES
+RET=$?
+
+if [[ $RET != 0 ]]; then
+	echo "testcl $COMMAND: failed"
+	go_out 62
+fi
+
+grep "CONNECT localhost:8080" log/proxy.log
+
+if [[ $? != 0 ]]; then
+	echo "testcl $COMMAND: request not sent via proxy"
+	go_out 62
+fi
+
+###############################################################################
+echo "Proxy, authentication failure"
+###############################################################################
+testcl $COMMAND PROXY_NOAUTH 1
+RET=$?
+
+if [[ $RET != 11 ]]; then
+	echo "testcl $COMMAND: failed (ret must be 11, but got: $RET)"
+	go_out 63
+fi
+
+grep "DENIED localhost:8080" log/proxy.log
+
+if [[ $? != 0 ]]; then
+	echo "testcl $COMMAND: proxy must deny the request"
+	go_out 63
+fi
+
+###############################################################################
+echo "Proxy, host in no_proxy goes directly"
+###############################################################################
+testcl $COMMAND PROXY_BYPASS $TIMES
+RET=$?
+
+if [[ $RET != 0 ]]; then
+	echo "testcl $COMMAND: failed"
+	go_out 64
+fi
+
+###############################################################################
+echo "Signing, HMAC-SHA256"
+###############################################################################
+COMMAND="breakercall"
+
+testcl $COMMAND SIGN_HMAC $TIMES
+RET=$?
+
+if [[ $RET != 0 ]]; then
+	echo "testcl $COMMAND: failed"
+	go_out 65
+fi
+
+###############################################################################
+echo "Signing, AWS SigV4"
+###############################################################################
+testcl $COMMAND SIGN_V4 $TIMES
+RET=$?
+
+if [[ $RET != 0 ]]; then
+	echo "testcl $COMMAND: failed"
+	go_out 66
+fi
+
+###############################################################################
+echo "Signing, AWS SigV4 with query string"
+###############################################################################
+testcl $COMMAND SIGN_V4_QUERY $TIMES
+RET=$?
+
+if [[ $RET != 0 ]]; then
+	echo "testcl $COMMAND: failed"
+	go_out 71
+fi
+
+###############################################################################
+echo "Signing, invalid key"
+###############################################################################
+testcl $COMMAND SIGN_BADKEY 1
+RET=$?
+
+if [[ $RET != 11 ]]; then
+	echo "testcl $COMMAND: failed (ret must be 11, but got: $RET)"
+	go_out 67
+fi
+
 ###############################################################################
 echo "Done"
 ###############################################################################
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	u "ubftab"
 
 	atmi "github.com/endurox-dev/endurox-go"
@@ -318,6 +319,262 @@ func VIEWCallREQUEST1(ac *atmi.ATMICtx, cmd string, svc string, times string) er
 
 }
 
+//HTTP method & URL template tests with UBF buffer. The backend echoes
+//method, path, query and body in EX_IF_METHOD, EX_IF_URL, T_STRING_3_FLD
+//and T_STRING_4_FLD
+func URLTplCall(ac *atmi.ATMICtx, cmd string, svc string, times string) error {
+
+	nrTimes, _ := strconv.Atoi(times)
+
+	for i := 0; i < nrTimes; i++ {
+
+		buf, err := ac.NewUBF(4096)
+
+		if err != nil {
+			return errors.New(err.Error())
+		}
+
+		//Without the placeholder field call must fail
+		if cmd != "urltpl_nofld" {
+			buf.BChg(u.T_STRING_FLD, 0, "ORD 1")
+		}
+		buf.BChg(u.T_LONG_FLD, 0, i)
+		buf.BChg(u.T_STRING_2_FLD, 0, "HELLO")
+
+		//Call the server
+		if _, err := ac.TpCall(svc, buf, 0); nil != err {
+			MErrorCode = err.Code()
+			return errors.New(err.Error())
+		}
+
+		var stmt string
+
+		switch svc {
+		case "URLTPL_GET":
+			stmt = fmt.Sprintf("EX_IF_METHOD=='GET'"+
+				"&& EX_IF_URL=='/urltpl/orders/ORD 1'"+
+				"&& T_STRING_3_FLD=='limit=%d'"+
+				"&& T_STRING_4_FLD==''", i)
+		case "URLTPL_PUT":
+			stmt = fmt.Sprintf("EX_IF_METHOD=='PUT'"+
+				"&& EX_IF_URL=='/urltpl/orders/ORD 1/items'"+
+				"&& T_STRING_3_FLD=='T_LONG_FLD=%d'", i)
+
+			//Query field is moved out of the body
+			body, _ := buf.BGetString(u.T_STRING_4_FLD, 0)
+
+			if !strings.Contains(body, "T_STRING_2_FLD") ||
+				strings.Contains(body, "T_LONG_FLD") {
+				return fmt.Errorf("urltpl: invalid body sent: [%s]", body)
+			}
+		default:
+			return fmt.Errorf("urltpl: unexpected service [%s]", svc)
+		}
+
+		if res, err := buf.BQBoolEv(stmt); !res || nil != err {
+			buf.TpLogPrintUBF(atmi.LOG_ERROR, "urltpl: invalid response")
+			if nil != err {
+				return fmt.Errorf("urltpl: Expression "+
+					"failed: %s", err.Error())
+			} else {
+				return fmt.Errorf("urltpl: Expression is FALSE!: %s", stmt)
+			}
+		}
+	}
+
+	return nil
+}
+
+//HTTP method & URL template tests with JSON buffer (JSON paths)
+func URLTplJSONCall(ac *atmi.ATMICtx, cmd string, svc string, times string) error {
+
+	nrTimes, _ := strconv.Atoi(times)
+
+	for i := 0; i < nrTimes; i++ {
+
+		var rsp map[string]string
+		buf, err := ac.NewJSON([]byte(fmt.Sprintf("{\"item\":{\"id\":\"A 1/2\", "+
+			"\"ver\":%d}, \"note\":\"hello\"}", i)))
+
+		if err != nil {
+			return errors.New(err.Error())
+		}
+
+		//Call the server
+		if _, err := ac.TpCall(svc, buf, 0); nil != err {
+			MErrorCode = err.Code()
+			return errors.New(err.Error())
+		}
+
+		if jerr := json.Unmarshal(buf.GetJSON(), &rsp); jerr != nil {
+			return fmt.Errorf("Unmarshal: %s", jerr.Error())
+		}
+
+		if rsp["EX_IF_METHOD"] != "DELETE" ||
+			rsp["EX_IF_URL"] != "/urltpl/items/A 1/2" ||
+			rsp["T_STRING_3_FLD"] != fmt.Sprintf("src=restout&v=%d", i) {
+			return fmt.Errorf("urltpl_json: invalid response: %v", rsp)
+		}
+
+		body := rsp["T_STRING_4_FLD"]
+
+		if !strings.Contains(body, "\"note\"") || strings.Contains(body, "\"ver\"") {
+			return fmt.Errorf("urltpl_json: invalid body sent: [%s]", body)
+		}
+	}
+
+	return nil
+}
+
+//Ext mode tests: request method, URL suffix, query, headers, cookies and
+//body are set in UBF, response status, headers, cookies and body checked
+func EXTCall(ac *atmi.ATMICtx, cmd string, svc string, times string) error {
+
+	nrTimes, _ := strconv.Atoi(times)
+
+	for i := 0; i < nrTimes; i++ {
+
+		buf, err := ac.NewUBF(4096)
+
+		if err != nil {
+			return errors.New(err.Error())
+		}
+
+		buf.BChg(u.EX_IF_METHOD, 0, "patch")
+
+		if cmd == "extcall_fail" {
+			buf.BChg(u.EX_IF_URL, 0, "/items/fail")
+		} else {
+			buf.BChg(u.EX_IF_URL, 0, fmt.Sprintf("/items/%d", i))
+		}
+
+		buf.BChg(u.EX_IF_REQQUERYN, 0, "a")
+		buf.BChg(u.EX_IF_REQQUERYV, 0, "1 2")
+		buf.BChg(u.EX_IF_REQHN, 0, "X-Test")
+		buf.BChg(u.EX_IF_REQHV, 0, "hello")
+		buf.BChg(u.EX_IF_REQCN, 0, "Sess")
+		buf.BChg(u.EX_IF_REQCV, 0, "abc")
+		buf.BChg(u.EX_IF_REQDATA, 0, "PAYLOAD")
+
+		//Call the server
+		if _, err := ac.TpCall(svc, buf, 0); nil != err {
+			MErrorCode = err.Code()
+
+			//Response is loaded on failure too
+			if code, _ := buf.BGetInt(u.EX_NETRCODE, 0); 409 != code {
+				return fmt.Errorf("extcall: expected status 409, got %d", code)
+			}
+
+			return errors.New(err.Error())
+		}
+
+		stmt := fmt.Sprintf("EX_NETRCODE==201"+
+			"&& EX_IF_RSPDATA=='PATCH /extout/items/%d a=1 2 PAYLOAD'"+
+			"&& EX_IF_RSPCN=='Back' && EX_IF_RSPCV=='42'", i)
+
+		if res, err := buf.BQBoolEv(stmt); !res || nil != err {
+			buf.TpLogPrintUBF(atmi.LOG_ERROR, "extcall: invalid response")
+			if nil != err {
+				return fmt.Errorf("extcall: Expression "+
+					"failed: %s", err.Error())
+			} else {
+				return fmt.Errorf("extcall: Expression is FALSE!: %s", stmt)
+			}
+		}
+
+		echo := ""
+		occs, _ := buf.BOccur(u.EX_IF_RSPHN)
+
+		for occ := 0; occ < occs; occ++ {
+			if name, _ := buf.BGetString(u.EX_IF_RSPHN, occ); "X-Echo" == name {
+				echo, _ = buf.BGetString(u.EX_IF_RSPHV, occ)
+			}
+		}
+
+		if echo != "hello|abc" {
+			return fmt.Errorf("extcall: X-Echo expected [hello|abc], got [%s]", echo)
+		}
+	}
+
+	return nil
+}
+
+//Call OAuth2 protected service, backend sets T_STRING_2_FLD if bearer
+//token is accepted
+//@param ac ATMI Context
+//@param cmd command
+//@param svc service to call
+//@param times number of calls
+//@return error or nil
+func OAuth2Call(ac *atmi.ATMICtx, cmd string, svc string, times string) error {
+
+	nrTimes, _ := strconv.Atoi(times)
+
+	for i := 0; i < nrTimes; i++ {
+
+		buf, err := ac.NewUBF(1024)
+
+		if err != nil {
+			return errors.New(err.Error())
+		}
+
+		buf.BChg(u.T_STRING_FLD, 0, fmt.Sprintf("call %d", i))
+
+		if _, err := ac.TpCall(svc, buf, 0); nil != err {
+			MErrorCode = err.Code()
+			return errors.New(err.Error())
+		}
+
+		if val, _ := buf.BGetString(u.T_STRING_2_FLD, 0); "AUTHORIZED" != val {
+			buf.TpLogPrintUBF(atmi.LOG_ERROR, "oauth2call: invalid response")
+			return fmt.Errorf("oauth2call: expected AUTHORIZED, got [%s]", val)
+		}
+	}
+
+	return nil
+}
+
+//Call service which backend fails first two attempts with 503, response
+//must come from the third attempt (retrycall) or just succeed (breakercall)
+//@param ac ATMI Context
+//@param cmd command
+//@param svc service to call
+//@param times number of calls
+//@return error or nil
+func RetryCall(ac *atmi.ATMICtx, cmd string, svc string, times string) error {
+
+	nrTimes, _ := strconv.Atoi(times)
+
+	for i := 0; i < nrTimes; i++ {
+
+		buf, err := ac.NewUBF(1024)
+
+		if err != nil {
+			return errors.New(err.Error())
+		}
+
+		//Unique request id for backend attempt counting
+		buf.BChg(u.T_STRING_FLD, 0, fmt.Sprintf("%s-%d-%d", svc, os.Getpid(), i))
+
+		if _, err := ac.TpCall(svc, buf, 0); nil != err {
+			MErrorCode = err.Code()
+			return errors.New(err.Error())
+		}
+
+		//For breaker tests any successful response is fine
+		if "breakercall" == cmd {
+			continue
+		}
+
+		if val, _ := buf.BGetString(u.T_STRING_2_FLD, 0); "ATTEMPT 3" != val {
+			buf.TpLogPrintUBF(atmi.LOG_ERROR, "retrycall: invalid response")
+			return fmt.Errorf("retrycall: expected ATTEMPT 3, got [%s]", val)
+		}
+	}
+
+	return nil
+}
+
 //Run the listener
 func apprun(ac *atmi.ATMICtx) error {
 
@@ -349,6 +606,16 @@ func apprun(ac *atmi.ATMICtx) error {
 		return VIEWCallREQUEST1(ac, cmd, svc, times)
 	case "bigmsg":
 		return BigMsg(ac, cmd, svc, times)
+	case "urltpl", "urltpl_nofld":
+		return URLTplCall(ac, cmd, svc, times)
+	case "urltpl_json":
+		return URLTplJSONCall(ac, cmd, svc, times)
+	case "extcall", "extcall_fail":
+		return EXTCall(ac, cmd, svc, times)
+	case "oauth2call":
+		return OAuth2Call(ac, cmd, svc, times)
+	case "retrycall", "breakercall":
+		return RetryCall(ac, cmd, svc, times)
 	default:
 		return errors.New(fmt.Sprintf("Invalid test case: [%s]", cmd))
 	}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+)
+
+//Minimal HTTP CONNECT proxy for restout proxy tests. Requires basic
+//authentication, tunnels accepted connections and logs the targets.
+//usage: testproxy <listen addr> <user> <password> <log file>
+
+var Mauth string
+var Mlog *os.File
+var MlogLock sync.Mutex
+
+//Log the tunnel request
+//@param format line format
+//@param a arguments
+func logLine(format string, a ...interface{}) {
+
+	MlogLock.Lock()
+	defer MlogLock.Unlock()
+
+	fmt.Fprintf(Mlog, format+"\n", a...)
+}
+
+//Handle CONNECT request
+//@param w response writer
+//@param r request
+func handle(w http.ResponseWriter, r *http.Request) {
+
+	if http.MethodConnect != r.Method {
+		http.Error(w, "only CONNECT supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if Mauth != r.Header.Get("Proxy-Authorization") {
+		logLine("DENIED %s", r.Host)
+		w.Header().Set("Proxy-Authenticate", "Basic realm=\"test\"")
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+
+	dst, err := net.Dial("tcp", r.Host)
+
+	if nil != err {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+
+	if !ok {
+		dst.Close()
+		http.Error(w, "hijack not supported", http.StatusInternalServerError)
+		return
+	}
+
+	src, _, err := hj.Hijack()
+
+	if nil != err {
+		dst.Close()
+		return
+	}
+
+	logLine("CONNECT %s", r.Host)
+
+	src.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+	go func() {
+		io.Copy(dst, src)
+		dst.Close()
+	}()
+
+	io.Copy(src, dst)
+	src.Close()
+}
+
+func main() {
+
+	if len(os.Args) != 5 {
+		fmt.Fprintf(os.Stderr, "usage: %s <listen addr> <user> <password> "+
+			"<log file>\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	var err error
+
+	Mlog, err = os.OpenFile(os.Args[4], os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+
+	if nil != err {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	Mauth = "Basic " + base64.StdEncoding.EncodeToString(
+		[]byte(os.Args[2]+":"+os.Args[3]))
+
+	if err := http.ListenAndServe(os.Args[1], http.HandlerFunc(handle)); nil != err {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}